@@ -20,6 +20,23 @@ type Client interface {
 	PullConfigs() *Configs
 }
 
+// DigestClient is implemented by clients that can retrieve the digest of the
+// configs of a config endpoint along with the subset of configs assigned to a
+// digest bucket. This allows Poller to only exchange the configs that differ.
+// Functions return nil if the information couldn't be retrieved.
+type DigestClient interface {
+	PullDigest() *ConfigDigest
+	PullTypeDigest(typ string) TypeDigest
+	PullBucket(typ string, bucket int) *Configs
+}
+
+// DeltaClient is implemented by clients that can retrieve only the configs and
+// tombstones that are missing from a container given its ID to version mapping.
+// PullMissing returns nil if the configs couldn't be retrieved.
+type DeltaClient interface {
+	PullMissing(list ConfigList) *Configs
+}
+
 // ClientFactory defines a function type used to create new Client
 // objects from a given URL string. Factories should be registered with the
 // RegisterClient function.
@@ -85,11 +102,23 @@ func (*NullClient) PullConfigs() (configs *Configs) { return }
 
 // Poller periodically polls a configuration endpoint via a Client
 // to either push or pull a set configs into a Router.
+//
+// If the remote client implements DigestClient then the digests of the local
+// and remote configs are compared first and only the configs of the digest
+// buckets that differ are exchanged. If the remote client implements
+// DeltaClient then configs are pulled by sending the version of the local
+// configs and retrieving only the configs that are missing. The poller falls
+// back to exchanging all the configs if either of these fail which is usually
+// the case when polling an endpoint that doesn't support the protocols. The
+// protocols are then skipped for the next pollerProbeSkip polls instead of
+// being probed on every poll.
 type Poller struct {
 
 	// Local indicates the Router object which will act as the config
 	// container and notification handler while polling. Must be set before
-	// calling Init and can't be modified afterwards.
+	// calling Init and can't be modified afterwards. Local is first used by
+	// the initial poll issued by Start so it must be fully set up beforehand
+	// which, for a Router, includes its Handlers.
 	Local Client
 
 	// URL indicates where the config endpoint can be reached. It is used to
@@ -121,9 +150,17 @@ type Poller struct {
 	initialize sync.Once
 	isRunning  bool
 
+	// skipProbes is the number of polls left before the digest and delta
+	// protocols are tried again.
+	skipProbes int
+
 	stopC chan int
 }
 
+// pollerProbeSkip is the number of polls for which the digest and delta
+// protocols are skipped once they failed.
+const pollerProbeSkip = 10
+
 // Init initializes the object.
 func (poller *Poller) Init() {
 	poller.initialize.Do(poller.init)
@@ -194,11 +231,89 @@ func (poller *Poller) Stop() {
 }
 
 func (poller *Poller) poll() {
+	probe := poller.skipProbes == 0
+	if !probe {
+		poller.skipProbes--
+	}
+
+	if remote, ok := poller.Remote.(DigestClient); ok && probe {
+		if digest := remote.PullDigest(); digest == nil {
+			poller.skipProbes = pollerProbeSkip
+		} else if poller.pollDigest(remote, digest) {
+			return
+		}
+	}
+
 	if poller.Push {
 		poller.Remote.PushConfigs(poller.Local.PullConfigs())
 	}
 
-	if poller.Pull {
+	if poller.Pull && !(probe && poller.pullMissing()) {
 		poller.Local.PushConfigs(poller.Remote.PullConfigs())
 	}
 }
+
+// pullMissing pulls the configs that are missing from the local configs.
+// Returns false if the remote client doesn't support the operation, if it
+// failed or if the delta protocols are being skipped.
+func (poller *Poller) pullMissing() bool {
+	remote, ok := poller.Remote.(DeltaClient)
+	if !ok || poller.skipProbes > 0 {
+		return false
+	}
+
+	configs := remote.PullMissing(poller.Local.PullConfigs().List())
+	if configs == nil {
+		poller.skipProbes = pollerProbeSkip
+		return false
+	}
+
+	poller.Local.PushConfigs(configs)
+	return true
+}
+
+// pollDigest exchanges the configs of the digest buckets that differ between the
+// local configs and the given remote digest. Missing configs are pulled in a
+// single request if the remote client implements DeltaClient. Returns false if
+// the type digests couldn't be retrieved.
+func (poller *Poller) pollDigest(remote DigestClient, digest *ConfigDigest) bool {
+	_, isDelta := poller.Remote.(DeltaClient)
+	pull := false
+
+	local := poller.Local.PullConfigs()
+
+	for _, typ := range local.Digest().Diff(digest) {
+		remoteDigest := remote.PullTypeDigest(typ)
+		if remoteDigest == nil {
+			return false
+		}
+
+		var localDigest TypeDigest
+		if state, ok := local.Types[typ]; ok {
+			localDigest = state.Digest()
+		}
+
+		for _, bucket := range localDigest.Diff(remoteDigest) {
+			if poller.Pull && isDelta {
+				pull = true
+
+			} else if poller.Pull {
+				configs := remote.PullBucket(typ, bucket)
+				if configs == nil {
+					return false
+				}
+				poller.Local.PushConfigs(configs)
+			}
+
+			if poller.Push {
+				poller.Remote.PushConfigs(local.Bucket(typ, bucket))
+			}
+		}
+	}
+
+	if pull && !poller.pullMissing() {
+		return false
+	}
+
+	return true
+}
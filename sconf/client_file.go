@@ -0,0 +1,397 @@
+// Copyright (c) 2014 Datacratic. All rights reserved.
+
+package sconf
+
+import (
+	"gopkg.in/yaml.v2"
+
+	"bytes"
+	"crypto/sha1"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// FileClient is a read-only Client which reads configs from a directory of
+// hand-written JSON or YAML files. Each file named <Dir>/<type>/<id>.json,
+// <id>.yaml or <id>.yml contains the data of a single config which is decoded
+// into the type registered with Registry.
+//
+// The directory is rescanned on every call to PullConfigs which is usually
+// driven by a Poller with Pull set. A file that changed since the previous scan
+// produces a new config whose version is the modification time of the file in
+// nanoseconds or, if that's not greater then the previous version, the
+// previous version plus one. A file that is removed produces a tombstone.
+//
+// The last version issued for each file is saved in VersionsFile such that
+// versions never go backwards across restarts, even if a file is replaced by
+// one with an older modification time. Files that are unchanged since the
+// versions were saved keep their version and files removed while the client
+// wasn't running produce a tombstone.
+//
+// Files that can't be decoded are reported via Component.Error and the
+// previous version of the config, if any, is kept around. Since the files are
+// meant to be edited by hand, NewConfig, DeadConfig and PushConfigs do
+// nothing.
+//
+// All the functions of FileClient are safe to call concurrently.
+type FileClient struct {
+	Component
+
+	// Dir indicates the directory containing the config files. Must be set
+	// prior to calling Init and can't be changed afterwards.
+	Dir string
+
+	// VersionsFile indicates the file where the last version issued for each
+	// config file is saved. Defaults to DefaultFileVersionsFile in Dir which
+	// is ignored by the scans. Can't be changed after calling Init.
+	VersionsFile string
+
+	// Registry is used to decode the config files, to stamp the schema version
+	// of the decoded configs and to resolve the siblings of concurrent
+	// updates. Defaults to DefaultTypeRegistry and can't be changed after
+	// calling Init.
+	Registry *TypeRegistry
+
+	initialize sync.Once
+
+	// lock protects the fields below and serializes the scans.
+	lock sync.Mutex
+
+	files map[fileKey]*fileEntry
+
+	// dirty indicates that versions were issued since the last save.
+	dirty bool
+}
+
+// DefaultFileVersionsFile is the default name of the file in the directory of a
+// FileClient where the versions of the config files are saved.
+const DefaultFileVersionsFile = ".versions.json"
+
+type fileKey struct{ Type, ID string }
+
+// fileEntry holds the last known state of a config file.
+type fileEntry struct {
+	path string
+	hash [sha1.Size]byte
+
+	// version is the last version issued for the config or tombstone. Both
+	// config and tombstone are nil if the entry was loaded from the versions
+	// file and the config file wasn't successfully scanned since.
+	version   uint64
+	config    *Config
+	tombstone *Tombstone
+}
+
+// fileVersion is the saved state of a fileEntry. Hash is empty for
+// tombstones.
+type fileVersion struct {
+	Version uint64 `json:"ver"`
+	Hash    []byte `json:"hash,omitempty"`
+}
+
+// NewFileClient creates a new FileClient for the directory indicated by the
+// path of the given file URL.
+func NewFileClient(rawURL string) (Client, error) {
+	URL, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+
+	dir := URL.Host + URL.Path
+	if len(dir) == 0 {
+		return nil, fmt.Errorf("missing directory in config URL '%s'", rawURL)
+	}
+
+	return &FileClient{
+		Component: Component{Name: "file-config-client-" + dir},
+		Dir:       dir,
+	}, nil
+}
+
+// Init initializes the object.
+func (client *FileClient) Init() {
+	client.initialize.Do(client.init)
+}
+
+func (client *FileClient) init() {
+	if len(client.Dir) == 0 {
+		log.Panic("Dir must be set for FileClient")
+	}
+
+	if len(client.VersionsFile) == 0 {
+		client.VersionsFile = filepath.Join(client.Dir, DefaultFileVersionsFile)
+	}
+
+	client.files = make(map[fileKey]*fileEntry)
+	client.loadVersions()
+}
+
+// loadVersions restores the versions saved by saveVersions. A missing file is
+// treated as an empty file.
+func (client *FileClient) loadVersions() {
+	body, err := ioutil.ReadFile(client.VersionsFile)
+	if os.IsNotExist(err) {
+		return
+	}
+
+	var versions map[string]map[string]fileVersion
+	if err == nil {
+		err = json.Unmarshal(body, &versions)
+	}
+
+	if err != nil {
+		client.Error(fmt.Errorf("unable to read versions file '%s': %s", client.VersionsFile, err))
+		return
+	}
+
+	for typ, IDs := range versions {
+		for ID, saved := range IDs {
+			entry := &fileEntry{version: saved.Version}
+			copy(entry.hash[:], saved.Hash)
+
+			if len(saved.Hash) == 0 {
+				entry.tombstone = &Tombstone{Type: typ, ID: ID, Version: saved.Version}
+			}
+
+			client.files[fileKey{Type: typ, ID: ID}] = entry
+		}
+	}
+}
+
+// saveVersions writes the last version issued for each config file.
+func (client *FileClient) saveVersions() {
+	versions := make(map[string]map[string]fileVersion)
+
+	for key, entry := range client.files {
+		if _, ok := versions[key.Type]; !ok {
+			versions[key.Type] = make(map[string]fileVersion)
+		}
+
+		saved := fileVersion{Version: entry.version}
+		if entry.tombstone == nil {
+			saved.Hash = entry.hash[:]
+		}
+		versions[key.Type][key.ID] = saved
+	}
+
+	body, err := json.Marshal(versions)
+	if err == nil {
+		err = writeFileAtomic(client.VersionsFile, body)
+	}
+
+	if err != nil {
+		client.Error(fmt.Errorf("unable to write versions file '%s': %s", client.VersionsFile, err))
+	} else {
+		client.dirty = false
+	}
+}
+
+// NewConfig does nothing.
+func (*FileClient) NewConfig(*Config) {}
+
+// DeadConfig does nothing.
+func (*FileClient) DeadConfig(*Tombstone) {}
+
+// PushConfigs does nothing.
+func (*FileClient) PushConfigs(*Configs) {}
+
+// PullConfigs rescans the directory and returns the configs of all the files
+// currently in the directory along with the tombstones of all the files that
+// were removed.
+func (client *FileClient) PullConfigs() *Configs {
+	client.Init()
+
+	client.lock.Lock()
+	defer client.lock.Unlock()
+
+	seen := make(map[fileKey]bool)
+
+	if types, err := ioutil.ReadDir(client.Dir); err != nil {
+		client.Error(fmt.Errorf("unable to list config dir '%s': %s", client.Dir, err))
+		client.keep(seen, "")
+
+	} else {
+		for _, typ := range types {
+			if typ.IsDir() && !strings.HasPrefix(typ.Name(), ".") {
+				client.scanType(seen, typ.Name())
+			}
+		}
+	}
+
+	now := uint64(time.Now().UnixNano())
+	configs := &Configs{Registry: client.Registry}
+
+	for key, entry := range client.files {
+		if !seen[key] && entry.tombstone == nil {
+			if entry.version < now {
+				entry.version = now
+			}
+
+			entry.tombstone = &Tombstone{Type: key.Type, ID: key.ID, Version: entry.version}
+			entry.config = nil
+			entry.path = ""
+			client.dirty = true
+		}
+
+		if entry.config != nil {
+			configs.NewConfig(entry.config)
+		} else if entry.tombstone != nil {
+			configs.DeadConfig(entry.tombstone)
+		}
+	}
+
+	if client.dirty {
+		client.saveVersions()
+	}
+
+	return configs
+}
+
+// keep marks all the existing configs of the given type, or of all types if
+// empty, as seen such that they don't get killed by a failed scan.
+func (client *FileClient) keep(seen map[fileKey]bool, typ string) {
+	for key := range client.files {
+		if len(typ) == 0 || key.Type == typ {
+			seen[key] = true
+		}
+	}
+}
+
+func (client *FileClient) scanType(seen map[fileKey]bool, typ string) {
+	dir := filepath.Join(client.Dir, typ)
+
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		client.Error(fmt.Errorf("unable to list config dir '%s': %s", dir, err))
+		client.keep(seen, typ)
+		return
+	}
+
+	for _, file := range files {
+		name := file.Name()
+		if file.IsDir() || strings.HasPrefix(name, ".") {
+			continue
+		}
+
+		ext := filepath.Ext(name)
+		if ext != ".json" && ext != ".yaml" && ext != ".yml" {
+			continue
+		}
+
+		path := filepath.Join(dir, name)
+		key := fileKey{Type: typ, ID: strings.TrimSuffix(name, ext)}
+
+		if seen[key] {
+			client.Error(fmt.Errorf("duplicate config file '%s'", path))
+			continue
+		}
+		seen[key] = true
+
+		version := uint64(file.ModTime().UnixNano())
+		if err := client.scanFile(key, path, version); err != nil {
+			client.Error(fmt.Errorf("unable to read config file '%s': %s", path, err))
+		}
+	}
+}
+
+func (client *FileClient) scanFile(key fileKey, path string, version uint64) error {
+	body, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	hash := sha1.Sum(body)
+
+	entry, ok := client.files[key]
+	if ok && entry.config != nil && entry.path == path && entry.hash == hash {
+		return nil
+	}
+
+	data, err := client.Registry.NewConfig(key.Type)
+	if err != nil {
+		return err
+	}
+
+	if filepath.Ext(path) != ".json" {
+		if body, err = yamlToJSON(body); err != nil {
+			return err
+		}
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	if err = decoder.Decode(data); err != nil {
+		return err
+	}
+
+	if !ok {
+		entry = &fileEntry{}
+		client.files[key] = entry
+
+	} else if entry.config == nil && entry.tombstone == nil && entry.hash == hash {
+		// Unchanged since the versions were saved.
+		version = entry.version
+
+	} else if version <= entry.version {
+		version = entry.version + 1
+	}
+
+	client.dirty = client.dirty || entry.version != version
+
+	entry.path = path
+	entry.hash = hash
+	entry.version = version
+	entry.tombstone = nil
+	entry.config = client.Registry.stamp(&Config{
+		Type:    key.Type,
+		ID:      key.ID,
+		Version: version,
+		Data:    data,
+	})
+
+	return nil
+}
+
+// yamlToJSON converts a YAML document to JSON such that it can be decoded using
+// the json tags of the registered config types.
+func yamlToJSON(body []byte) ([]byte, error) {
+	var value interface{}
+	if err := yaml.Unmarshal(body, &value); err != nil {
+		return nil, err
+	}
+
+	return json.Marshal(yamlToJSONValue(value))
+}
+
+func yamlToJSONValue(value interface{}) interface{} {
+	switch value := value.(type) {
+
+	case map[interface{}]interface{}:
+		result := make(map[string]interface{})
+		for key, item := range value {
+			result[fmt.Sprint(key)] = yamlToJSONValue(item)
+		}
+		return result
+
+	case []interface{}:
+		for i, item := range value {
+			value[i] = yamlToJSONValue(item)
+		}
+		return value
+
+	default:
+		return value
+
+	}
+}
+
+func init() {
+	RegisterClient("file", NewFileClient)
+}
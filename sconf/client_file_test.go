@@ -0,0 +1,203 @@
+// Copyright (c) 2014 Datacratic. All rights reserved.
+
+package sconf
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func (t ConfigPersistUtilsTest) WriteFile(path, body string) {
+	if err := ioutil.WriteFile(path, []byte(body), 0664); err != nil {
+		t.Fatalf("FAIL: unable to write '%s': %s", path, err)
+	}
+}
+
+func (t ConfigPersistUtilsTest) Pull(title string, client Client) *TypeConfigs {
+	state, ok := client.PullConfigs().Types[TestConfigType]
+	if !ok {
+		t.Errorf("FAIL(%s): missing config type: %s", title, TestConfigType)
+		return &TypeConfigs{}
+	}
+	return state
+}
+
+func (t ConfigPersistUtilsTest) Version(title string, state *TypeConfigs, ID string) uint64 {
+	result, ok := state.Get(ID)
+	if !ok {
+		t.Errorf("FAIL(%s): missing config %s", title, ID)
+		return 0
+	}
+
+	if result.Config != nil {
+		return result.Config.Version
+	}
+	return result.Tombstone.Version
+}
+
+func (t ConfigPersistUtilsTest) Data(title string, state *TypeConfigs, ID, exp string) {
+	config, ok := state.Configs.Get(ID)
+	if !ok {
+		t.Errorf("FAIL(%s): missing config %s", title, ID)
+
+	} else if data := config.Data.(*TestConfig).Data; data != exp {
+		t.Errorf("FAIL(%s): unexpected data for %s: %s != %s", title, ID, data, exp)
+	}
+}
+
+func TestFileClient(t *testing.T) {
+	test := NewConfigPersistUtilsTest(t)
+
+	dir := test.NewDir()
+	defer os.RemoveAll(dir)
+
+	if err := os.MkdirAll(dir+"/"+TestConfigType, 0775); err != nil {
+		t.Fatalf("FAIL: unable to create dir: %s", err)
+	}
+
+	test.WriteFile(dir+"/test/c0.json", `{ "data": "d0" }`)
+	test.WriteFile(dir+"/test/c1.yaml", "data: d1\n")
+	test.WriteFile(dir+"/test/c2.yml", "data: [ d2")
+	test.WriteFile(dir+"/test/README", "ignored")
+
+	client, err := NewClient("file://" + dir)
+	if err != nil {
+		t.Fatalf("FAIL: unable to create client: %s", err)
+	}
+
+	state0 := test.Pull("pull0", client)
+	test.DiffConfigs("pull0", state0,
+		test.Config("c0", test.Version("pull0", state0, "c0"), "d0"),
+		test.Config("c1", test.Version("pull0", state0, "c1"), "d1"))
+	test.DiffTombs("pull0", state0)
+	test.Data("pull0", state0, "c0", "d0")
+	test.Data("pull0", state0, "c1", "d1")
+
+	// Unchanged files must keep their version.
+	state1 := test.Pull("pull1", client)
+	for _, ID := range []string{"c0", "c1"} {
+		if v0, v1 := test.Version("pull0", state0, ID), test.Version("pull1", state1, ID); v0 != v1 {
+			t.Errorf("FAIL(pull1): unexpected version change for %s: %d != %d", ID, v0, v1)
+		}
+	}
+
+	test.WriteFile(dir+"/test/c0.json", `{ "data": "d3" }`)
+	test.WriteFile(dir+"/test/c2.yml", "data: d2\n")
+	os.Remove(dir + "/test/c1.yaml")
+
+	state2 := test.Pull("pull2", client)
+	test.DiffConfigs("pull2", state2,
+		test.Config("c0", test.Version("pull2", state2, "c0"), "d3"),
+		test.Config("c2", test.Version("pull2", state2, "c2"), "d2"))
+	test.DiffTombs("pull2", state2,
+		test.Tomb("c1", test.Version("pull2", state2, "c1")))
+
+	if v0, v2 := test.Version("pull0", state0, "c0"), test.Version("pull2", state2, "c0"); v2 <= v0 {
+		t.Errorf("FAIL(pull2): version wasn't bumped: %d <= %d", v2, v0)
+	}
+
+	if v0, v2 := test.Version("pull0", state0, "c1"), test.Version("pull2", state2, "c1"); v2 < v0 {
+		t.Errorf("FAIL(pull2): tombstone doesn't kill config: %d < %d", v2, v0)
+	}
+
+	// A broken edit keeps the previous version of the config around.
+	test.WriteFile(dir+"/test/c0.json", `{ "data": `)
+	test.WriteFile(dir+"/test/c1.yaml", "data: d4\n")
+
+	state3 := test.Pull("pull3", client)
+	test.DiffConfigs("pull3", state3,
+		test.Config("c0", test.Version("pull2", state2, "c0"), "d3"),
+		test.Config("c1", test.Version("pull3", state3, "c1"), "d4"),
+		test.Config("c2", test.Version("pull2", state2, "c2"), "d2"))
+	test.DiffTombs("pull3", state3)
+	test.Data("pull3", state3, "c0", "d3")
+	test.Data("pull3", state3, "c1", "d4")
+
+	if v2, v3 := test.Version("pull2", state2, "c1"), test.Version("pull3", state3, "c1"); v3 <= v2 {
+		t.Errorf("FAIL(pull3): config doesn't replace tombstone: %d <= %d", v3, v2)
+	}
+}
+
+func TestFileClientRestart(t *testing.T) {
+	test := NewConfigPersistUtilsTest(t)
+
+	dir := test.NewDir()
+	defer os.RemoveAll(dir)
+
+	if err := os.MkdirAll(dir+"/"+TestConfigType, 0775); err != nil {
+		t.Fatalf("FAIL: unable to create dir: %s", err)
+	}
+
+	test.WriteFile(dir+"/test/c0.json", `{ "data": "d0" }`)
+	test.WriteFile(dir+"/test/c1.json", `{ "data": "d1" }`)
+	test.WriteFile(dir+"/test/c2.json", `{ "data": "d2" }`)
+
+	state0 := test.Pull("pull0", &FileClient{Dir: dir})
+
+	// Replace a file with one that has an older modification time and remove
+	// another one while no client is running.
+	test.WriteFile(dir+"/test/c0.json", `{ "data": "d3" }`)
+	old := time.Now().Add(-time.Hour)
+	if err := os.Chtimes(dir+"/test/c0.json", old, old); err != nil {
+		t.Fatalf("FAIL: unable to change times: %s", err)
+	}
+	os.Remove(dir + "/test/c2.json")
+
+	state1 := test.Pull("pull1", &FileClient{Dir: dir})
+	test.Data("pull1", state1, "c0", "d3")
+	test.DiffTombs("pull1", state1,
+		test.Tomb("c2", test.Version("pull1", state1, "c2")))
+
+	if v0, v1 := test.Version("pull0", state0, "c0"), test.Version("pull1", state1, "c0"); v1 <= v0 {
+		t.Errorf("FAIL(older): version went backwards: %d <= %d", v1, v0)
+	}
+
+	if v0, v1 := test.Version("pull0", state0, "c1"), test.Version("pull1", state1, "c1"); v0 != v1 {
+		t.Errorf("FAIL(unchanged): unexpected version change: %d != %d", v0, v1)
+	}
+
+	if v0, v1 := test.Version("pull0", state0, "c2"), test.Version("pull1", state1, "c2"); v1 < v0 {
+		t.Errorf("FAIL(removed): tombstone doesn't kill config: %d < %d", v1, v0)
+	}
+
+	// Tombstones keep their version across restarts.
+	state2 := test.Pull("pull2", &FileClient{Dir: dir})
+	if v1, v2 := test.Version("pull1", state1, "c2"), test.Version("pull2", state2, "c2"); v1 != v2 {
+		t.Errorf("FAIL(tombstone): unexpected version change: %d != %d", v1, v2)
+	}
+}
+
+func TestFileClientRegistry(t *testing.T) {
+	test := NewConfigPersistUtilsTest(t)
+
+	dir := test.NewDir()
+	defer os.RemoveAll(dir)
+
+	if err := os.MkdirAll(dir+"/"+TestSchemaConfigType, 0775); err != nil {
+		t.Fatalf("FAIL: unable to create dir: %s", err)
+	}
+
+	test.WriteFile(dir+"/"+TestSchemaConfigType+"/c0.yaml", "data: d0\ncount: 3\n")
+
+	// The type isn't registered with the default registry.
+	if configs := (&FileClient{Dir: dir}).PullConfigs(); configs.Len() != 0 {
+		t.Errorf("FAIL(default): unexpected configs %s", configs)
+	}
+
+	client := &FileClient{Dir: dir, Registry: NewTestSchemaRegistry()}
+
+	result, _ := client.PullConfigs().Get(TestSchemaConfigType, "c0")
+	if result.Config == nil {
+		t.Fatalf("FAIL(registry): missing config")
+	}
+
+	if data, ok := result.Config.Data.(*TestSchemaConfig); !ok || *data != (TestSchemaConfig{"d0", 3}) {
+		t.Errorf("FAIL(registry): unexpected data %v", result.Config.Data)
+	}
+
+	if result.Config.Schema != 2 {
+		t.Errorf("FAIL(registry): unexpected schema %d != 2", result.Config.Schema)
+	}
+}
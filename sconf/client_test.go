@@ -0,0 +1,71 @@
+// Copyright (c) 2014 Datacratic. All rights reserved.
+
+package sconf
+
+import (
+	"testing"
+)
+
+type TestDeltaClient struct {
+	*Router
+	Lists  int
+	Failed bool
+}
+
+func (client *TestDeltaClient) PullMissing(list ConfigList) *Configs {
+	client.Lists++
+	if client.Failed {
+		return nil
+	}
+	return client.PullConfigs().Missing(list)
+}
+
+func TestPollerDelta(t *testing.T) {
+	test := NewTestRouterUtils(t)
+
+	local := test.NewRouter()
+	remote := &TestDeltaClient{Router: test.NewRouter()}
+
+	local.NewConfig(test.Config("c0", 1))
+	remote.NewConfig(test.Config("c0", 2))
+	remote.NewConfig(test.Config("c1", 1))
+	test.WaitForPropagation()
+
+	poller := &Poller{Local: local, Remote: remote, Pull: true}
+	poller.Init()
+
+	poller.poll()
+	test.WaitForPropagation()
+	local.Expect(test, test.Config("c0", 2), test.Config("c1", 1))
+
+	if remote.Lists != 1 {
+		t.Errorf("FAIL(delta): unexpected delta pulls %d != 1", remote.Lists)
+	}
+
+	// Endpoints that don't support the protocol fall back to a full pull.
+	remote.Failed = true
+	remote.DeadConfig(test.Tomb("c1", 2))
+	test.WaitForPropagation()
+
+	poller.poll()
+	test.WaitForPropagation()
+	local.Expect(test, test.Config("c0", 2))
+
+	if remote.Lists != 2 {
+		t.Errorf("FAIL(fallback): unexpected delta pulls %d != 2", remote.Lists)
+	}
+
+	// The protocol isn't probed again on every poll.
+	for i := 0; i < pollerProbeSkip; i++ {
+		poller.poll()
+	}
+	if remote.Lists != 2 {
+		t.Errorf("FAIL(skip): unexpected delta pulls %d != 2", remote.Lists)
+	}
+
+	remote.Failed = false
+	poller.poll()
+	if remote.Lists != 3 {
+		t.Errorf("FAIL(probe): unexpected delta pulls %d != 3", remote.Lists)
+	}
+}
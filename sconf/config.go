@@ -13,12 +13,50 @@
 // merging, A tombstone at version X will replace a config at version Y if X >=
 // Y and a config at version X will replace a tombstone at version Y if X > Y.
 //
+// Two configs with the same version but different data are in conflict which
+// usually indicates a misbehaving writer. To keep the merge commutative, the
+// conflict is resolved by keeping the config whose data has the greatest hash
+// of its JSON encoding. This assumes that the JSON encoding of the data is
+// canonical which is the case for structs and maps but requires that the data
+// decodes and re-encodes to the same JSON.
+//
+// Since a single version can't tell apart a newer config from a concurrent one,
+// configs can optionally carry a version vector which tracks the updates made
+// by each writer. When both configs being merged have a vector, the merge keeps
+// every config that doesn't happen before another one. Concurrent configs are
+// kept as the siblings of a new config whose vector and version descend from
+// all of them which is then forwarded to handlers like any other config. The
+// siblings are collapsed by the Resolver registered with the type, if any.
+// Tombstones don't have vectors and a tombstone kills a config whose scalar
+// version is lower or equal. The delta pull can't tell apart concurrent configs
+// that have the same version so the version of a config with a vector should
+// be derived from its vector via VersionVector.Version.
+//
 // Additionally, configs are seperated by types which is used for serialization
 // and for routing.
+//
+// Tombstones must be kept around for as long as a peer could still send us an
+// older version of the config they killed, otherwise the config would be
+// resurrected by the merge. To avoid accumulating tombstones forever, they can
+// be garbage collected below a version horizon: all tombstones with a version
+// lower then the horizon are dropped and, from then on, configs and tombstones
+// for unknown IDs with a version lower then the horizon are rejected as if a
+// tombstone was still present. This makes the horizon itself act as a compact
+// tombstone for every collected ID.
+//
+// The horizon is only safe if no peer can still hold a config at a version
+// below the horizon that it didn't already send us. TombstoneCollector derives
+// the horizon from either a grace period, which assumes that no peer stays
+// partitioned for longer, or from the versions acknowledged by every known
+// peer. Since the horizon applies to all IDs of a type, GC also requires that
+// versions are comparable across IDs which is the case when versions are
+// derived from a clock. GC is disabled unless a horizon is explicitly set.
 
 package sconf
 
 import (
+	"bytes"
+	"crypto/sha1"
 	"encoding/json"
 	"fmt"
 )
@@ -45,6 +83,24 @@ type Config struct {
 	ID      string      `json:"id"`
 	Version uint64      `json:"ver"`
 	Data    interface{} `json:"data,omitempty"`
+
+	// Schema is the schema version of the data. Set when the config is
+	// decoded or pushed into a Router or a config database based on the Schema
+	// registered with the type in their TypeRegistry. See Schema for more
+	// details.
+	Schema int `json:"schema,omitempty"`
+
+	// Labels optionally associates metadata with the config which can be
+	// queried via Selector objects.
+	Labels map[string]string `json:"labels,omitempty"`
+
+	// Vector optionally tracks the causal history of the config. See the
+	// package notes for more details.
+	Vector VersionVector `json:"vv,omitempty"`
+
+	// Siblings contains the configs of a concurrent update that weren't
+	// resolved. Data is nil if Siblings is set.
+	Siblings []*Config `json:"siblings,omitempty"`
 }
 
 // Tombstone returns a Tombstone that will kill the config object.
@@ -56,33 +112,78 @@ func (config *Config) Tombstone() *Tombstone {
 	}
 }
 
-// UnmarshalJSON deserializes the given json blob as a Config object. Makes use
-// of the config type registry to deserialize the config object and returns an
-// error if the type was not registered with the config type registry.
-func (config *Config) UnmarshalJSON(body []byte) (err error) {
-	var configJSON struct {
-		Type    string          `json:"type"`
-		ID      string          `json:"id"`
-		Version uint64          `json:"ver"`
-		Data    json.RawMessage `json:"data,omitempty"`
+// dataHash returns the hash of the JSON encoding of the config's data or of its
+// siblings if it has any. Labels are included if present.
+func (config *Config) dataHash() []byte {
+	var value interface{} = config.Data
+	if len(config.Siblings) > 0 {
+		value = config.Siblings
 	}
 
-	if err = json.Unmarshal(body, &configJSON); err != nil {
-		return
+	if len(config.Labels) > 0 {
+		value = []interface{}{value, config.Labels}
 	}
 
-	config.Type = configJSON.Type
-	config.ID = configJSON.ID
-	config.Version = configJSON.Version
-	if configJSON.Data == nil {
-		return
+	body, err := json.Marshal(value)
+	if err != nil {
+		// Unencodable data should never make it this far so we just need to
+		// be consistent.
+		body = []byte(err.Error())
+	}
+
+	hash := sha1.Sum(body)
+	return hash[:]
+}
+
+// dataHashes caches the data hashes computed while processing a single event
+// such that the data of each config is encoded and hashed at most once. A nil
+// cache computes the hashes without caching them.
+type dataHashes map[*Config][]byte
+
+func (hashes dataHashes) of(config *Config) []byte {
+	if hash, ok := hashes[config]; ok {
+		return hash
 	}
 
-	if config.Data, err = NewConfig(configJSON.Type); err != nil {
-		return
+	hash := config.dataHash()
+	if hashes != nil {
+		hashes[config] = hash
 	}
+	return hash
+}
+
+// IsConflict returns true if both configs have the same type, ID, version and
+// version vector but different data.
+func IsConflict(a, b *Config) bool {
+	return isConflict(a, b, nil)
+}
+
+func isConflict(a, b *Config, hashes dataHashes) bool {
+	return a != b && a.Type == b.Type && a.ID == b.ID && a.Version == b.Version &&
+		a.Vector.Compare(b.Vector) == VectorEqual &&
+		!bytes.Equal(hashes.of(a), hashes.of(b))
+}
+
+// wins returns true if config should replace other which has the same version.
+func (config *Config) wins(other *Config, hashes dataHashes) bool {
+	return config != other && bytes.Compare(hashes.of(config), hashes.of(other)) > 0
+}
+
+// UnmarshalJSON deserializes the given json blob as a Config object. Makes use
+// of DefaultTypeRegistry to deserialize the config object and returns an error
+// if the type was not registered with the config type registry unless
+// DefaultTypeRegistry.Passthrough is set. Use TypeRegistry.Unmarshal to decode
+// with another registry.
+func (config *Config) UnmarshalJSON(body []byte) error {
+	return DefaultTypeRegistry.Unmarshal(body, config)
+}
 
-	return json.Unmarshal(configJSON.Data, config.Data)
+// Decode returns a copy of the config where data kept as a json.RawMessage
+// because its type wasn't registered is decoded into the type registered with
+// DefaultTypeRegistry. See TypeRegistry.Passthrough and TypeRegistry.Decode for
+// more details.
+func (config *Config) Decode() (*Config, error) {
+	return DefaultTypeRegistry.Decode(config)
 }
 
 // String returns a string representation of the config suitable for debugging.
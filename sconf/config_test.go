@@ -97,7 +97,7 @@ func (t TestConfigUtils) Diff(title string, configs []*Config, exp ...*Config) {
 
 func (t TestConfigUtils) DiffConfigs(title string, state *TypeConfigs, exp ...*Config) {
 	var configs []*Config
-	for _, config := range state.Configs {
+	for _, config := range state.Configs.Map() {
 		configs = append(configs, config)
 	}
 
@@ -110,7 +110,7 @@ func (t TestConfigUtils) DiffTombs(title string, state *TypeConfigs, exp ...*Tom
 	}
 
 	var tombs []*Config
-	for _, tomb := range state.Tombstones {
+	for _, tomb := range state.Tombstones.Map() {
 		tombs = append(tombs, toConfig(tomb))
 	}
 
@@ -174,3 +174,105 @@ func TestConfigs(test *testing.T) {
 
 	t.Rmv(c, t.Config("c0", 0), nil, true)
 }
+
+func TestConfigConflict(t *testing.T) {
+	a := (&TestConfig{Data: "a"}).Wrap("c0", 1)
+	b := (&TestConfig{Data: "b"}).Wrap("c0", 1)
+
+	if !IsConflict(a, b) || IsConflict(a, a) {
+		t.Errorf("FAIL(conflict): conflict not detected")
+	}
+
+	// The same config must win regardless of the order of the merge.
+	ab := &Configs{}
+	ab.NewConfig(a)
+	ab.NewConfig(b)
+
+	ba := &Configs{}
+	ba.NewConfig(b)
+	ba.NewConfig(a)
+
+	resultAB, _ := ab.Get(TestConfigType, "c0")
+	resultBA, _ := ba.Get(TestConfigType, "c0")
+
+	if resultAB.Config != resultBA.Config {
+		t.Errorf("FAIL(merge): diverged %v != %v", resultAB.Config.Data, resultBA.Config.Data)
+	}
+
+	if _, isNew := ab.NewConfig((&TestConfig{Data: resultAB.Config.Data.(*TestConfig).Data}).Wrap("c0", 1)); isNew {
+		t.Errorf("FAIL(same): identical config was new")
+	}
+}
+
+type TestCountingData struct{ Encodings int }
+
+func (data *TestCountingData) MarshalJSON() ([]byte, error) {
+	data.Encodings++
+	return []byte(`{}`), nil
+}
+
+func TestConfigHashOnce(t *testing.T) {
+	a, b := &TestCountingData{}, &TestCountingData{}
+	configA := &Config{Type: TestConfigType, ID: "c0", Version: 1, Data: a}
+	configB := &Config{Type: TestConfigType, ID: "c0", Version: 1, Data: b}
+
+	configs := &Configs{}
+	configs.NewConfig(configA)
+	a.Encodings = 0
+
+	if configs.NewConfig(configA); a.Encodings != 0 {
+		t.Errorf("FAIL(same): unexpected encodings %d != 0", a.Encodings)
+	}
+
+	if configs.NewConfig(configB); a.Encodings != 1 || b.Encodings != 1 {
+		t.Errorf("FAIL(conflict): unexpected encodings %d %d != 1", a.Encodings, b.Encodings)
+	}
+}
+
+func TestConfigsMissing(test *testing.T) {
+	t := NewTestConfigsUtils(test)
+
+	a := &Configs{}
+	a.NewConfig(t.Config("c0", 1))
+	a.NewConfig(t.Config("c1", 2))
+	a.NewConfig(t.Config("c2", 1))
+	a.DeadConfig(t.Tomb("c3", 2))
+	a.DeadConfig(t.Tomb("c4", 1))
+	a.NewConfig(t.ConfigT("other", "c5", 1))
+
+	b := &Configs{}
+	b.NewConfig(t.Config("c0", 1))
+	b.NewConfig(t.Config("c1", 1))
+	b.DeadConfig(t.Tomb("c2", 1))
+	b.NewConfig(t.Config("c3", 2))
+	b.DeadConfig(t.Tomb("c4", 2))
+	b.NewConfig(t.Config("c6", 1))
+
+	missing := a.Missing(b.List())
+	t.DiffConfigs("missing-live", missing.Types[TestConfigType], t.Config("c1", 2))
+	t.DiffTombs("missing-dead", missing.Types[TestConfigType], t.Tomb("c3", 2))
+	t.DiffConfigs("missing-type", missing.Types["other"], t.ConfigT("other", "c5", 1))
+
+	b.Merge(missing)
+	if newConfigs, deadConfigs := b.Diff(a); len(newConfigs) != 0 || len(deadConfigs) != 0 {
+		t.Errorf("FAIL(merge): not synced %v %v", newConfigs, deadConfigs)
+	}
+
+	if missing := a.Missing(a.List()); missing.Len() != 0 {
+		t.Errorf("FAIL(self): unexpected missing configs %v", missing)
+	}
+
+	c := &Configs{}
+	c.NewConfig((&TestConfig{Data: "conflict"}).Wrap("c0", 1))
+
+	list := a.List()
+	list[TestConfigType].Hashes["c0"] = c.List()[TestConfigType].Hashes["c0"]
+
+	missing = a.Missing(list)
+	t.DiffConfigs("conflict", missing.Types[TestConfigType], t.Config("c0", 1))
+
+	list[TestConfigType].Hashes = nil
+	if missing := a.Missing(list); missing.Len() != 0 {
+		t.Errorf("FAIL(no-hashes): unexpected missing configs %v", missing)
+	}
+}
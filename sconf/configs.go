@@ -23,10 +23,13 @@ type ConfigResult struct {
 }
 
 // TypeConfigList contains the ID to version mapping of all configs and
-// tombstones for a given type.
+// tombstones for a given type. Hashes contains the hash of the data and version
+// vector of each config which is used to detect conflicting configs of the same
+// version.
 type TypeConfigList struct {
 	Configs    map[string]uint64 `json:"live,omitempty"`
 	Tombstones map[string]uint64 `json:"dead,omitempty"`
+	Hashes     map[string]uint64 `json:"hashes,omitempty"`
 }
 
 // ConfigList contains the ID to version mapping of all configs and tombstones
@@ -40,11 +43,27 @@ type Configs struct {
 	// Types contains the set of configs and tombstones associated with a given
 	// tombstones.
 	Types map[string]*TypeConfigs
+
+	// Horizon indicates the version below which tombstones were garbage
+	// collected. Inherited by the TypeConfigs created after the collection.
+	// See GC for more details. The horizon is local to the container and isn't
+	// serialized.
+	Horizon uint64 `json:"-"`
+
+	// Retention indicates the number of history entries to keep for each type.
+	// The entry for the empty type name applies to all the types not in the
+	// map. Should be modified via SetRetention and isn't serialized.
+	Retention map[string]int `json:"-"`
+
+	// Registry is used to resolve the siblings of concurrent updates and is
+	// inherited by the TypeConfigs. Defaults to DefaultTypeRegistry and isn't
+	// serialized.
+	Registry *TypeRegistry `json:"-"`
 }
 
 // Copy performs a deep copy of the object.
 func (configs *Configs) Copy() (other *Configs) {
-	other = &Configs{}
+	other = &Configs{Horizon: configs.Horizon, Retention: configs.Retention, Registry: configs.Registry}
 	other.Types = make(map[string]*TypeConfigs)
 
 	if configs.Types == nil || len(configs.Types) == 0 {
@@ -67,11 +86,19 @@ func (configs *Configs) getState(typ string) *TypeConfigs {
 		return state
 	}
 
-	state := &TypeConfigs{}
+	state := &TypeConfigs{Horizon: configs.Horizon, Retention: configs.retention(typ), Registry: configs.Registry}
 	configs.Types[typ] = state
 	return state
 }
 
+func (configs *Configs) setRegistry(registry *TypeRegistry) {
+	configs.Registry = registry
+
+	for _, state := range configs.Types {
+		state.Registry = registry
+	}
+}
+
 // Len returns the number of configs and tombstones for all types.
 func (configs *Configs) Len() (size int) {
 	for _, state := range configs.Types {
@@ -110,7 +137,11 @@ func (configs *Configs) Get(typ, ID string) (ConfigResult, bool) {
 // config is new and it replaces an existing config then the old config being
 // replaced is returned.
 func (configs *Configs) NewConfig(config *Config) (oldConfig *Config, isNew bool) {
-	return configs.getState(config.Type).NewConfig(config)
+	return configs.newConfig(config, make(dataHashes))
+}
+
+func (configs *Configs) newConfig(config *Config, hashes dataHashes) (oldConfig *Config, isNew bool) {
+	return configs.getState(config.Type).newConfig(config, hashes)
 }
 
 // DeadConfig adds the config tombstones and returns a boolean to indicate
@@ -141,7 +172,8 @@ func (configs *Configs) Merge(other *Configs) (newConfigs []*Config, deadConfigs
 
 // Diff returns the configs and tombstones that would be added if invoked by any
 // of the mutating functions. This does not modify the object and the Data field
-// is never looked at in the Config objects.
+// of the Config objects is only looked at to resolve conflicts between configs
+// of the same version and to merge configs with version vectors.
 func (configs *Configs) Diff(other *Configs) (newConfigs []*Config, deadConfigs []*Tombstone) {
 	for typ, state := range other.Types {
 		live, dead := configs.getState(typ).Diff(state)
@@ -153,12 +185,43 @@ func (configs *Configs) Diff(other *Configs) (newConfigs []*Config, deadConfigs
 	return
 }
 
+// Missing returns the configs and tombstones that a container with the given
+// ID to version mapping is missing. Configs of the same version are considered
+// missing if their hash differs from the one in the mapping.
+func (configs *Configs) Missing(list ConfigList) *Configs {
+	result := &Configs{Types: make(map[string]*TypeConfigs)}
+
+	for typ, state := range configs.Types {
+		if missing := state.Missing(list[typ]); missing.Len() > 0 {
+			result.Types[typ] = missing
+		}
+	}
+
+	return result
+}
+
+// GC garbage collects all the tombstones whose version is strictly lower then
+// horizon and returns the collected tombstones. Once collected, configs and
+// tombstones for unknown IDs are only accepted if their version is greater or
+// equal to the horizon which prevents stale peers from resurrecting a collected
+// ID. The history of the collected IDs is dropped. The horizon never decreases
+// and is not propagated by Merge.
+func (configs *Configs) GC(horizon uint64) (collected []*Tombstone) {
+	if horizon > configs.Horizon {
+		configs.Horizon = horizon
+	}
+
+	for _, state := range configs.Types {
+		collected = append(collected, state.GC(horizon)...)
+	}
+
+	return
+}
+
 // ConfigArray returns an array of all the configs in this container.
 func (configs *Configs) ConfigArray() (result []*Config) {
 	for _, state := range configs.Types {
-		for _, config := range state.Configs {
-			result = append(result, config)
-		}
+		result = append(result, state.ConfigArray()...)
 	}
 	return
 }
@@ -166,9 +229,7 @@ func (configs *Configs) ConfigArray() (result []*Config) {
 // TombstoneArray returns an array of all the tombstones in this container.
 func (configs *Configs) TombstoneArray() (result []*Tombstone) {
 	for _, state := range configs.Types {
-		for _, tombstone := range state.Tombstones {
-			result = append(result, tombstone)
-		}
+		result = append(result, state.TombstoneArray()...)
 	}
 	return
 }
@@ -187,71 +248,79 @@ func (configs *Configs) String() string {
 	return buffer.String()
 }
 
-// TypeConfigs container for configs and tombstone of a given type.
+// TypeConfigs container for configs and tombstone of a given type. The Configs
+// and Tombstones maps are persistent maps which makes copies of the container
+// O(1). They should only be modified via the mutating functions such that the
+// digest of the container remains accurate.
 type TypeConfigs struct {
 
 	// Configs contains a mapping of config ID to configs. An ID present in this
 	// map will not be present in Tombstones.
-	Configs map[string]*Config
+	Configs ConfigMap
 
 	// Tombstones contains a mapping of config ID to tombstones. An ID present
 	// in this map will not be present in Configs.
-	Tombstones map[string]*Tombstone
-}
+	Tombstones TombstoneMap
 
-// Copy performs a deep copy of the container. Note that config and tombstones
-// are assumed to be immutable so they will not be copied.
-func (configs *TypeConfigs) Copy() *TypeConfigs {
-	result := &TypeConfigs{}
+	// Horizon indicates the version below which tombstones were garbage
+	// collected. Configs and tombstones for IDs that are not in the container
+	// are rejected if their version is lower then the horizon.
+	Horizon uint64
 
-	if configs.Configs != nil && len(configs.Configs) > 0 {
-		result.Configs = make(map[string]*Config)
+	// Retention indicates the maximum number of entries kept in the history
+	// of each ID.
+	Retention int
 
-		for ID, config := range configs.Configs {
-			result.Configs[ID] = config
-		}
-	}
-
-	if configs.Tombstones != nil && len(configs.Tombstones) > 0 {
-		result.Tombstones = make(map[string]*Tombstone)
+	// Registry is used to resolve the siblings of concurrent updates. Defaults
+	// to DefaultTypeRegistry.
+	Registry *TypeRegistry
 
-		for _, tombstone := range configs.Tombstones {
-			result.Tombstones[tombstone.ID] = tombstone
-		}
-	}
+	// history contains the History of each ID. Only maintained if Retention
+	// is greater then 0.
+	history pmap
 
-	return result
+	// digest is maintained by the mutating functions once it's computed.
+	digest *sharedDigest
 }
 
-// Len returns the number of configs and tombstones.
-func (configs *TypeConfigs) Len() (size int) {
-	if configs.Configs != nil {
-		size += len(configs.Configs)
-	}
+// Copy performs a copy of the container which is O(1) since the maps of the
+// container are persistent and the digest is copied on write. Note that config
+// and tombstones are assumed to be immutable so they will not be copied.
+func (configs *TypeConfigs) Copy() *TypeConfigs {
+	result := *configs
 
-	if configs.Tombstones != nil {
-		size += len(configs.Tombstones)
+	if configs.digest != nil {
+		configs.digest.share()
 	}
 
-	return
+	return &result
+}
+
+// Len returns the number of configs and tombstones.
+func (configs *TypeConfigs) Len() int {
+	return configs.Configs.Len() + configs.Tombstones.Len()
 }
 
 // List returns an ID to version mapping of the configs.
 func (configs *TypeConfigs) List() *TypeConfigList {
 	result := &TypeConfigList{}
 
-	if len(configs.Configs) > 0 {
+	if configs.Configs.Len() > 0 {
 		result.Configs = make(map[string]uint64)
-		for ID, config := range configs.Configs {
+		result.Hashes = make(map[string]uint64)
+		configs.Configs.Range(func(ID string, config *Config) bool {
 			result.Configs[ID] = config.Version
-		}
+			result.Hashes[ID] = configEntry(config, nil)
+			return true
+		})
 	}
 
-	if len(configs.Tombstones) > 0 {
+	if configs.Tombstones.Len() > 0 {
 		result.Tombstones = make(map[string]uint64)
-		for ID, config := range configs.Tombstones {
-			result.Tombstones[ID] = config.Version
-		}
+		configs.Tombstones.Range(func(ID string, tombstone *Tombstone) bool {
+			result.Tombstones[ID] = tombstone.Version
+			return true
+		})
 	}
 
 	return result
@@ -260,73 +329,97 @@ func (configs *TypeConfigs) List() *TypeConfigList {
 // Get returns the config or tombstone associated with the given ID and a bool
 // indicating whether the ID is present in the container.
 func (configs *TypeConfigs) Get(ID string) (ConfigResult, bool) {
-	if configs.Configs != nil {
-		if config, ok := configs.Configs[ID]; ok {
-			return ConfigResult{Config: config}, true
-		}
+	if config, ok := configs.Configs.Get(ID); ok {
+		return ConfigResult{Config: config}, true
 	}
 
-	if configs.Tombstones != nil {
-		if tombstone, ok := configs.Tombstones[ID]; ok {
-			return ConfigResult{Tombstone: tombstone}, true
-		}
+	if tombstone, ok := configs.Tombstones.Get(ID); ok {
+		return ConfigResult{Tombstone: tombstone}, true
 	}
 
 	return ConfigResult{}, false
 }
 
-func (configs *TypeConfigs) isNewConfig(ID string, version uint64) bool {
-	if configs.Configs != nil {
-		if config, ok := configs.Configs[ID]; ok {
-			return version > config.Version
-		}
+// mergeConfig returns the config that would be stored if the given config was
+// added and whether it's new. The returned config differs from the given config
+// only if both the given config and the existing config have version vectors.
+func (configs *TypeConfigs) mergeConfig(newConfig *Config, hashes dataHashes) (*Config, bool) {
+	config, ok := configs.Configs.Get(newConfig.ID)
+	if !ok || config.Vector == nil || newConfig.Vector == nil {
+		return newConfig, configs.isNewConfig(newConfig, hashes)
+	}
+
+	if config == newConfig {
+		return config, false
+	}
+
+	merged := mergeCausal(config, newConfig, configs.Registry.resolver(newConfig.Type), hashes)
+	merged = configs.Registry.stamp(merged)
+
+	if merged == config || merged.Vector.Compare(config.Vector) == VectorEqual &&
+		bytes.Equal(hashes.of(merged), hashes.of(config)) {
+		return config, false
 	}
 
-	if configs.Tombstones != nil {
-		if tombstone, ok := configs.Tombstones[ID]; ok {
-			return version > tombstone.Version
+	return merged, true
+}
+
+func (configs *TypeConfigs) isNewConfig(newConfig *Config, hashes dataHashes) bool {
+	if config, ok := configs.Configs.Get(newConfig.ID); ok {
+		if newConfig.Version == config.Version {
+			return newConfig.wins(config, hashes)
 		}
+		return newConfig.Version > config.Version
+	}
+
+	if tombstone, ok := configs.Tombstones.Get(newConfig.ID); ok {
+		return newConfig.Version > tombstone.Version
 	}
 
-	return true
+	return newConfig.Version >= configs.Horizon
 }
 
 func (configs *TypeConfigs) isNewTombstone(ID string, version uint64) bool {
-	if configs.Configs != nil {
-		if config, ok := configs.Configs[ID]; ok {
-			return version >= config.Version
-		}
+	if config, ok := configs.Configs.Get(ID); ok {
+		return version >= config.Version
 	}
 
-	if configs.Tombstones != nil {
-		if tombstone, ok := configs.Tombstones[ID]; ok {
-			return version > tombstone.Version
-		}
+	if tombstone, ok := configs.Tombstones.Get(ID); ok {
+		return version > tombstone.Version
 	}
 
-	return true
+	return version >= configs.Horizon
 }
 
 // NewConfig adds the config and returns a boolean to indicate whether the
 // config is new. A config is new if its version is strictly superior to the
-// version of an existing config or tombstone of the same ID. If the config is
-// new and it replaces an existing config then the old config being replaced is
-// returned.
+// version of an existing config or tombstone of the same ID or if it wins the
+// conflict against an existing config of the same version. If both configs have
+// version vectors, the stored config is the result of their causal merge and
+// can be retrieved via Get. If the config is new and it replaces an existing
+// config then the old config being replaced is returned.
 func (configs *TypeConfigs) NewConfig(config *Config) (oldConfig *Config, isNew bool) {
-	if isNew = configs.isNewConfig(config.ID, config.Version); !isNew {
+	return configs.newConfig(config, make(dataHashes))
+}
+
+func (configs *TypeConfigs) newConfig(config *Config, hashes dataHashes) (oldConfig *Config, isNew bool) {
+	if config, isNew = configs.mergeConfig(config, hashes); !isNew {
 		return
 	}
 
-	if configs.Configs == nil {
-		configs.Configs = make(map[string]*Config)
-	} else {
-		oldConfig = configs.Configs[config.ID]
+	digest := configs.mutableDigest()
+
+	if oldConfig, _ = configs.Configs.Get(config.ID); oldConfig != nil {
+		digest.addConfig(oldConfig, hashes)
 	}
 
-	configs.Configs[config.ID] = config
+	configs.Configs = configs.Configs.Set(config)
+	digest.addConfig(config, hashes)
+	configs.record(config.ID, ConfigResult{Config: config})
 
-	if configs.Tombstones != nil {
-		delete(configs.Tombstones, config.ID)
+	if tombstone, ok := configs.Tombstones.Get(config.ID); ok {
+		configs.Tombstones = configs.Tombstones.Delete(config.ID)
+		digest.addTombstone(tombstone)
 	}
 
 	return
@@ -342,15 +435,86 @@ func (configs *TypeConfigs) DeadConfig(tombstone *Tombstone) (oldConfig *Config,
 		return
 	}
 
-	if configs.Tombstones == nil {
-		configs.Tombstones = make(map[string]*Tombstone)
+	digest := configs.mutableDigest()
+
+	if oldTombstone, ok := configs.Tombstones.Get(tombstone.ID); ok {
+		digest.addTombstone(oldTombstone)
+	}
+
+	configs.Tombstones = configs.Tombstones.Set(tombstone)
+	digest.addTombstone(tombstone)
+	configs.record(tombstone.ID, ConfigResult{Tombstone: tombstone})
+
+	if oldConfig, _ = configs.Configs.Get(tombstone.ID); oldConfig != nil {
+		configs.Configs = configs.Configs.Delete(tombstone.ID)
+		digest.addConfig(oldConfig, nil)
+	}
+
+	return
+}
+
+// Missing returns the configs and tombstones that a container with the given
+// ID to version mapping is missing. A nil mapping is treated as an empty
+// container. A config of the same version as in the mapping is only missing if
+// the mapping contains a hash for it that differs.
+func (configs *TypeConfigs) Missing(list *TypeConfigList) *TypeConfigs {
+	if list == nil {
+		list = &TypeConfigList{}
+	}
+
+	result := &TypeConfigs{}
+
+	configs.Configs.Range(func(ID string, config *Config) bool {
+		if version, ok := list.Configs[ID]; ok && version > config.Version {
+			return true
+		} else if ok && version == config.Version {
+			if hash, ok := list.Hashes[ID]; !ok || hash == configEntry(config, nil) {
+				return true
+			}
+		}
+		if version, ok := list.Tombstones[ID]; ok && version >= config.Version {
+			return true
+		}
+		result.NewConfig(config)
+		return true
+	})
+
+	configs.Tombstones.Range(func(ID string, tombstone *Tombstone) bool {
+		if version, ok := list.Configs[ID]; ok && version > tombstone.Version {
+			return true
+		}
+		if version, ok := list.Tombstones[ID]; ok && version >= tombstone.Version {
+			return true
+		}
+		result.DeadConfig(tombstone)
+		return true
+	})
+
+	return result
+}
+
+// GC garbage collects all the tombstones whose version is strictly lower then
+// horizon and returns the collected tombstones along with their history. The
+// horizon never decreases.
+func (configs *TypeConfigs) GC(horizon uint64) (collected []*Tombstone) {
+	if horizon > configs.Horizon {
+		configs.Horizon = horizon
 	}
 
-	configs.Tombstones[tombstone.ID] = tombstone
+	configs.Tombstones.Range(func(ID string, tombstone *Tombstone) bool {
+		if tombstone.Version < configs.Horizon {
+			collected = append(collected, tombstone)
+		}
+		return true
+	})
+
+	for _, tombstone := range collected {
+		configs.Tombstones = configs.Tombstones.Delete(tombstone.ID)
+		configs.history = configs.history.remove(tombstone.ID)
 
-	if configs.Configs != nil {
-		oldConfig = configs.Configs[tombstone.ID]
-		delete(configs.Configs, tombstone.ID)
+		if configs.digest != nil {
+			configs.mutableDigest().addTombstone(tombstone)
+		}
 	}
 
 	return
@@ -364,37 +528,63 @@ func (configs *TypeConfigs) DeadConfig(tombstone *Tombstone) (oldConfig *Config,
 // NewConfig.
 func (configs *TypeConfigs) Merge(other *TypeConfigs) (newConfigs []*Config, deadConfigs []*Tombstone) {
 
-	for _, config := range other.Configs {
+	other.Configs.Range(func(ID string, config *Config) bool {
 		if _, isNew := configs.NewConfig(config); isNew {
-			newConfigs = append(newConfigs, config)
+			merged, _ := configs.Configs.Get(ID)
+			newConfigs = append(newConfigs, merged)
 		}
-	}
+		return true
+	})
 
-	for _, tombstone := range other.Tombstones {
+	other.Tombstones.Range(func(ID string, tombstone *Tombstone) bool {
 		if _, isNew := configs.DeadConfig(tombstone); isNew {
 			deadConfigs = append(deadConfigs, tombstone)
 		}
-	}
+		return true
+	})
 
 	return
 }
 
 // Diff returns the configs and tombstones that would be added if invoked by any
 // of the mutating functions. This does not modify the object and the Data field
-// is never looked at in the Config objects.
+// of the Config objects is only looked at to resolve conflicts between configs
+// of the same version and to merge configs with version vectors.
 func (configs *TypeConfigs) Diff(other *TypeConfigs) (newConfigs []*Config, deadConfigs []*Tombstone) {
-	for _, config := range other.Configs {
-		if configs.isNewConfig(config.ID, config.Version) {
-			newConfigs = append(newConfigs, config)
+	hashes := make(dataHashes)
+
+	other.Configs.Range(func(ID string, config *Config) bool {
+		if merged, isNew := configs.mergeConfig(config, hashes); isNew {
+			newConfigs = append(newConfigs, merged)
 		}
-	}
+		return true
+	})
 
-	for _, tombstone := range other.Tombstones {
+	other.Tombstones.Range(func(ID string, tombstone *Tombstone) bool {
 		if configs.isNewTombstone(tombstone.ID, tombstone.Version) {
 			deadConfigs = append(deadConfigs, tombstone)
 		}
-	}
+		return true
+	})
+
+	return
+}
 
+// ConfigArray returns an array of all the configs in this container.
+func (configs *TypeConfigs) ConfigArray() (result []*Config) {
+	configs.Configs.Range(func(ID string, config *Config) bool {
+		result = append(result, config)
+		return true
+	})
+	return
+}
+
+// TombstoneArray returns an array of all the tombstones in this container.
+func (configs *TypeConfigs) TombstoneArray() (result []*Tombstone) {
+	configs.Tombstones.Range(func(ID string, tombstone *Tombstone) bool {
+		result = append(result, tombstone)
+		return true
+	})
 	return
 }
 
@@ -407,48 +597,18 @@ func (configs *TypeConfigs) MarshalJSON() ([]byte, error) {
 		Tombstones []*Tombstone `json:"dead,omitempty"`
 	}
 
-	for _, config := range configs.Configs {
-		configsJSON.Configs = append(configsJSON.Configs, config)
-	}
-	for _, tombstone := range configs.Tombstones {
-		configsJSON.Tombstones = append(configsJSON.Tombstones, tombstone)
-	}
+	configsJSON.Configs = configs.ConfigArray()
+	configsJSON.Tombstones = configs.TombstoneArray()
 
 	return json.Marshal(&configsJSON)
 }
 
 // UnmarshalJSON deserializes the config object from it's simpler json
 // representation and builds the ID to object maps which are useful for
-// in-memory accesses.
-func (configs *TypeConfigs) UnmarshalJSON(body []byte) (err error) {
-	var configsJSON struct {
-		Configs    []*Config    `json:"live,omitempty"`
-		Tombstones []*Tombstone `json:"dead,omitempty"`
-	}
-
-	if err = json.Unmarshal(body, &configsJSON); err != nil {
-		return
-	}
-
-	configs.Configs = make(map[string]*Config)
-	for _, config := range configsJSON.Configs {
-		if _, ok := configs.Configs[config.ID]; ok {
-			return fmt.Errorf("duplicate config: %v", *config)
-		}
-
-		configs.Configs[config.ID] = config
-	}
-
-	configs.Tombstones = make(map[string]*Tombstone)
-	for _, tombstone := range configsJSON.Tombstones {
-		if _, ok := configs.Tombstones[tombstone.ID]; ok {
-			return fmt.Errorf("duplicate tombstone: %v", *tombstone)
-		}
-
-		configs.Tombstones[tombstone.ID] = tombstone
-	}
-
-	return
+// in-memory accesses. Makes use of the registry of the object to deserialize
+// the configs.
+func (configs *TypeConfigs) UnmarshalJSON(body []byte) error {
+	return configs.Registry.Unmarshal(body, configs)
 }
 
 // String returns a string representation of the configs suitable for debugging.
@@ -456,12 +616,12 @@ func (configs *TypeConfigs) String() string {
 	buffer := new(bytes.Buffer)
 	buffer.WriteString("[ ")
 
-	for _, config := range configs.Configs {
+	for _, config := range configs.ConfigArray() {
 		buffer.WriteString(config.String())
 		buffer.WriteString(" ")
 	}
 
-	for _, tombstone := range configs.Tombstones {
+	for _, tombstone := range configs.TombstoneArray() {
 		buffer.WriteString(tombstone.String())
 		buffer.WriteString(" ")
 	}
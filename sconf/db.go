@@ -25,3 +25,6 @@ func (db *NullConfigDB) Load() (*Configs, error) { return &Configs{}, nil }
 
 // Close does nothing.
 func (db *NullConfigDB) Close() (err error) { return }
+
+// CollectTombstones does nothing.
+func (db *NullConfigDB) CollectTombstones(_ uint64) {}
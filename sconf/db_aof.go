@@ -7,46 +7,234 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
-	"hash/crc32"
 	"io"
 	"log"
 	"os"
-	"strconv"
 	"sync"
-)
-
-const (
-	magicAOF string = "e74e1902"
+	"time"
 )
 
 // ErrCorruptedAOF is the error returned by AOFConfigDB when a corrupted database
 // is encountered.
 var ErrCorruptedAOF = errors.New("CorruptedAOF")
 
+// AOFSyncPolicy defines when the writes to an AOFConfigDB are flushed to
+// stable storage via fsync.
+type AOFSyncPolicy int
+
+const (
+	// AOFSyncNever leaves flushing to the operating system and only syncs the
+	// AOF when the database is closed or compacted.
+	AOFSyncNever AOFSyncPolicy = iota
+
+	// AOFSyncEvery syncs the AOF periodically such that all the writes issued
+	// within a SyncRate window are flushed together by a single fsync.
+	AOFSyncEvery
+
+	// AOFSyncAlways syncs the AOF before NewConfig or DeadConfig returns.
+	// Writes issued concurrently are grouped together such that they share a
+	// single fsync.
+	AOFSyncAlways
+)
+
+// DefaultAOFSyncRate is the default sync rate used with the AOFSyncEvery sync
+// policy.
+const DefaultAOFSyncRate = 1 * time.Second
+
+// AOFRecoveryMode defines how an AOFConfigDB handles corrupted records
+// encountered while loading the AOF.
+type AOFRecoveryMode int
+
+const (
+	// AOFRecoverNone reports all corrupted records and skips them.
+	AOFRecoverNone AOFRecoveryMode = iota
+
+	// AOFRecoverTruncate behaves like AOFRecoverNone except that a corrupted
+	// final record, which is usually the result of a crash in the middle of a
+	// write, is truncated from the AOF such that new records can be appended
+	// cleanly.
+	AOFRecoverTruncate
+
+	// AOFRecoverStrict behaves like AOFRecoverTruncate except that any
+	// corrupted record which isn't the final record will cause Init to panic.
+	AOFRecoverStrict
+)
+
+// AOFCorruption describes a corrupted record encountered while loading an AOF.
+type AOFCorruption struct {
+
+	// Offset is the byte offset of the start of the record in the AOF.
+	Offset int64
+
+	// Size is the size of the record in bytes.
+	Size int64
+
+	// File is the path of the AOF or AOF segment containing the record.
+	File string
+
+	// Truncated indicates that the record was dropped from the AOF.
+	Truncated bool
+
+	// Err describes the corruption.
+	Err error
+}
+
+// String returns a string representation of the corruption suitable for
+// debugging.
+func (corruption AOFCorruption) String() string {
+	return fmt.Sprintf("%s[%d, %d): %s", corruption.File,
+		corruption.Offset, corruption.Offset+corruption.Size, corruption.Err)
+}
+
+var errTornRecord = errors.New("unterminated aof record")
+
+var errCorruptRecord = errors.New("corrupted aof record frame")
+
 // AOFConfigDB implements a configuration database as a append-only file. New
 // entries are added to the database via the NewConfig and DeadConfig functions
 // and the database can be read via the Load function.
 //
+// The AOF can either be a single file or, if Dir is set, a series of numbered
+// segment files which are replayed in the order listed in the directory's
+// manifest. A new segment is started whenever the current one grows beyond
+// SegmentSize.
+//
 // Note that corruptions are detected and reported but will not stop the loading
-// process.
+// process unless AOFRecoverStrict is used. A corrupted final record is the
+// usual symptom of a crash and can be truncated from the AOF by using the
+// AOFRecoverTruncate or AOFRecoverStrict recovery modes.
+//
+// Since the database only ever appends, the AOF can be compacted either on
+// demand via the Compact function or automatically by setting CompactSize or
+// CompactRatio. Compaction rewrites the AOF such that it only contains the
+// currently live configs and tombstones and then atomically swaps it with the
+// existing AOF. Writes that happen while a compaction is in progress are
+// buffered and appended to the new AOF before the swap. When using segments,
+// the snapshot replaces all the segments that precede the compaction which are
+// then deleted.
+//
+// If HistoryRetention is set, the history of each config is rebuilt while
+// replaying the AOF and compaction preserves the history entries that are
+// still retained.
 //
-// \todo This struct is currently not go-routine safe.
+// All the functions of AOFConfigDB are safe to call concurrently.
 type AOFConfigDB struct {
 	Component
 
 	// File indicates the file path where the AOF database should be
-	// stored. Either File or AOF should be set prior to calling Init and can't
-	// be changed afterwrads.
+	// stored. One of File, AOF or Dir should be set prior to calling Init and
+	// can't be changed afterwrads.
 	File string
 
-	// AOF indicates the file to use as the AOF database. Either File or AOF
-	// must be set prior to calling Init and can't be changed afterwards.
+	// AOF indicates the file to use as the AOF database. One of File, AOF or
+	// Dir must be set prior to calling Init and can't be changed afterwards.
 	AOF *os.File
 
+	// Dir indicates the directory where the AOF segments and their manifest
+	// should be stored. One of File, AOF or Dir must be set prior to calling
+	// Init and can't be changed afterwards.
+	Dir string
+
+	// SegmentSize indicates the size in bytes after which a new segment is
+	// started when Dir is used. Defaults to DefaultAOFSegmentSize.
+	SegmentSize int64
+
+	// CompactSize indicates the number of bytes that the AOF can grow by
+	// since the last compaction before a compaction is triggered. Defaults to
+	// 0 which disables size triggered compactions.
+	CompactSize int64
+
+	// CompactRatio indicates the ratio of records in the AOF to entries in the
+	// database above which a compaction is triggered. Must be greater then 1
+	// and defaults to 0 which disables ratio triggered compactions.
+	CompactRatio float64
+
+	// Sync indicates when writes should be flushed to stable storage. Defaults
+	// to AOFSyncNever and can't be changed after calling Init.
+	Sync AOFSyncPolicy
+
+	// SyncRate indicates the frequency at which writes are flushed with the
+	// AOFSyncEvery policy. Defaults to DefaultAOFSyncRate.
+	SyncRate time.Duration
+
+	// Recovery indicates how corrupted records are handled while loading the
+	// AOF. Defaults to AOFRecoverNone and can't be changed after calling Init.
+	Recovery AOFRecoveryMode
+
+	// Format indicates the record format used when creating new AOF files or
+	// segments. Existing files are read and appended to in their own format
+	// until they are rewritten by a compaction. Defaults to AOFFormatV1.
+	Format AOFFormat
+
+	// CompressSize indicates the body size in bytes above which records are
+	// compressed. Only supported by AOFFormatV2 and defaults to 0 which
+	// disables compression.
+	CompressSize int
+
+	// HistoryRetention indicates the number of history entries to keep for
+	// each config type. See Configs.SetRetention for more details. Defaults to
+	// no history and can't be changed after calling Init.
+	HistoryRetention map[string]int
+
+	// Registry is used to decode the configs replayed from the AOF, to stamp
+	// the schema version of the configs written to it and to resolve the
+	// siblings of concurrent updates. Defaults to
+	// DefaultTypeRegistry and can't be changed after calling Init.
+	Registry *TypeRegistry
+
 	initialized sync.Once
 
+	path        string
+	corruptions []AOFCorruption
+
+	compactions sync.WaitGroup
+	stopC       chan int
+	syncDoneC   chan int
+
+	// syncLock serializes the fsync calls and segment changes and must be
+	// acquired before lock when both are required.
+	syncLock sync.Mutex
+	synced   uint64
+
+	// lock protects all the fields below.
+	lock sync.Mutex
+
 	configs   *Configs
 	loadError error
+
+	// horizon holds the highest GC horizon read while loading the AOF which
+	// is only applied once all the records were replayed.
+	horizon uint64
+
+	format      AOFFormat
+	size        int64
+	records     int
+	written     uint64
+	compactSize int64
+	compaction  *aofCompaction
+
+	segments    []string
+	segmentSize int64
+	nextSegment int
+}
+
+// aofCompaction holds the state of an in-progress compaction.
+type aofCompaction struct {
+	snapshot *Configs
+
+	// path is where the snapshot is written.
+	path string
+
+	// size and records hold the size of the AOF when the compaction started.
+	size    int64
+	records int
+
+	// pending holds the records written during the compaction of a single
+	// file AOF.
+	pending []aofRecord
+
+	// obsolete holds the segments that will be replaced by the snapshot.
+	obsolete []string
 }
 
 // Init initializes the object.
@@ -55,8 +243,36 @@ func (db *AOFConfigDB) Init() {
 }
 
 func (db *AOFConfigDB) init() {
-	db.configs = &Configs{}
+	db.configs = &Configs{Retention: db.HistoryRetention, Registry: db.Registry}
+
+	if db.Format == 0 {
+		db.Format = AOFFormatV1
+	}
+
+	if len(db.Dir) > 0 {
+		if db.SegmentSize == 0 {
+			db.SegmentSize = DefaultAOFSegmentSize
+		}
+		db.openSegments()
+
+	} else {
+		db.openFile()
+	}
+
+	db.configs.GC(db.horizon)
 
+	if db.Sync == AOFSyncEvery {
+		if db.SyncRate == 0 {
+			db.SyncRate = DefaultAOFSyncRate
+		}
+
+		db.stopC = make(chan int)
+		db.syncDoneC = make(chan int)
+		go db.syncPeriodically()
+	}
+}
+
+func (db *AOFConfigDB) openFile() {
 	if len(db.File) > 0 {
 		var err error
 		db.AOF, err = os.OpenFile(db.File, os.O_RDWR|os.O_CREATE, 0664)
@@ -66,90 +282,271 @@ func (db *AOFConfigDB) init() {
 	}
 
 	if db.AOF == nil {
-		log.Panicf("AOF or File must be set for AOFConfigDB '%s'", db.Name)
+		log.Panicf("AOF, File or Dir must be set for AOFConfigDB '%s'", db.Name)
+	}
+
+	db.path = db.File
+	if len(db.path) == 0 {
+		db.path = db.AOF.Name()
+	}
+
+	db.size = db.load(db.AOF, db.path, true)
+
+	if db.size == 0 {
+		if err := db.writeHeader(); err != nil {
+			log.Panicf("unable to write aof header '%s': %s", db.path, err)
+		}
+	}
+}
+
+// writeHeader writes the header for the configured format to the current file
+// which must be empty. Must be called while holding lock or during Init.
+func (db *AOFConfigDB) writeHeader() error {
+	db.format = db.Format
+
+	header := aofHeader(db.format)
+	if len(header) == 0 {
+		return nil
+	}
+
+	n, err := db.AOF.Write(header)
+	db.size += int64(n)
+	db.segmentSize += int64(n)
+	return err
+}
+
+func (db *AOFConfigDB) syncPeriodically() {
+	defer close(db.syncDoneC)
+
+	tickC := time.NewTicker(db.SyncRate)
+	defer tickC.Stop()
+
+	for {
+		select {
+
+		case <-tickC.C:
+			if err := db.sync(); err != nil {
+				db.Error(fmt.Errorf("unable to sync aof: %s", err))
+			}
+
+		case <-db.stopC:
+			return
+
+		}
+	}
+}
+
+// sync flushes all writes issued before the call to stable storage. Concurrent
+// callers will piggyback on any fsync that started after their write completed.
+func (db *AOFConfigDB) sync() error {
+	db.lock.Lock()
+	target := db.written
+	db.lock.Unlock()
+
+	db.syncLock.Lock()
+	defer db.syncLock.Unlock()
+
+	if db.synced >= target {
+		return nil
+	}
+
+	db.lock.Lock()
+	file := db.AOF
+	written := db.written
+	db.lock.Unlock()
+
+	if err := file.Sync(); err != nil {
+		return err
 	}
 
-	db.load()
+	db.synced = written
+	return nil
 }
 
 // Close closes the database flushing any pending writes. Returns an error if
 // the AOF could not be closed properly.
 func (db *AOFConfigDB) Close() error {
-	if err := db.AOF.Sync(); err != nil {
-		log.Panicf("failed to sync the AOF db: %s", err)
+	db.Init()
+
+	if db.stopC != nil {
+		close(db.stopC)
+		<-db.syncDoneC
 	}
-	return db.AOF.Close()
-}
 
-func (db *AOFConfigDB) write(head byte, body []byte) (err error) {
-	crc := crc32.ChecksumIEEE(body)
-	_, err = db.AOF.WriteString(fmt.Sprintf("%s%08x%c%s\n", magicAOF, crc, head, body))
-	return
-}
+	db.compactions.Wait()
 
-func (db *AOFConfigDB) loadLine(line []byte) (err error) {
-	magic := string(line[0:8])
-	crcStr := string(line[8:16])
-	head := line[16]
-	body := line[17 : len(line)-1]
+	db.syncLock.Lock()
+	defer db.syncLock.Unlock()
 
-	if magic != magicAOF {
-		err = fmt.Errorf("invalid aof magic: %s != %s", magic, magicAOF)
-		return
+	db.lock.Lock()
+	defer db.lock.Unlock()
+
+	if err := db.AOF.Sync(); err != nil {
+		log.Panicf("failed to sync the AOF db: %s", err)
 	}
+	return db.AOF.Close()
+}
 
-	crc, err := strconv.ParseUint(crcStr, 16, 32)
+func (db *AOFConfigDB) write(record aofRecord) (err error) {
+	data, err := encodeRecord(db.format, record, db.CompressSize)
 	if err != nil {
-		err = fmt.Errorf("unable to read crc: %s -> %s", crcStr, err)
 		return
 	}
 
-	if bodyCRC := crc32.ChecksumIEEE(body); bodyCRC != uint32(crc) {
-		err = fmt.Errorf("CRC mismatch: %s -> %c != %x", body, bodyCRC, crc)
-		return
+	n, err := db.AOF.Write(data)
+	db.size += int64(n)
+	db.segmentSize += int64(n)
+	db.records++
+	db.written++
+
+	if db.compaction != nil && len(db.Dir) == 0 {
+		db.compaction.pending = append(db.compaction.pending, record)
 	}
 
-	switch head {
+	return
+}
+
+func (db *AOFConfigDB) loadRecord(record aofRecord) (err error) {
+	switch record.Head {
 	case 'n':
-		err = db.loadNewConfig(body)
+		err = db.loadNewConfig(record.Body)
 	case 't':
-		err = db.loadDeadConfig(body)
+		err = db.loadDeadConfig(record.Body)
+	case 'g':
+		err = db.loadHorizon(record.Body)
 	default:
-		err = fmt.Errorf("unknown aof header: %d", head)
+		err = fmt.Errorf("unknown aof header: %d", record.Head)
 	}
 
 	return
 }
 
-func (db *AOFConfigDB) load() {
-	reader := bufio.NewReader(db.AOF)
+// load replays the records of the given file and returns its size once
+// recovered. isLast indicates whether the file is the last one to be written
+// to, which is the only file where a torn record can be truncated.
+func (db *AOFConfigDB) load(file *os.File, path string, isLast bool) int64 {
+	var corruptions []AOFCorruption
+
+	info, err := file.Stat()
+	if err != nil {
+		log.Panicf("unable to stat aof '%s': %s", path, err)
+	}
+
+	reader, format, offset, err := newAOFReader(bufio.NewReader(file), info.Size())
+	db.format = format
+
+	if err == errTornRecord {
+		corruptions = append(corruptions, AOFCorruption{File: path, Size: offset, Err: err})
+		return db.recover(file, offset, corruptions, isLast)
+	}
+
+	if err != nil {
+		log.Panicf("unable to read aof '%s': %s", path, err)
+	}
+
 	for {
-		line, err := reader.ReadBytes('\n')
-		if err == nil {
-			err = db.loadLine(line)
+		record, size, err := reader.Next()
+		if err == io.EOF {
+			break
 		}
 
-		if err == io.EOF {
-			return
+		if err == nil {
+			if err = db.loadRecord(record); err == nil {
+				db.records++
+			}
 		}
 
 		if err != nil {
-			db.Error(err)
-			db.loadError = ErrCorruptedAOF
+			corruptions = append(corruptions, AOFCorruption{
+				File:   path,
+				Offset: offset,
+				Size:   size,
+				Err:    err,
+			})
+		}
+
+		offset += size
+	}
+
+	return db.recover(file, offset, corruptions, isLast)
+}
+
+func (db *AOFConfigDB) recover(file *os.File, size int64, corruptions []AOFCorruption, isLast bool) int64 {
+	n := len(corruptions)
+	if n == 0 {
+		return size
+	}
+
+	// Only a record cut short by the end of the file is the symptom of a
+	// crash. Complete records that fail to decode are corruptions.
+	var torn *AOFCorruption
+	if last := &corruptions[n-1]; isLast && last.Err == errTornRecord && last.Offset+last.Size == size {
+		torn = last
+	}
+
+	for i := range corruptions {
+		corruption := &corruptions[i]
+		if corruption == torn && db.Recovery != AOFRecoverNone {
+			continue
+		}
+
+		if db.Recovery == AOFRecoverStrict {
+			log.Panicf("corrupted aof at %s", corruption)
+		}
+
+		db.Error(fmt.Errorf("corrupted aof record at %s", corruption))
+		db.loadError = ErrCorruptedAOF
+	}
+
+	if torn != nil && db.Recovery != AOFRecoverNone {
+		if err := file.Truncate(torn.Offset); err != nil {
+			log.Panicf("unable to truncate aof '%s': %s", torn.File, err)
 		}
+
+		if _, err := file.Seek(torn.Offset, os.SEEK_SET); err != nil {
+			log.Panicf("unable to seek aof '%s': %s", torn.File, err)
+		}
+
+		torn.Truncated = true
+		size = torn.Offset
+		db.Log(fmt.Sprintf("truncated torn aof record at %s", torn))
 	}
+
+	db.corruptions = append(db.corruptions, corruptions...)
+	return size
+}
+
+// Corruptions returns the list of corrupted records that were encountered while
+// loading the AOF along with whether they were truncated from the AOF.
+func (db *AOFConfigDB) Corruptions() []AOFCorruption {
+	db.Init()
+	return db.corruptions
 }
 
 // Load returns a copy of the database and a CorruptedAOF error if a corruption
 // was detected while loading the database.
 func (db *AOFConfigDB) Load() (*Configs, error) {
 	db.Init()
+
+	db.lock.Lock()
+	defer db.lock.Unlock()
+
 	return db.configs.Copy(), db.loadError
 }
 
+// History returns the history of the config of the given type and ID.
+func (db *AOFConfigDB) History(typ, ID string) History {
+	db.Init()
+
+	db.lock.Lock()
+	defer db.lock.Unlock()
+
+	return db.configs.History(typ, ID)
+}
+
 func (db *AOFConfigDB) loadNewConfig(body []byte) (err error) {
 	config := &Config{}
-	if err = json.Unmarshal(body, config); err != nil {
+	if err = db.Registry.Unmarshal(body, config); err != nil {
 		return
 	}
 
@@ -161,7 +558,13 @@ func (db *AOFConfigDB) loadNewConfig(body []byte) (err error) {
 func (db *AOFConfigDB) NewConfig(config *Config) {
 	db.Init()
 
-	if _, isNew := db.configs.NewConfig(config); !isNew {
+	config = db.Registry.stamp(config)
+
+	db.lock.Lock()
+	_, isNew := db.configs.NewConfig(config)
+	db.lock.Unlock()
+
+	if !isNew {
 		return
 	}
 
@@ -171,10 +574,8 @@ func (db *AOFConfigDB) NewConfig(config *Config) {
 		return
 	}
 
-	err = db.write('n', body)
-	if err != nil {
+	if err = db.append(aofRecord{'n', body}); err != nil {
 		db.Error(fmt.Errorf("unable to write config %v: %s", *config, err))
-		return
 	}
 }
 
@@ -192,7 +593,11 @@ func (db *AOFConfigDB) loadDeadConfig(body []byte) (err error) {
 func (db *AOFConfigDB) DeadConfig(tombstone *Tombstone) {
 	db.Init()
 
-	if _, isNew := db.configs.DeadConfig(tombstone); !isNew {
+	db.lock.Lock()
+	_, isNew := db.configs.DeadConfig(tombstone)
+	db.lock.Unlock()
+
+	if !isNew {
 		return
 	}
 
@@ -202,9 +607,328 @@ func (db *AOFConfigDB) DeadConfig(tombstone *Tombstone) {
 		return
 	}
 
-	err = db.write('t', body)
-	if err != nil {
+	if err = db.append(aofRecord{'t', body}); err != nil {
 		db.Error(fmt.Errorf("unable to write tombstone %v: %s", *tombstone, err))
+	}
+}
+
+// aofHorizon is the body of the record written when tombstones are collected.
+type aofHorizon struct {
+	Horizon uint64 `json:"horizon"`
+}
+
+func (db *AOFConfigDB) loadHorizon(body []byte) (err error) {
+	var record aofHorizon
+	if err = json.Unmarshal(body, &record); err != nil {
+		return
+	}
+
+	if record.Horizon > db.horizon {
+		db.horizon = record.Horizon
+	}
+	return
+}
+
+// CollectTombstones garbage collects the tombstones below the given horizon and
+// records the horizon in the AOF. The collected tombstones are only removed
+// from the AOF by the next compaction.
+func (db *AOFConfigDB) CollectTombstones(horizon uint64) {
+	db.Init()
+
+	db.lock.Lock()
+	isNew := horizon > db.configs.Horizon
+	db.configs.GC(horizon)
+	db.lock.Unlock()
+
+	if !isNew {
+		return
+	}
+
+	body, err := json.Marshal(aofHorizon{horizon})
+	if err != nil {
+		db.Error(fmt.Errorf("unable to encode horizon %d: %s", horizon, err))
+		return
+	}
+
+	if err = db.append(aofRecord{'g', body}); err != nil {
+		db.Error(fmt.Errorf("unable to write horizon %d: %s", horizon, err))
+	}
+}
+
+// append writes the record to the AOF. Note that concurrent writers may append
+// their records in a different order then they were applied to configs which is
+// fine since merging configs is commutative.
+func (db *AOFConfigDB) append(record aofRecord) error {
+	db.lock.Lock()
+	err := db.write(record)
+	roll := err == nil && db.shouldRoll()
+	compact := err == nil && db.shouldCompact()
+	db.lock.Unlock()
+
+	if err != nil {
+		return err
+	}
+
+	if roll {
+		if err := db.rollSegment(); err != nil {
+			db.Error(fmt.Errorf("unable to start new aof segment: %s", err))
+		}
+	}
+
+	if compact {
+		db.autoCompact()
+	}
+
+	if db.Sync == AOFSyncAlways {
+		return db.sync()
+	}
+
+	return nil
+}
+
+func (db *AOFConfigDB) shouldCompact() bool {
+	if db.compaction != nil {
+		return false
+	}
+
+	if db.CompactSize > 0 && db.size-db.compactSize >= db.CompactSize {
+		return true
+	}
+
+	if db.CompactRatio > 1 {
+		n := db.configs.Len() + db.configs.historyLen()
+		if n > 0 && float64(db.records) >= db.CompactRatio*float64(n) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (db *AOFConfigDB) autoCompact() {
+	compaction, err := db.beginCompact()
+	if err != nil || compaction == nil {
+		return
+	}
+
+	db.compactions.Add(1)
+	go func() {
+		defer db.compactions.Done()
+
+		if err := db.compact(compaction); err != nil {
+			db.Error(fmt.Errorf("unable to compact aof: %s", err))
+		}
+	}()
+}
+
+// Compact rewrites the AOF such that it only contains the records required to
+// rebuild the current state of the database. Writes can safely be issued while
+// a compaction is in progress. Returns an error if the new AOF could not be
+// written or swapped in, in which case the existing AOF is left untouched.
+// Configs are rewritten with the current schema of their type.
+func (db *AOFConfigDB) Compact() error {
+	db.Init()
+
+	compaction, err := db.beginCompact()
+	if err != nil {
+		return err
+	}
+
+	if compaction == nil {
+		return errors.New("aof compaction already in progress")
+	}
+
+	return db.compact(compaction)
+}
+
+func (db *AOFConfigDB) beginCompact() (compaction *aofCompaction, err error) {
+	db.syncLock.Lock()
+	defer db.syncLock.Unlock()
+
+	db.lock.Lock()
+	defer db.lock.Unlock()
+
+	if db.compaction != nil {
 		return
 	}
+
+	compaction = &aofCompaction{}
+
+	if len(db.Dir) > 0 {
+		// Starting a new segment guarantees that all the records of the
+		// obsolete segments are contained in the snapshot.
+		if err = db.roll(); err != nil {
+			return nil, err
+		}
+
+		compaction.obsolete = append([]string{}, db.segments[:len(db.segments)-1]...)
+		compaction.path = db.segmentPath(db.allocSegment())
+
+	} else {
+		compaction.path = db.path + ".rewrite"
+	}
+
+	compaction.size = db.size
+	compaction.records = db.records
+	compaction.snapshot = db.configs.Copy()
+
+	db.compaction = compaction
+	return
+}
+
+func (db *AOFConfigDB) compact(compaction *aofCompaction) (err error) {
+	file, size, records, err := db.writeSnapshot(compaction.path, compaction.snapshot)
+
+	if err == nil {
+		if len(db.Dir) > 0 {
+			err = db.endSegmentCompact(compaction, file, size, records)
+		} else {
+			err = db.endCompact(compaction, file, size, records)
+		}
+	}
+
+	if err != nil {
+		db.lock.Lock()
+		db.compaction = nil
+		db.lock.Unlock()
+
+		if file != nil {
+			file.Close()
+		}
+		os.Remove(compaction.path)
+	}
+
+	return
+}
+
+func (db *AOFConfigDB) writeSnapshot(path string, snapshot *Configs) (file *os.File, size int64, records int, err error) {
+	if file, err = os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0664); err != nil {
+		return
+	}
+
+	writer := bufio.NewWriter(file)
+
+	n, err := writer.Write(aofHeader(db.Format))
+	if err != nil {
+		return
+	}
+	size += int64(n)
+
+	write := func(head byte, obj interface{}) error {
+		body, err := json.Marshal(obj)
+		if err != nil {
+			return err
+		}
+
+		data, err := encodeRecord(db.Format, aofRecord{head, body}, db.CompressSize)
+		if err != nil {
+			return err
+		}
+
+		n, err := writer.Write(data)
+		size += int64(n)
+		records++
+		return err
+	}
+
+	if snapshot.Horizon > 0 {
+		if err = write('g', aofHorizon{snapshot.Horizon}); err != nil {
+			return
+		}
+	}
+
+	// The history entries are replayed before the live configs and
+	// tombstones which are usually the last entry of their history.
+	for _, state := range snapshot.Types {
+		state.rangeHistory(func(ID string, history History) bool {
+			current, _ := state.Get(ID)
+
+			for _, entry := range history {
+				if entry.Config != nil && entry.Config != current.Config {
+					err = write('n', entry.Config)
+				} else if entry.Tombstone != nil && entry.Tombstone != current.Tombstone {
+					err = write('t', entry.Tombstone)
+				}
+
+				if err != nil {
+					return false
+				}
+			}
+
+			return true
+		})
+
+		if err != nil {
+			return
+		}
+	}
+
+	for _, config := range snapshot.ConfigArray() {
+		if err = write('n', config); err != nil {
+			return
+		}
+	}
+
+	for _, tombstone := range snapshot.TombstoneArray() {
+		if err = write('t', tombstone); err != nil {
+			return
+		}
+	}
+
+	if err = writer.Flush(); err != nil {
+		return
+	}
+
+	err = file.Sync()
+	return
+}
+
+func (db *AOFConfigDB) endCompact(compaction *aofCompaction, file *os.File, size int64, records int) (err error) {
+	db.syncLock.Lock()
+	defer db.syncLock.Unlock()
+
+	db.lock.Lock()
+	defer db.lock.Unlock()
+
+	// Records written during the compaction are re-encoded since the snapshot
+	// may use a different format then the previous AOF.
+	var pending int64
+	for _, record := range compaction.pending {
+		var data []byte
+		if data, err = encodeRecord(db.Format, record, db.CompressSize); err != nil {
+			return
+		}
+
+		if _, err = file.Write(data); err != nil {
+			return
+		}
+		pending += int64(len(data))
+	}
+
+	if err = file.Sync(); err != nil {
+		return
+	}
+
+	if err = os.Rename(file.Name(), db.path); err != nil {
+		return
+	}
+
+	db.AOF.Close()
+	db.AOF = file
+	db.format = db.Format
+	db.synced = db.written
+
+	// The size of the pending records may have changed when re-encoded.
+	db.size = compaction.size + pending
+	db.compacted(compaction, size, records)
+	return
+}
+
+// compacted updates the size of the AOF to account for the compaction. Must be
+// called while holding lock.
+func (db *AOFConfigDB) compacted(compaction *aofCompaction, size int64, records int) {
+	db.size = size + (db.size - compaction.size)
+	db.records = records + (db.records - compaction.records)
+	db.compactSize = db.size
+	db.compaction = nil
 }
@@ -0,0 +1,281 @@
+// Copyright (c) 2014 Datacratic. All rights reserved.
+
+package sconf
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"strconv"
+)
+
+// AOFFormat defines the on-disk record format used by AOFConfigDB.
+//
+// The v1 format stores one record per line as the AOF magic followed by the
+// hex encoded CRC32 of the body, a one byte head and the JSON body. Since it is
+// line based, it can't handle bodies that contain raw newlines.
+//
+// The v2 format starts with a file header containing a magic and the format
+// version and is followed by length-prefixed binary records. Each record
+// contains the length of its body, the CRC32C of its head, flags and body, a
+// one byte head, a one byte flags field, the CRC32C of the preceding fields and
+// the body which may be compressed. The second CRC guards the length such that
+// a corrupted length can't be mistaken for a record cut short by a crash.
+type AOFFormat int
+
+const (
+	// AOFFormatV1 is the original line-based format.
+	AOFFormatV1 AOFFormat = 1
+
+	// AOFFormatV2 is the length-prefixed binary format.
+	AOFFormatV2 AOFFormat = 2
+)
+
+const (
+	magicAOF   string = "e74e1902"
+	magicAOFV2 string = "sconfaof"
+
+	aofHeaderSize   = len(magicAOFV2) + 4
+	aofFrameSize    = 4 + 4 + 1 + 1 + 4
+	aofMaxBodySize  = 1 << 30
+	aofFlagCompress = 1 << 0
+)
+
+var crc32c = crc32.MakeTable(crc32.Castagnoli)
+
+// aofRecord is a decoded AOF record.
+type aofRecord struct {
+	Head byte
+	Body []byte
+}
+
+// aofHeader returns the header that should be written at the start of a file
+// of the given format.
+func aofHeader(format AOFFormat) []byte {
+	if format == AOFFormatV1 {
+		return nil
+	}
+
+	header := make([]byte, aofHeaderSize)
+	copy(header, magicAOFV2)
+	binary.BigEndian.PutUint32(header[len(magicAOFV2):], uint32(format))
+	return header
+}
+
+// encodeRecord encodes the record in the given format. Bodies larger then
+// compressSize are compressed if the format supports it and compressSize is
+// greater then 0.
+func encodeRecord(format AOFFormat, record aofRecord, compressSize int) ([]byte, error) {
+	if format == AOFFormatV1 {
+		crc := crc32.ChecksumIEEE(record.Body)
+		return []byte(fmt.Sprintf("%s%08x%c%s\n", magicAOF, crc, record.Head, record.Body)), nil
+	}
+
+	body := record.Body
+	var flags byte
+
+	if compressSize > 0 && len(body) > compressSize {
+		buffer := new(bytes.Buffer)
+
+		writer, err := flate.NewWriter(buffer, flate.BestSpeed)
+		if err != nil {
+			return nil, err
+		}
+
+		if _, err = writer.Write(body); err != nil {
+			return nil, err
+		}
+
+		if err = writer.Close(); err != nil {
+			return nil, err
+		}
+
+		if buffer.Len() < len(body) {
+			body = buffer.Bytes()
+			flags |= aofFlagCompress
+		}
+	}
+
+	frame := make([]byte, aofFrameSize, aofFrameSize+len(body))
+	binary.BigEndian.PutUint32(frame[0:4], uint32(len(body)))
+	frame[8] = record.Head
+	frame[9] = flags
+
+	crc := crc32.Update(crc32.Checksum(frame[8:10], crc32c), crc32c, body)
+	binary.BigEndian.PutUint32(frame[4:8], crc)
+	binary.BigEndian.PutUint32(frame[10:14], crc32.Checksum(frame[0:10], crc32c))
+
+	return append(frame, body...), nil
+}
+
+// aofReader reads the records of an AOF file. Next returns the decoded record,
+// the number of bytes it occupies in the file and an error if the record is
+// corrupted. io.EOF is returned once the end of the file is reached.
+type aofReader interface {
+	Next() (record aofRecord, size int64, err error)
+}
+
+// newAOFReader detects the format of the file and returns a reader for its
+// records along with the format and the size of the file header. size is the
+// size of the file which bounds the length of the records. A header that is cut
+// short by the end of the file returns errTornRecord along with the size of the
+// partial header.
+func newAOFReader(reader *bufio.Reader, size int64) (aofReader, AOFFormat, int64, error) {
+	if magic, err := reader.Peek(len(magicAOFV2)); err != nil || string(magic) != magicAOFV2 {
+		return &aofReaderV1{reader}, AOFFormatV1, 0, nil
+	}
+
+	header := make([]byte, aofHeaderSize)
+	if n, err := io.ReadFull(reader, header); err == io.ErrUnexpectedEOF {
+		return nil, AOFFormatV2, int64(n), errTornRecord
+	} else if err != nil {
+		return nil, 0, 0, fmt.Errorf("unable to read aof header: %s", err)
+	}
+
+	format := AOFFormat(binary.BigEndian.Uint32(header[len(magicAOFV2):]))
+	if format != AOFFormatV2 {
+		return nil, 0, 0, fmt.Errorf("unsupported aof format: %d", format)
+	}
+
+	return &aofReaderV2{reader, size - int64(aofHeaderSize)}, format, int64(aofHeaderSize), nil
+}
+
+type aofReaderV1 struct {
+	reader *bufio.Reader
+}
+
+func (reader *aofReaderV1) Next() (record aofRecord, size int64, err error) {
+	line, err := reader.reader.ReadBytes('\n')
+	size = int64(len(line))
+
+	if err == io.EOF && len(line) == 0 {
+		return
+	}
+
+	if err == io.EOF {
+		err = errTornRecord
+		return
+	}
+
+	if err != nil {
+		return
+	}
+
+	if len(line) < 18 {
+		err = fmt.Errorf("truncated aof record: %q", line)
+		return
+	}
+
+	magic := string(line[0:8])
+	crcStr := string(line[8:16])
+	record.Head = line[16]
+	record.Body = line[17 : len(line)-1]
+
+	if magic != magicAOF {
+		err = fmt.Errorf("invalid aof magic: %s != %s", magic, magicAOF)
+		return
+	}
+
+	crc, err := strconv.ParseUint(crcStr, 16, 32)
+	if err != nil {
+		err = fmt.Errorf("unable to read crc: %s -> %s", crcStr, err)
+		return
+	}
+
+	if bodyCRC := crc32.ChecksumIEEE(record.Body); bodyCRC != uint32(crc) {
+		err = fmt.Errorf("CRC mismatch: %s -> %x != %x", record.Body, bodyCRC, crc)
+	}
+
+	return
+}
+
+type aofReaderV2 struct {
+	reader    *bufio.Reader
+	remaining int64
+}
+
+func (reader *aofReaderV2) Next() (record aofRecord, size int64, err error) {
+	defer func() { reader.remaining -= size }()
+
+	frame := make([]byte, aofFrameSize)
+
+	n, err := io.ReadFull(reader.reader, frame)
+	size = int64(n)
+
+	if err == io.EOF {
+		return
+	}
+
+	if err == io.ErrUnexpectedEOF {
+		err = errTornRecord
+		return
+	}
+
+	if err != nil {
+		return
+	}
+
+	// A corrupted frame means that we can't find the next record so we give
+	// up on the rest of the file which is reported as a corruption. Only
+	// errTornRecord is truncated on recovery so the records that follow are
+	// never dropped silently.
+	if crc32.Checksum(frame[0:10], crc32c) != binary.BigEndian.Uint32(frame[10:14]) {
+		rest, _ := io.Copy(ioutil.Discard, reader.reader)
+		size += rest
+		err = errCorruptRecord
+		return
+	}
+
+	length := int64(binary.BigEndian.Uint32(frame[0:4]))
+
+	if length > aofMaxBodySize {
+		rest, _ := io.Copy(ioutil.Discard, reader.reader)
+		size += rest
+		err = fmt.Errorf("invalid aof record length: %d", length)
+		return
+	}
+
+	// The frame is intact so a body that goes past the end of the file was
+	// cut short by a crash.
+	if length > reader.remaining-size {
+		rest, _ := io.Copy(ioutil.Discard, reader.reader)
+		size += rest
+		err = errTornRecord
+		return
+	}
+
+	body := make([]byte, length)
+	n, err = io.ReadFull(reader.reader, body)
+	size += int64(n)
+
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		err = errTornRecord
+		return
+	}
+
+	if err != nil {
+		return
+	}
+
+	crc := crc32.Update(crc32.Checksum(frame[8:10], crc32c), crc32c, body)
+	if exp := binary.BigEndian.Uint32(frame[4:8]); crc != exp {
+		err = fmt.Errorf("CRC mismatch: %x != %x", crc, exp)
+		return
+	}
+
+	record.Head = frame[8]
+	record.Body = body
+
+	if flags := frame[9]; flags&aofFlagCompress != 0 {
+		if record.Body, err = ioutil.ReadAll(flate.NewReader(bytes.NewReader(body))); err != nil {
+			err = fmt.Errorf("unable to decompress aof record: %s", err)
+		}
+	}
+
+	return
+}
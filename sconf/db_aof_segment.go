@@ -0,0 +1,233 @@
+// Copyright (c) 2014 Datacratic. All rights reserved.
+
+package sconf
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// DefaultAOFSegmentSize is the default size in bytes after which AOFConfigDB
+// will start a new segment.
+const DefaultAOFSegmentSize = 64 * 1024 * 1024
+
+const (
+	aofManifestFile   string = "MANIFEST"
+	aofSegmentPattern string = "%08d.aof"
+	aofSegmentExt     string = ".aof"
+)
+
+// aofManifest lists the segments of an AOF in the order they should be
+// replayed. Segments that are not listed in the manifest are leftovers of an
+// interrupted compaction and can safely be deleted.
+type aofManifest struct {
+	Segments []string `json:"segments"`
+}
+
+func parseSegment(name string) (int, bool) {
+	if !strings.HasSuffix(name, aofSegmentExt) {
+		return 0, false
+	}
+
+	n, err := strconv.ParseUint(strings.TrimSuffix(name, aofSegmentExt), 10, 32)
+	if err != nil {
+		return 0, false
+	}
+
+	return int(n), true
+}
+
+func (db *AOFConfigDB) segmentPath(name string) string {
+	return filepath.Join(db.Dir, name)
+}
+
+// allocSegment returns the name of a new segment. Must be called while holding
+// lock.
+func (db *AOFConfigDB) allocSegment() string {
+	name := fmt.Sprintf(aofSegmentPattern, db.nextSegment)
+	db.nextSegment++
+	return name
+}
+
+func (db *AOFConfigDB) openSegments() {
+	if err := os.MkdirAll(db.Dir, 0775); err != nil {
+		log.Panicf("unable to create aof dir '%s': %s", db.Dir, err)
+	}
+
+	manifest, err := db.readManifest()
+	if err != nil {
+		log.Panicf("unable to read aof manifest in '%s': %s", db.Dir, err)
+	}
+
+	live := make(map[string]bool)
+	for _, name := range manifest.Segments {
+		live[name] = true
+	}
+
+	files, err := ioutil.ReadDir(db.Dir)
+	if err != nil {
+		log.Panicf("unable to list aof dir '%s': %s", db.Dir, err)
+	}
+
+	db.nextSegment = 1
+	for _, file := range files {
+		n, ok := parseSegment(file.Name())
+		if !ok {
+			continue
+		}
+
+		if n >= db.nextSegment {
+			db.nextSegment = n + 1
+		}
+
+		if !live[file.Name()] {
+			os.Remove(db.segmentPath(file.Name()))
+		}
+	}
+
+	for i, name := range manifest.Segments {
+		path := db.segmentPath(name)
+		isLast := i == len(manifest.Segments)-1
+
+		file, err := os.OpenFile(path, os.O_RDWR, 0664)
+		if err != nil {
+			log.Panicf("unable to open aof segment '%s': %s", path, err)
+		}
+
+		size := db.load(file, path, isLast)
+		db.size += size
+
+		if isLast {
+			db.AOF = file
+			db.path = path
+			db.segmentSize = size
+		} else {
+			file.Close()
+		}
+	}
+
+	db.segments = manifest.Segments
+
+	if db.AOF == nil {
+		if err := db.roll(); err != nil {
+			log.Panicf("unable to create aof segment in '%s': %s", db.Dir, err)
+		}
+
+	} else if db.segmentSize == 0 {
+		if err := db.writeHeader(); err != nil {
+			log.Panicf("unable to write aof header '%s': %s", db.path, err)
+		}
+	}
+}
+
+func (db *AOFConfigDB) readManifest() (manifest aofManifest, err error) {
+	body, err := ioutil.ReadFile(db.segmentPath(aofManifestFile))
+	if os.IsNotExist(err) {
+		return manifest, nil
+	}
+
+	if err == nil {
+		err = json.Unmarshal(body, &manifest)
+	}
+
+	return
+}
+
+// writeManifest atomically replaces the manifest.
+func (db *AOFConfigDB) writeManifest(segments []string) error {
+	body, err := json.Marshal(&aofManifest{Segments: segments})
+	if err != nil {
+		return err
+	}
+
+	return writeFileAtomic(db.segmentPath(aofManifestFile), body)
+}
+
+// shouldRoll must be called while holding lock.
+func (db *AOFConfigDB) shouldRoll() bool {
+	return len(db.Dir) > 0 && db.segmentSize >= db.SegmentSize
+}
+
+func (db *AOFConfigDB) rollSegment() error {
+	db.syncLock.Lock()
+	defer db.syncLock.Unlock()
+
+	db.lock.Lock()
+	defer db.lock.Unlock()
+
+	if !db.shouldRoll() {
+		return nil
+	}
+
+	return db.roll()
+}
+
+// roll starts a new segment and makes it the current segment. Must be called
+// while holding both syncLock and lock.
+func (db *AOFConfigDB) roll() error {
+	name := db.allocSegment()
+	path := db.segmentPath(name)
+
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0664)
+	if err != nil {
+		return err
+	}
+
+	segments := append(append([]string{}, db.segments...), name)
+	if err = db.writeManifest(segments); err != nil {
+		file.Close()
+		os.Remove(path)
+		return err
+	}
+
+	if db.AOF != nil {
+		if err := db.AOF.Sync(); err != nil {
+			db.Error(fmt.Errorf("unable to sync aof segment '%s': %s", db.path, err))
+		}
+		db.AOF.Close()
+	}
+
+	db.AOF = file
+	db.path = path
+	db.segments = segments
+	db.segmentSize = 0
+	db.synced = db.written
+
+	return db.writeHeader()
+}
+
+func (db *AOFConfigDB) endSegmentCompact(compaction *aofCompaction, file *os.File, size int64, records int) (err error) {
+	file.Close()
+
+	db.lock.Lock()
+	defer db.lock.Unlock()
+
+	n := len(compaction.obsolete)
+	for i, name := range compaction.obsolete {
+		assertf(db.segments[i] == name, "unexpected aof segment '%s' != '%s'", db.segments[i], name)
+	}
+
+	segments := []string{filepath.Base(compaction.path)}
+	segments = append(segments, db.segments[n:]...)
+
+	if err = db.writeManifest(segments); err != nil {
+		return
+	}
+
+	db.segments = segments
+	db.compacted(compaction, size, records)
+
+	for _, name := range compaction.obsolete {
+		if err := os.Remove(db.segmentPath(name)); err != nil {
+			db.Error(fmt.Errorf("unable to remove aof segment '%s': %s", name, err))
+		}
+	}
+
+	return
+}
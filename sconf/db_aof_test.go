@@ -3,10 +3,17 @@
 package sconf
 
 import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
 	"fmt"
+	"io/ioutil"
 	"math/rand"
 	"os"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 )
 
 type ConfigPersistUtilsTest struct{ TestConfigUtils }
@@ -28,8 +35,8 @@ func (t ConfigPersistUtilsTest) Tomb(ID string, version uint64) *Tombstone {
 	return t.Config(ID, version, "").Tombstone()
 }
 
-func (t ConfigPersistUtilsTest) Load(title string, aof *AOFConfigDB) *TypeConfigs {
-	configs, err := aof.Load()
+func (t ConfigPersistUtilsTest) Load(title string, db ConfigDB) *TypeConfigs {
+	configs, err := db.Load()
 	if err != nil {
 		t.Errorf("FAIL(%s): unable to load db: %s", title, err)
 		return nil
@@ -81,3 +88,419 @@ func TestConfigPersistAOF(t *testing.T) {
 		test.Tomb("c2", 2))
 	aof2.Close()
 }
+
+func (t ConfigPersistUtilsTest) Records(title, file string, exp int) {
+	body, err := ioutil.ReadFile(file)
+	if err != nil {
+		t.Errorf("FAIL(%s): unable to read aof: %s", title, err)
+		return
+	}
+
+	if n := bytes.Count(body, []byte{'\n'}); n != exp {
+		t.Errorf("FAIL(%s): unexpected record count %d != %d", title, n, exp)
+	}
+}
+
+func TestConfigPersistAOFCompact(t *testing.T) {
+	test := NewConfigPersistUtilsTest(t)
+
+	file := test.NewFile()
+	defer os.Remove(file)
+
+	aof0 := &AOFConfigDB{File: file}
+
+	for i := uint64(0); i < 10; i++ {
+		aof0.NewConfig(test.Config("c0", i, "d0"))
+		aof0.NewConfig(test.Config("c1", i, "d1"))
+	}
+	aof0.DeadConfig(test.Tomb("c1", 10))
+	test.Records("aof0", file, 21)
+
+	if err := aof0.Compact(); err != nil {
+		t.Fatalf("FAIL(aof0): unable to compact: %s", err)
+	}
+	test.Records("aof0.compact", file, 2)
+
+	// Writes issued during a compaction must make it in the new AOF.
+	snapshot, _ := aof0.beginCompact()
+	aof0.NewConfig(test.Config("c2", 0, "d2"))
+	aof0.NewConfig(test.Config("c0", 11, "d3"))
+	if err := aof0.compact(snapshot); err != nil {
+		t.Fatalf("FAIL(aof0): unable to compact: %s", err)
+	}
+	test.Records("aof0.online", file, 4)
+
+	aof0.NewConfig(test.Config("c3", 0, "d4"))
+	aof0.Close()
+
+	aof1 := &AOFConfigDB{File: file}
+	test.DiffConfigs("aof1", test.Load("aof1", aof1),
+		test.Config("c0", 11, "d3"),
+		test.Config("c2", 0, "d2"),
+		test.Config("c3", 0, "d4"))
+	test.DiffTombs("aof1", test.Load("aof1", aof1),
+		test.Tomb("c1", 10))
+	aof1.Close()
+}
+
+func TestConfigPersistAOFAutoCompact(t *testing.T) {
+	test := NewConfigPersistUtilsTest(t)
+
+	file := test.NewFile()
+	defer os.Remove(file)
+
+	aof0 := &AOFConfigDB{File: file, CompactRatio: 4}
+	for i := uint64(0); i < 100; i++ {
+		aof0.NewConfig(test.Config("c0", i, "d0"))
+	}
+	aof0.Close()
+
+	aof1 := &AOFConfigDB{File: file}
+	test.DiffConfigs("aof1", test.Load("aof1", aof1),
+		test.Config("c0", 99, "d0"))
+
+	if records := aof1.records; records >= 100 {
+		t.Errorf("FAIL(aof1): aof was not compacted: %d records", records)
+	}
+	aof1.Close()
+}
+
+func TestConfigPersistAOFConcurrent(t *testing.T) {
+	test := NewConfigPersistUtilsTest(t)
+
+	policies := []AOFSyncPolicy{AOFSyncNever, AOFSyncEvery, AOFSyncAlways}
+
+	for _, policy := range policies {
+		title := fmt.Sprintf("sync-%d", policy)
+
+		file := test.NewFile()
+		defer os.Remove(file)
+
+		aof0 := &AOFConfigDB{File: file, Sync: policy, SyncRate: time.Millisecond}
+
+		var wg sync.WaitGroup
+		for i := 0; i < 4; i++ {
+			wg.Add(1)
+
+			go func(ID string) {
+				defer wg.Done()
+
+				for ver := uint64(0); ver < 50; ver++ {
+					aof0.NewConfig(test.Config(ID, ver, "d"))
+					aof0.Load()
+				}
+				aof0.DeadConfig(test.Tomb(ID, 50))
+			}(fmt.Sprintf("c%d", i))
+		}
+		wg.Wait()
+		aof0.Close()
+
+		aof1 := &AOFConfigDB{File: file}
+		test.DiffConfigs(title, test.Load(title, aof1))
+		test.DiffTombs(title, test.Load(title, aof1),
+			test.Tomb("c0", 50),
+			test.Tomb("c1", 50),
+			test.Tomb("c2", 50),
+			test.Tomb("c3", 50))
+		aof1.Close()
+	}
+}
+
+func (t ConfigPersistUtilsTest) Append(file string, data string) {
+	aof, err := os.OpenFile(file, os.O_WRONLY|os.O_APPEND, 0664)
+	if err != nil {
+		t.Fatalf("FAIL: unable to open aof: %s", err)
+	}
+	defer aof.Close()
+
+	if _, err = aof.WriteString(data); err != nil {
+		t.Fatalf("FAIL: unable to write aof: %s", err)
+	}
+}
+
+func (t ConfigPersistUtilsTest) Size(file string) int64 {
+	stat, err := os.Stat(file)
+	if err != nil {
+		t.Fatalf("FAIL: unable to stat aof: %s", err)
+	}
+	return stat.Size()
+}
+
+func TestConfigPersistAOFRecovery(t *testing.T) {
+	test := NewConfigPersistUtilsTest(t)
+
+	file := test.NewFile()
+	defer os.Remove(file)
+
+	aof0 := &AOFConfigDB{File: file}
+	aof0.NewConfig(test.Config("c0", 0, "d0"))
+	aof0.NewConfig(test.Config("c1", 0, "d1"))
+	aof0.Close()
+
+	size := test.Size(file)
+	test.Append(file, magicAOF+"0000")
+
+	aof1 := &AOFConfigDB{File: file, Recovery: AOFRecoverTruncate}
+	test.DiffConfigs("aof1", test.Load("aof1", aof1),
+		test.Config("c0", 0, "d0"),
+		test.Config("c1", 0, "d1"))
+
+	if corruptions := aof1.Corruptions(); len(corruptions) != 1 {
+		t.Errorf("FAIL(aof1): unexpected corruptions: %v", corruptions)
+
+	} else if c := corruptions[0]; c.Offset != size || c.Size != 12 || !c.Truncated {
+		t.Errorf("FAIL(aof1): unexpected corruption: %v", c)
+	}
+
+	aof1.NewConfig(test.Config("c2", 0, "d2"))
+	aof1.Close()
+
+	aof2 := &AOFConfigDB{File: file, Recovery: AOFRecoverStrict}
+	test.DiffConfigs("aof2", test.Load("aof2", aof2),
+		test.Config("c0", 0, "d0"),
+		test.Config("c1", 0, "d1"),
+		test.Config("c2", 0, "d2"))
+
+	if corruptions := aof2.Corruptions(); len(corruptions) != 0 {
+		t.Errorf("FAIL(aof2): unexpected corruptions: %v", corruptions)
+	}
+	aof2.Close()
+
+	test.Append(file, "garbage\n")
+	aof3 := &AOFConfigDB{File: file}
+	aof3.NewConfig(test.Config("c3", 0, "d3"))
+	aof3.Close()
+
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Errorf("FAIL(aof4): strict recovery didn't panic")
+			}
+		}()
+
+		aof4 := &AOFConfigDB{File: file, Recovery: AOFRecoverStrict}
+		aof4.Init()
+	}()
+
+	aof5 := &AOFConfigDB{File: file, Recovery: AOFRecoverTruncate}
+	if _, err := aof5.Load(); err != ErrCorruptedAOF {
+		t.Errorf("FAIL(aof5): expected corruption error: %v", err)
+	}
+	aof5.Close()
+
+	// A complete final record that fails to decode isn't torn.
+	test.Append(file, magicAOF+"00000000n{}\n")
+	size = test.Size(file)
+
+	aof6 := &AOFConfigDB{File: file, Recovery: AOFRecoverTruncate}
+	if _, err := aof6.Load(); err != ErrCorruptedAOF {
+		t.Errorf("FAIL(aof6): expected corruption error: %v", err)
+	}
+	if corruptions := aof6.Corruptions(); len(corruptions) != 2 || corruptions[1].Truncated {
+		t.Errorf("FAIL(aof6): unexpected corruptions: %v", corruptions)
+	}
+	aof6.Close()
+
+	if newSize := test.Size(file); newSize != size {
+		t.Errorf("FAIL(aof6): corrupted record was truncated: %d != %d", newSize, size)
+	}
+}
+
+func (t ConfigPersistUtilsTest) NewDir() string {
+	return fmt.Sprintf("%s/rtbkit-config-test.%x.d", os.TempDir(), rand.Uint32())
+}
+
+func (t ConfigPersistUtilsTest) Segments(title, dir string) []string {
+	manifest, err := (&AOFConfigDB{Dir: dir}).readManifest()
+	if err != nil {
+		t.Errorf("FAIL(%s): unable to read manifest: %s", title, err)
+	}
+
+	for _, name := range manifest.Segments {
+		if _, err := os.Stat(dir + "/" + name); err != nil {
+			t.Errorf("FAIL(%s): missing segment %s: %s", title, name, err)
+		}
+	}
+
+	return manifest.Segments
+}
+
+func TestConfigPersistAOFSegments(t *testing.T) {
+	test := NewConfigPersistUtilsTest(t)
+
+	dir := test.NewDir()
+	defer os.RemoveAll(dir)
+
+	aof0 := &AOFConfigDB{Dir: dir, SegmentSize: 256}
+	for i := uint64(0); i < 10; i++ {
+		aof0.NewConfig(test.Config("c0", i, "d0"))
+		aof0.NewConfig(test.Config("c1", i, "d1"))
+	}
+	aof0.DeadConfig(test.Tomb("c1", 10))
+	aof0.Close()
+
+	if segments := test.Segments("aof0", dir); len(segments) < 2 {
+		t.Errorf("FAIL(aof0): expected multiple segments: %v", segments)
+	}
+
+	aof1 := &AOFConfigDB{Dir: dir, SegmentSize: 256}
+	test.DiffConfigs("aof1", test.Load("aof1", aof1),
+		test.Config("c0", 9, "d0"))
+	test.DiffTombs("aof1", test.Load("aof1", aof1),
+		test.Tomb("c1", 10))
+
+	if err := aof1.Compact(); err != nil {
+		t.Fatalf("FAIL(aof1): unable to compact: %s", err)
+	}
+
+	if segments := test.Segments("aof1", dir); len(segments) != 2 {
+		t.Errorf("FAIL(aof1): unexpected segments after compaction: %v", segments)
+	}
+
+	aof1.NewConfig(test.Config("c2", 0, "d2"))
+	aof1.Close()
+
+	aof2 := &AOFConfigDB{Dir: dir}
+	test.DiffConfigs("aof2", test.Load("aof2", aof2),
+		test.Config("c0", 9, "d0"),
+		test.Config("c2", 0, "d2"))
+	test.DiffTombs("aof2", test.Load("aof2", aof2),
+		test.Tomb("c1", 10))
+	aof2.Close()
+
+	segments := test.Segments("aof2", dir)
+	test.Append(dir+"/"+segments[0], "garbage\n")
+
+	aof3 := &AOFConfigDB{Dir: dir, Recovery: AOFRecoverTruncate}
+	if _, err := aof3.Load(); err != ErrCorruptedAOF {
+		t.Errorf("FAIL(aof3): expected corruption error: %v", err)
+	}
+
+	if corruptions := aof3.Corruptions(); len(corruptions) != 1 {
+		t.Errorf("FAIL(aof3): unexpected corruptions: %v", corruptions)
+
+	} else if c := corruptions[0]; c.File != dir+"/"+segments[0] || c.Truncated {
+		t.Errorf("FAIL(aof3): unexpected corruption: %v", c)
+	}
+	aof3.Close()
+}
+
+func (t ConfigPersistUtilsTest) Format(title, file string, exp AOFFormat) {
+	aof, err := os.Open(file)
+	if err != nil {
+		t.Fatalf("FAIL(%s): unable to open aof: %s", title, err)
+	}
+	defer aof.Close()
+
+	if _, format, _, err := newAOFReader(bufio.NewReader(aof), t.Size(file)); err != nil {
+		t.Errorf("FAIL(%s): unable to read aof header: %s", title, err)
+
+	} else if format != exp {
+		t.Errorf("FAIL(%s): unexpected format %d != %d", title, format, exp)
+	}
+}
+
+func TestConfigPersistAOFFormat(t *testing.T) {
+	test := NewConfigPersistUtilsTest(t)
+
+	file := test.NewFile()
+	defer os.Remove(file)
+
+	aof0 := &AOFConfigDB{File: file}
+	aof0.NewConfig(test.Config("c0", 0, "d0"))
+	aof0.NewConfig(test.Config("c1", 0, "d1"))
+	aof0.Close()
+	test.Format("aof0", file, AOFFormatV1)
+
+	// Existing files keep their format until they're compacted.
+	aof1 := &AOFConfigDB{File: file, Format: AOFFormatV2, CompressSize: 64}
+	aof1.NewConfig(test.Config("c2", 0, strings.Repeat("d2\n", 100)))
+	test.Format("aof1", file, AOFFormatV1)
+
+	snapshot, _ := aof1.beginCompact()
+	aof1.DeadConfig(test.Tomb("c0", 1))
+	if err := aof1.compact(snapshot); err != nil {
+		t.Fatalf("FAIL(aof1): unable to compact: %s", err)
+	}
+	test.Format("aof1", file, AOFFormatV2)
+
+	aof1.NewConfig(test.Config("c3", 0, strings.Repeat("d3\n", 100)))
+	aof1.Close()
+
+	aof2 := &AOFConfigDB{File: file}
+	state := test.Load("aof2", aof2)
+	test.DiffConfigs("aof2", state,
+		test.Config("c1", 0, "d1"),
+		test.Config("c2", 0, ""),
+		test.Config("c3", 0, ""))
+	test.DiffTombs("aof2", state,
+		test.Tomb("c0", 1))
+
+	if data := state.Configs.Map()["c3"].Data.(*TestConfig).Data; data != strings.Repeat("d3\n", 100) {
+		t.Errorf("FAIL(aof2): unexpected data: %q", data)
+	}
+	aof2.Close()
+
+	// The frame of a torn record is intact but its body runs past the end of
+	// the file.
+	frame, _ := encodeRecord(AOFFormatV2, aofRecord{Head: 'n', Body: []byte(`{"id":"c5"}`)}, 0)
+
+	size := test.Size(file)
+	test.Append(file, string(frame[:len(frame)-1]))
+
+	aof3 := &AOFConfigDB{File: file, Recovery: AOFRecoverStrict}
+	test.DiffConfigs("aof3", test.Load("aof3", aof3),
+		test.Config("c1", 0, "d1"),
+		test.Config("c2", 0, ""),
+		test.Config("c3", 0, ""))
+
+	if corruptions := aof3.Corruptions(); len(corruptions) != 1 || !corruptions[0].Truncated {
+		t.Errorf("FAIL(aof3): unexpected corruptions: %v", corruptions)
+	}
+	aof3.Close()
+
+	if newSize := test.Size(file); newSize != size {
+		t.Errorf("FAIL(aof3): torn record wasn't truncated: %d != %d", newSize, size)
+	}
+
+	// A corrupted length is a corruption even if it prevents reading the rest
+	// of the file and even if it points past the end of the file.
+	binary.BigEndian.PutUint32(frame[0:4], 1<<12)
+	test.Append(file, string(frame))
+	aof4 := &AOFConfigDB{File: file}
+	aof4.NewConfig(test.Config("c4", 0, "d4"))
+	aof4.Close()
+	size = test.Size(file)
+
+	aof5 := &AOFConfigDB{File: file, Recovery: AOFRecoverTruncate}
+	if _, err := aof5.Load(); err != ErrCorruptedAOF {
+		t.Errorf("FAIL(aof5): expected corruption error: %v", err)
+	}
+	if corruptions := aof5.Corruptions(); len(corruptions) != 1 || corruptions[0].Truncated {
+		t.Errorf("FAIL(aof5): unexpected corruptions: %v", corruptions)
+	}
+	aof5.Close()
+
+	if newSize := test.Size(file); newSize != size {
+		t.Errorf("FAIL(aof5): corrupted length was truncated: %d != %d", newSize, size)
+	}
+
+	// A torn header is truncated like any other torn record.
+	header := test.NewFile()
+	defer os.Remove(header)
+	if err := ioutil.WriteFile(header, []byte(magicAOFV2+"\x00\x00"), 0664); err != nil {
+		t.Fatalf("FAIL(aof6): unable to write aof: %s", err)
+	}
+
+	aof6 := &AOFConfigDB{File: header, Format: AOFFormatV2, Recovery: AOFRecoverTruncate}
+	aof6.NewConfig(test.Config("c0", 0, "d0"))
+	if corruptions := aof6.Corruptions(); len(corruptions) != 1 || !corruptions[0].Truncated {
+		t.Errorf("FAIL(aof6): unexpected corruptions: %v", corruptions)
+	}
+	aof6.Close()
+
+	aof7 := &AOFConfigDB{File: header, Recovery: AOFRecoverStrict}
+	test.DiffConfigs("aof7", test.Load("aof7", aof7), test.Config("c0", 0, "d0"))
+	test.Format("aof7", header, AOFFormatV2)
+	aof7.Close()
+}
@@ -0,0 +1,454 @@
+// Copyright (c) 2014 Datacratic. All rights reserved.
+
+package sconf
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// ErrCorruptedDir is the error returned by DirConfigDB when a file that can't
+// be decoded is encountered.
+var ErrCorruptedDir = errors.New("CorruptedDir")
+
+const (
+	dirConfigExt    string = ".json"
+	dirTombstoneExt string = ".dead"
+	dirHorizonFile  string = ".horizon"
+	dirHistoryDir   string = ".history"
+)
+
+// DirConfigDB implements a configuration database as a directory tree where
+// each live config is stored as a json file named <Dir>/<type>/<id>.json and
+// each tombstone is stored as a marker file named <Dir>/<type>/<id>.dead. The
+// files are meant to be read and edited by humans and, as an example, can be
+// committed to a version control system.
+//
+// Every file is written to a temporary file which is then renamed such that a
+// crash will never leave a partially written file behind. A crash between
+// writing a config and removing its previous marker file can leave both files
+// in the directory in which case the usual merge rules are used to pick the
+// winner when the directory is loaded.
+//
+// Files that can't be decoded are reported and skipped while loading in which
+// case Load will return an ErrCorruptedDir error. Types and IDs are escaped
+// before being used as file names. The horizon of the last call to
+// CollectTombstones is stored in <Dir>/.horizon which can't clash with an
+// escaped type.
+//
+// If HistoryRetention is set, the history of each config is stored as a json
+// array in <Dir>/<type>/.history/<id>.json which is rewritten on every change.
+//
+// All the functions of DirConfigDB are safe to call concurrently.
+type DirConfigDB struct {
+	Component
+
+	// Dir indicates the directory where the configs should be stored. Must be
+	// set prior to calling Init and can't be changed afterwards.
+	Dir string
+
+	// HistoryRetention indicates the number of history entries to keep for
+	// each config type. See Configs.SetRetention for more details. Defaults to
+	// no history and can't be changed after calling Init.
+	HistoryRetention map[string]int
+
+	// Registry is used to decode the configs loaded from the directory, to
+	// stamp the schema version of the configs written to it and to resolve the
+	// siblings of concurrent updates. Defaults to DefaultTypeRegistry and can't
+	// be changed after calling Init.
+	Registry *TypeRegistry
+
+	initialized sync.Once
+
+	// lock protects all the fields below and serializes the writes to the
+	// directory.
+	lock sync.Mutex
+
+	configs   *Configs
+	loadError error
+}
+
+// Init initializes the object.
+func (db *DirConfigDB) Init() {
+	db.initialized.Do(db.init)
+}
+
+func (db *DirConfigDB) init() {
+	db.configs = &Configs{Retention: db.HistoryRetention, Registry: db.Registry}
+
+	if len(db.Dir) == 0 {
+		log.Panicf("Dir must be set for DirConfigDB '%s'", db.Name)
+	}
+
+	if err := os.MkdirAll(db.Dir, 0775); err != nil {
+		log.Panicf("unable to create config dir '%s': %s", db.Dir, err)
+	}
+
+	types, err := ioutil.ReadDir(db.Dir)
+	if err != nil {
+		log.Panicf("unable to list config dir '%s': %s", db.Dir, err)
+	}
+
+	for _, typ := range types {
+		if !typ.IsDir() {
+			continue
+		}
+
+		name, err := url.QueryUnescape(typ.Name())
+		if err != nil {
+			db.corrupted(filepath.Join(db.Dir, typ.Name()), err)
+			continue
+		}
+
+		db.loadHistory(filepath.Join(db.Dir, typ.Name(), dirHistoryDir), name)
+		db.loadType(filepath.Join(db.Dir, typ.Name()), name)
+	}
+
+	horizon, err := db.readHorizon()
+	if err != nil {
+		db.corrupted(filepath.Join(db.Dir, dirHorizonFile), err)
+	}
+	db.configs.GC(horizon)
+}
+
+func (db *DirConfigDB) readHorizon() (horizon uint64, err error) {
+	body, err := ioutil.ReadFile(filepath.Join(db.Dir, dirHorizonFile))
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+
+	if err == nil {
+		err = json.Unmarshal(body, &horizon)
+	}
+
+	return
+}
+
+func (db *DirConfigDB) loadType(dir, typ string) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		log.Panicf("unable to list config dir '%s': %s", dir, err)
+	}
+
+	for _, file := range files {
+		if file.IsDir() {
+			continue
+		}
+
+		path := filepath.Join(dir, file.Name())
+
+		switch ext := filepath.Ext(file.Name()); ext {
+		case dirConfigExt, dirTombstoneExt:
+			ID, err := url.QueryUnescape(strings.TrimSuffix(file.Name(), ext))
+			if err == nil {
+				if ext == dirConfigExt {
+					err = db.loadNewConfig(path, typ, ID)
+				} else {
+					err = db.loadDeadConfig(path, typ, ID)
+				}
+			}
+
+			if err != nil {
+				db.corrupted(path, err)
+			}
+		}
+	}
+}
+
+// loadHistory replays the history files of the given type which must happen
+// before the type is loaded since the entries are ordered by version.
+func (db *DirConfigDB) loadHistory(dir, typ string) {
+	files, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return
+	} else if err != nil {
+		log.Panicf("unable to list config dir '%s': %s", dir, err)
+	}
+
+	for _, file := range files {
+		if file.IsDir() || filepath.Ext(file.Name()) != dirConfigExt {
+			continue
+		}
+
+		path := filepath.Join(dir, file.Name())
+		if err := db.loadHistoryFile(path, typ); err != nil {
+			db.corrupted(path, err)
+		}
+	}
+}
+
+func (db *DirConfigDB) loadHistoryFile(path, typ string) error {
+	body, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	var history History
+	if err = db.Registry.Unmarshal(body, &history); err != nil {
+		return err
+	}
+
+	for _, entry := range history {
+		if entry.Config != nil && entry.Config.Type == typ {
+			db.configs.NewConfig(entry.Config)
+		} else if entry.Tombstone != nil && entry.Tombstone.Type == typ {
+			db.configs.DeadConfig(entry.Tombstone)
+		}
+	}
+
+	return nil
+}
+
+func (db *DirConfigDB) corrupted(path string, err error) {
+	db.Error(fmt.Errorf("corrupted config file '%s': %s", path, err))
+	db.loadError = ErrCorruptedDir
+}
+
+// checkKey fills in the type and ID of a hand-written file which omits them and
+// otherwise makes sure that they match the path of the file.
+func checkKey(typ, ID string, fileTyp, fileID *string) error {
+	if len(*fileTyp) == 0 {
+		*fileTyp = typ
+	}
+
+	if len(*fileID) == 0 {
+		*fileID = ID
+	}
+
+	if *fileTyp != typ || *fileID != ID {
+		return fmt.Errorf("type '%s' and id '%s' don't match the file path", *fileTyp, *fileID)
+	}
+
+	return nil
+}
+
+func (db *DirConfigDB) loadNewConfig(path, typ, ID string) error {
+	body, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	// The data is decoded separately since its type may only be known once
+	// the path of the file has been taken into account.
+	var raw configJSON
+	if err = json.Unmarshal(body, &raw); err != nil {
+		return err
+	}
+
+	if err = checkKey(typ, ID, &raw.Type, &raw.ID); err != nil {
+		return err
+	}
+
+	config, err := db.Registry.config(&raw)
+	if err != nil {
+		return err
+	}
+
+	db.configs.NewConfig(config)
+	return nil
+}
+
+func (db *DirConfigDB) loadDeadConfig(path, typ, ID string) error {
+	body, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	tombstone := &Tombstone{}
+	if err = json.Unmarshal(body, tombstone); err != nil {
+		return err
+	}
+
+	if err = checkKey(typ, ID, &tombstone.Type, &tombstone.ID); err != nil {
+		return err
+	}
+
+	db.configs.DeadConfig(tombstone)
+	return nil
+}
+
+// escapeFileName escapes the given type or ID such that it can safely be used
+// as a file name. Leading dots are escaped to avoid the special "." and ".."
+// entries and hidden files.
+func escapeFileName(name string) string {
+	name = url.QueryEscape(name)
+	if strings.HasPrefix(name, ".") {
+		name = "%2E" + name[1:]
+	}
+	return name
+}
+
+func (db *DirConfigDB) historyPath(typ, ID string) string {
+	return filepath.Join(db.typePath(typ), dirHistoryDir, escapeFileName(ID)+dirConfigExt)
+}
+
+func (db *DirConfigDB) typePath(typ string) string {
+	return filepath.Join(db.Dir, escapeFileName(typ))
+}
+
+func (db *DirConfigDB) filePath(typ, ID, ext string) string {
+	return filepath.Join(db.typePath(typ), escapeFileName(ID)+ext)
+}
+
+// Load returns a copy of the database and a CorruptedDir error if a file
+// couldn't be decoded while loading the database.
+func (db *DirConfigDB) Load() (*Configs, error) {
+	db.Init()
+
+	db.lock.Lock()
+	defer db.lock.Unlock()
+
+	return db.configs.Copy(), db.loadError
+}
+
+// History returns the history of the config of the given type and ID.
+func (db *DirConfigDB) History(typ, ID string) History {
+	db.Init()
+
+	db.lock.Lock()
+	defer db.lock.Unlock()
+
+	return db.configs.History(typ, ID)
+}
+
+// NewConfig adds the given config to the database.
+func (db *DirConfigDB) NewConfig(config *Config) {
+	db.Init()
+
+	config = db.Registry.stamp(config)
+
+	db.lock.Lock()
+	defer db.lock.Unlock()
+
+	if _, isNew := db.configs.NewConfig(config); !isNew {
+		return
+	}
+	result, _ := db.configs.Get(config.Type, config.ID)
+	config = result.Config
+
+	body, err := json.MarshalIndent(config, "", "    ")
+	if err != nil {
+		db.Error(fmt.Errorf("unable to encode config %v: %s", *config, err))
+		return
+	}
+
+	path := db.filePath(config.Type, config.ID, dirConfigExt)
+	if err = db.write(path, body); err != nil {
+		db.Error(fmt.Errorf("unable to write config %v: %s", *config, err))
+		return
+	}
+
+	path = db.filePath(config.Type, config.ID, dirTombstoneExt)
+	if err = os.Remove(path); err != nil && !os.IsNotExist(err) {
+		db.Error(fmt.Errorf("unable to remove tombstone '%s': %s", path, err))
+	}
+
+	db.writeHistory(config.Type, config.ID)
+}
+
+// DeadConfig adds the given config tombstone to the database.
+func (db *DirConfigDB) DeadConfig(tombstone *Tombstone) {
+	db.Init()
+
+	db.lock.Lock()
+	defer db.lock.Unlock()
+
+	if _, isNew := db.configs.DeadConfig(tombstone); !isNew {
+		return
+	}
+
+	body, err := json.MarshalIndent(tombstone, "", "    ")
+	if err != nil {
+		db.Error(fmt.Errorf("unable to encode tombstone %v: %s", *tombstone, err))
+		return
+	}
+
+	path := db.filePath(tombstone.Type, tombstone.ID, dirTombstoneExt)
+	if err = db.write(path, body); err != nil {
+		db.Error(fmt.Errorf("unable to write tombstone %v: %s", *tombstone, err))
+		return
+	}
+
+	path = db.filePath(tombstone.Type, tombstone.ID, dirConfigExt)
+	if err = os.Remove(path); err != nil && !os.IsNotExist(err) {
+		db.Error(fmt.Errorf("unable to remove config '%s': %s", path, err))
+	}
+
+	db.writeHistory(tombstone.Type, tombstone.ID)
+}
+
+// writeHistory must be called while holding lock.
+func (db *DirConfigDB) writeHistory(typ, ID string) {
+	history := db.configs.History(typ, ID)
+	if len(history) == 0 {
+		return
+	}
+
+	body, err := json.MarshalIndent(history, "", "    ")
+	if err != nil {
+		db.Error(fmt.Errorf("unable to encode history of '%s' for type '%s': %s", ID, typ, err))
+		return
+	}
+
+	path := db.historyPath(typ, ID)
+	if err = db.write(path, body); err != nil {
+		db.Error(fmt.Errorf("unable to write history '%s': %s", path, err))
+	}
+}
+
+// CollectTombstones garbage collects the tombstones below the given horizon and
+// removes their marker and history files.
+func (db *DirConfigDB) CollectTombstones(horizon uint64) {
+	db.Init()
+
+	db.lock.Lock()
+	defer db.lock.Unlock()
+
+	if horizon <= db.configs.Horizon {
+		return
+	}
+
+	// The horizon is written first such that a crash can't resurrect the
+	// collected configs.
+	path := filepath.Join(db.Dir, dirHorizonFile)
+	if err := writeFileAtomic(path, []byte(fmt.Sprintf("%d\n", horizon))); err != nil {
+		db.Error(fmt.Errorf("unable to write horizon '%s': %s", path, err))
+		return
+	}
+
+	for _, tombstone := range db.configs.GC(horizon) {
+		path = db.filePath(tombstone.Type, tombstone.ID, dirTombstoneExt)
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			db.Error(fmt.Errorf("unable to remove tombstone '%s': %s", path, err))
+		}
+
+		path = db.historyPath(tombstone.Type, tombstone.ID)
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			db.Error(fmt.Errorf("unable to remove history '%s': %s", path, err))
+		}
+	}
+}
+
+// write must be called while holding lock.
+func (db *DirConfigDB) write(path string, body []byte) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0775); err != nil {
+		return err
+	}
+
+	return writeFileAtomic(path, append(body, '\n'))
+}
+
+// Close closes the database. All writes are flushed before NewConfig and
+// DeadConfig return so there's nothing left to do.
+func (db *DirConfigDB) Close() error {
+	db.Init()
+	return nil
+}
@@ -0,0 +1,94 @@
+// Copyright (c) 2014 Datacratic. All rights reserved.
+
+package sconf
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func (t ConfigPersistUtilsTest) Exists(title, path string, exp bool) {
+	if _, err := os.Stat(path); (err == nil) != exp {
+		t.Errorf("FAIL(%s): unexpected file state for '%s': %v != %v", title, path, err == nil, exp)
+	}
+}
+
+func TestConfigPersistDir(t *testing.T) {
+	test := NewConfigPersistUtilsTest(t)
+
+	dir := test.NewDir()
+	defer os.RemoveAll(dir)
+
+	db0 := &DirConfigDB{Dir: dir}
+
+	db0.NewConfig(test.Config("c0", 0, "d0"))
+	db0.NewConfig(test.Config("c1", 0, "d1"))
+	db0.NewConfig(test.Config("c2", 0, "d2"))
+	db0.DeadConfig(test.Tomb("c1", 1))
+	db0.DeadConfig(test.Tomb("c2", 0))
+	db0.NewConfig(test.Config("c2", 1, "d3"))
+	db0.NewConfig(test.Config("../c4", 0, "d6"))
+	db0.Close()
+
+	test.Exists("db0.c0", dir+"/test/c0.json", true)
+	test.Exists("db0.c1.live", dir+"/test/c1.json", false)
+	test.Exists("db0.c1.dead", dir+"/test/c1.dead", true)
+	test.Exists("db0.c2.live", dir+"/test/c2.json", true)
+	test.Exists("db0.c2.dead", dir+"/test/c2.dead", false)
+
+	db1 := &DirConfigDB{Dir: dir}
+	test.DiffConfigs("db1", test.Load("db1", db1),
+		test.Config("c0", 0, "d0"),
+		test.Config("c2", 1, "d3"),
+		test.Config("../c4", 0, "d6"))
+	test.DiffTombs("db1", test.Load("db1", db1),
+		test.Tomb("c1", 1))
+
+	db1.NewConfig(test.Config("c1", 3, "d4"))
+	db1.DeadConfig(test.Tomb("c2", 2))
+	db1.NewConfig(test.Config("c3", 2, "d5"))
+	db1.Close()
+
+	// Hand-edited files can omit the type and id which are taken from the path.
+	body := []byte(`{ "ver": 4, "data": { "data": "d7" } }`)
+	if err := ioutil.WriteFile(dir+"/test/c0.json", body, 0664); err != nil {
+		t.Fatalf("FAIL(edit): unable to write config: %s", err)
+	}
+
+	db2 := &DirConfigDB{Dir: dir}
+	test.DiffConfigs("db2", test.Load("db2", db2),
+		test.Config("c0", 4, "d7"),
+		test.Config("c1", 3, "d4"),
+		test.Config("c3", 2, "d5"),
+		test.Config("../c4", 0, "d6"))
+	test.DiffTombs("db2", test.Load("db2", db2),
+		test.Tomb("c2", 2))
+	db2.Close()
+}
+
+func TestConfigPersistDirCorrupted(t *testing.T) {
+	test := NewConfigPersistUtilsTest(t)
+
+	dir := test.NewDir()
+	defer os.RemoveAll(dir)
+
+	db0 := &DirConfigDB{Dir: dir}
+	db0.NewConfig(test.Config("c0", 0, "d0"))
+	db0.NewConfig(test.Config("c1", 0, "d1"))
+	db0.Close()
+
+	if err := ioutil.WriteFile(dir+"/test/c1.json", []byte(`{ "ver": `), 0664); err != nil {
+		t.Fatalf("FAIL(corrupt): unable to write config: %s", err)
+	}
+
+	db1 := &DirConfigDB{Dir: dir}
+	configs, err := db1.Load()
+	if err != ErrCorruptedDir {
+		t.Errorf("FAIL(db1): expected corruption error: %v", err)
+	}
+
+	test.DiffConfigs("db1", configs.Types[TestConfigType],
+		test.Config("c0", 0, "d0"))
+	db1.Close()
+}
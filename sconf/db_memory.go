@@ -4,13 +4,19 @@ package sconf
 
 // MemoryConfigDB defines an in-memory config database which is not persisted.
 type MemoryConfigDB struct {
+
+	// HistoryRetention indicates the number of history entries to keep for
+	// each config type. See Configs.SetRetention for more details. Must be set
+	// before adding configs and can't be changed afterwards.
+	HistoryRetention map[string]int
+
 	state *Configs
 }
 
 // NewConfig adds the given config to the database.
 func (db *MemoryConfigDB) NewConfig(config *Config) {
 	if db.state == nil {
-		db.state = &Configs{}
+		db.state = &Configs{Retention: db.HistoryRetention}
 	}
 	db.state.NewConfig(config)
 }
@@ -18,7 +24,7 @@ func (db *MemoryConfigDB) NewConfig(config *Config) {
 // DeadConfig adds the given config tombstone to the database.
 func (db *MemoryConfigDB) DeadConfig(tombstone *Tombstone) {
 	if db.state == nil {
-		db.state = &Configs{}
+		db.state = &Configs{Retention: db.HistoryRetention}
 	}
 	db.state.DeadConfig(tombstone)
 }
@@ -26,7 +32,23 @@ func (db *MemoryConfigDB) DeadConfig(tombstone *Tombstone) {
 // Load returns a copy of the database.
 func (db *MemoryConfigDB) Load() (state *Configs, err error) {
 	if db.state == nil {
-		db.state = &Configs{}
+		db.state = &Configs{Retention: db.HistoryRetention}
 	}
 	return db.state.Copy(), nil
 }
+
+// CollectTombstones garbage collects the tombstones below the given horizon.
+func (db *MemoryConfigDB) CollectTombstones(horizon uint64) {
+	if db.state == nil {
+		db.state = &Configs{Retention: db.HistoryRetention}
+	}
+	db.state.GC(horizon)
+}
+
+// History returns the history of the config of the given type and ID.
+func (db *MemoryConfigDB) History(typ, ID string) History {
+	if db.state == nil {
+		db.state = &Configs{Retention: db.HistoryRetention}
+	}
+	return db.state.History(typ, ID)
+}
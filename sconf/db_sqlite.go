@@ -0,0 +1,496 @@
+// Copyright (c) 2014 Datacratic. All rights reserved.
+
+package sconf
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"sync"
+)
+
+const sqliteSchema = `
+CREATE TABLE IF NOT EXISTS configs (
+	type TEXT NOT NULL,
+	id   TEXT NOT NULL,
+	ver  INTEGER NOT NULL,
+	body BLOB NOT NULL,
+	PRIMARY KEY (type, id)
+);
+
+CREATE TABLE IF NOT EXISTS tombstones (
+	type TEXT NOT NULL,
+	id   TEXT NOT NULL,
+	ver  INTEGER NOT NULL,
+	PRIMARY KEY (type, id)
+);
+
+CREATE TABLE IF NOT EXISTS horizon (
+	ver INTEGER NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS history (
+	seq  INTEGER PRIMARY KEY AUTOINCREMENT,
+	type TEXT NOT NULL,
+	id   TEXT NOT NULL,
+	body BLOB NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS history_key ON history (type, id, seq);
+`
+
+// SQLiteConfigDB implements a configuration database on top of a SQLite
+// database where configs and tombstones are stored in separate tables keyed by
+// their type and ID. Unlike the other databases, the state is not held in
+// memory and can be queried directly via the Get and Stream functions.
+//
+// New entries are subjected to the same version rules as the Configs object
+// such that a config or tombstone that wouldn't be new is ignored. Versions are
+// stored as signed integers and are compared outside of the database so the
+// full range of uint64 is supported. The horizon of the last call to
+// CollectTombstones is stored in its own table.
+//
+// If HistoryRetention is set, every new config or tombstone is also recorded
+// in a history table which is trimmed to the retention of the type as part of
+// the same transaction.
+//
+// The package doesn't register a SQLite driver such that importing sconf
+// doesn't require cgo. The driver must be registered by the caller, usually
+// by importing github.com/mattn/go-sqlite3, before calling Init.
+//
+// All the functions of SQLiteConfigDB are safe to call concurrently.
+type SQLiteConfigDB struct {
+	Component
+
+	// File indicates the path of the SQLite database file which is opened with
+	// the sqlite3 driver. One of File or DB must be set prior to calling Init
+	// and can't be changed afterwards.
+	File string
+
+	// DB indicates the SQLite database to use. One of File or DB must be set
+	// prior to calling Init and can't be changed afterwards.
+	DB *sql.DB
+
+	// HistoryRetention indicates the number of history entries to keep for
+	// each config type. See Configs.SetRetention for more details. Defaults to
+	// no history and can't be changed after calling Init.
+	HistoryRetention map[string]int
+
+	// Registry is used to decode the configs read from the database, to stamp
+	// the schema version of the configs written to it and to resolve the
+	// siblings of concurrent updates. Defaults to DefaultTypeRegistry and can't
+	// be changed after calling Init.
+	Registry *TypeRegistry
+
+	initialized sync.Once
+
+	// lock serializes the writes such that the version checks and the updates
+	// are applied atomically.
+	lock    sync.Mutex
+	horizon uint64
+}
+
+// Init initializes the object.
+func (db *SQLiteConfigDB) Init() {
+	db.initialized.Do(db.init)
+}
+
+func (db *SQLiteConfigDB) init() {
+	if len(db.File) > 0 {
+		var err error
+		if db.DB, err = sql.Open("sqlite3", db.File); err != nil {
+			log.Panicf("unable to open sqlite db '%s': %s", db.File, err)
+		}
+	}
+
+	if db.DB == nil {
+		log.Panicf("DB or File must be set for SQLiteConfigDB '%s'", db.Name)
+	}
+
+	if _, err := db.DB.Exec(sqliteSchema); err != nil {
+		log.Panicf("unable to create sqlite schema for '%s': %s", db.Name, err)
+	}
+
+	var horizon int64
+	err := db.DB.QueryRow("SELECT ver FROM horizon").Scan(&horizon)
+	if err != nil && err != sql.ErrNoRows {
+		log.Panicf("unable to read sqlite horizon for '%s': %s", db.Name, err)
+	}
+	db.horizon = uint64(horizon)
+}
+
+// Close closes the underlying database.
+func (db *SQLiteConfigDB) Close() error {
+	db.Init()
+	return db.DB.Close()
+}
+
+// querier is implemented by both sql.DB and sql.Tx.
+type querier interface {
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+// get returns the config or tombstone associated with the given type and ID as
+// a TypeConfigs object such that the version rules can be applied. The body of
+// the config is decoded since it's required to resolve conflicts.
+func (db *SQLiteConfigDB) get(q querier, typ, ID string) (*TypeConfigs, error) {
+	state := &TypeConfigs{Registry: db.Registry}
+
+	var ver int64
+	var body []byte
+
+	err := q.QueryRow("SELECT ver, body FROM configs WHERE type = ? AND id = ?", typ, ID).Scan(&ver, &body)
+	if err == nil {
+		config := &Config{}
+		if err = db.Registry.Unmarshal(body, config); err != nil {
+			return nil, err
+		}
+		state.NewConfig(config)
+
+	} else if err != sql.ErrNoRows {
+		return nil, err
+	}
+
+	err = q.QueryRow("SELECT ver FROM tombstones WHERE type = ? AND id = ?", typ, ID).Scan(&ver)
+	if err == nil {
+		state.DeadConfig(&Tombstone{Type: typ, ID: ID, Version: uint64(ver)})
+
+	} else if err != sql.ErrNoRows {
+		return nil, err
+	}
+
+	return state, nil
+}
+
+// Get returns the config or tombstone associated with the given type and ID and
+// a bool indicating whether the ID is present in the database for the given
+// type.
+func (db *SQLiteConfigDB) Get(typ, ID string) (result ConfigResult, ok bool, err error) {
+	db.Init()
+
+	state, err := db.get(db.DB, typ, ID)
+	if err != nil {
+		return
+	}
+
+	result, ok = state.Get(ID)
+	return
+}
+
+// Stream invokes NewConfig on the handler for every config in the database
+// followed by DeadConfig for every tombstone. Rows are decoded one at a time
+// such that the database never has to be held in memory. Returns an error if
+// the database couldn't be read or if a row couldn't be decoded.
+func (db *SQLiteConfigDB) Stream(handler Handler) error {
+	db.Init()
+
+	rows, err := db.DB.Query("SELECT body FROM configs")
+	if err != nil {
+		return err
+	}
+
+	for rows.Next() {
+		var body []byte
+		if err = rows.Scan(&body); err != nil {
+			rows.Close()
+			return err
+		}
+
+		config := &Config{}
+		if err = db.Registry.Unmarshal(body, config); err != nil {
+			rows.Close()
+			return err
+		}
+
+		handler.NewConfig(config)
+	}
+
+	if err = rows.Err(); err != nil {
+		return err
+	}
+
+	if rows, err = db.DB.Query("SELECT type, id, ver FROM tombstones"); err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var ver int64
+		tombstone := &Tombstone{}
+
+		if err = rows.Scan(&tombstone.Type, &tombstone.ID, &ver); err != nil {
+			return err
+		}
+
+		tombstone.Version = uint64(ver)
+		handler.DeadConfig(tombstone)
+	}
+
+	return rows.Err()
+}
+
+// configsHandler adapts a Configs object to the Handler interface.
+type configsHandler struct{ configs *Configs }
+
+func (handler configsHandler) NewConfig(config *Config)        { handler.configs.NewConfig(config) }
+func (handler configsHandler) DeadConfig(tombstone *Tombstone) { handler.configs.DeadConfig(tombstone) }
+
+// History returns the history of the config of the given type and ID.
+func (db *SQLiteConfigDB) History(typ, ID string) (history History, err error) {
+	db.Init()
+
+	rows, err := db.DB.Query("SELECT body FROM history WHERE type = ? AND id = ? ORDER BY seq", typ, ID)
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var entry ConfigResult
+		if entry, err = db.scanHistory(rows); err != nil {
+			return
+		}
+		history = append(history, entry)
+	}
+
+	err = rows.Err()
+	return
+}
+
+func (db *SQLiteConfigDB) scanHistory(rows *sql.Rows) (entry ConfigResult, err error) {
+	var body []byte
+	if err = rows.Scan(&body); err == nil {
+		err = db.Registry.Unmarshal(body, &entry)
+	}
+	return
+}
+
+// streamHistory replays the history table into the handler in the order in
+// which the entries were recorded.
+func (db *SQLiteConfigDB) streamHistory(handler Handler) error {
+	rows, err := db.DB.Query("SELECT body FROM history ORDER BY seq")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		entry, err := db.scanHistory(rows)
+		if err != nil {
+			return err
+		}
+
+		if entry.Config != nil {
+			handler.NewConfig(entry.Config)
+		} else if entry.Tombstone != nil {
+			handler.DeadConfig(entry.Tombstone)
+		}
+	}
+
+	return rows.Err()
+}
+
+// recordHistory must be called within the transaction that adds the entry.
+func (db *SQLiteConfigDB) recordHistory(tx *sql.Tx, typ, ID string, entry ConfigResult) error {
+	retention := typeRetention(db.HistoryRetention, typ)
+	if retention <= 0 {
+		return nil
+	}
+
+	body, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec("INSERT INTO history (type, id, body) VALUES (?, ?, ?)", typ, ID, body)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(`DELETE FROM history WHERE type = ? AND id = ? AND seq NOT IN
+		(SELECT seq FROM history WHERE type = ? AND id = ? ORDER BY seq DESC LIMIT ?)`,
+		typ, ID, typ, ID, retention)
+	return err
+}
+
+// Load returns the content of the database along with the history of the
+// configs. Use Stream to avoid holding the database in memory.
+func (db *SQLiteConfigDB) Load() (*Configs, error) {
+	db.Init()
+
+	configs := &Configs{Retention: db.HistoryRetention, Registry: db.Registry}
+	if err := db.streamHistory(configsHandler{configs}); err != nil {
+		return nil, err
+	}
+
+	if err := db.Stream(configsHandler{configs}); err != nil {
+		return nil, err
+	}
+
+	db.lock.Lock()
+	configs.GC(db.horizon)
+	db.lock.Unlock()
+
+	return configs, nil
+}
+
+// NewConfig adds the given config to the database.
+func (db *SQLiteConfigDB) NewConfig(config *Config) {
+	db.Init()
+
+	config = db.Registry.stamp(config)
+
+	err := db.update(config.Type, config.ID, func(tx *sql.Tx, state *TypeConfigs) (err error) {
+		if _, isNew := state.NewConfig(config); !isNew {
+			return
+		}
+
+		// Configs with version vectors can be merged with the existing config.
+		merged, _ := state.Configs.Get(config.ID)
+
+		body, err := json.Marshal(merged)
+		if err != nil {
+			return
+		}
+
+		_, err = tx.Exec("INSERT OR REPLACE INTO configs (type, id, ver, body) VALUES (?, ?, ?, ?)",
+			config.Type, config.ID, int64(merged.Version), body)
+		if err == nil {
+			_, err = tx.Exec("DELETE FROM tombstones WHERE type = ? AND id = ?", config.Type, config.ID)
+		}
+		if err == nil {
+			err = db.recordHistory(tx, config.Type, config.ID, ConfigResult{Config: merged})
+		}
+		return
+	})
+
+	if err != nil {
+		db.Error(fmt.Errorf("unable to write config %v: %s", *config, err))
+	}
+}
+
+// DeadConfig adds the given config tombstone to the database.
+func (db *SQLiteConfigDB) DeadConfig(tombstone *Tombstone) {
+	db.Init()
+
+	err := db.update(tombstone.Type, tombstone.ID, func(tx *sql.Tx, state *TypeConfigs) (err error) {
+		if _, isNew := state.DeadConfig(tombstone); !isNew {
+			return
+		}
+
+		_, err = tx.Exec("INSERT OR REPLACE INTO tombstones (type, id, ver) VALUES (?, ?, ?)",
+			tombstone.Type, tombstone.ID, int64(tombstone.Version))
+		if err == nil {
+			_, err = tx.Exec("DELETE FROM configs WHERE type = ? AND id = ?", tombstone.Type, tombstone.ID)
+		}
+		if err == nil {
+			err = db.recordHistory(tx, tombstone.Type, tombstone.ID, ConfigResult{Tombstone: tombstone})
+		}
+		return
+	})
+
+	if err != nil {
+		db.Error(fmt.Errorf("unable to write tombstone %v: %s", *tombstone, err))
+	}
+}
+
+// CollectTombstones garbage collects the tombstones below the given horizon
+// along with their history.
+func (db *SQLiteConfigDB) CollectTombstones(horizon uint64) {
+	db.Init()
+
+	db.lock.Lock()
+	defer db.lock.Unlock()
+
+	if horizon <= db.horizon {
+		return
+	}
+
+	if err := db.collect(horizon); err != nil {
+		db.Error(fmt.Errorf("unable to collect tombstones below %d: %s", horizon, err))
+		return
+	}
+
+	db.horizon = horizon
+}
+
+// collect must be called while holding lock.
+func (db *SQLiteConfigDB) collect(horizon uint64) error {
+	tx, err := db.DB.Begin()
+	if err != nil {
+		return err
+	}
+
+	// Versions are compared outside of the database since they're stored as
+	// signed integers.
+	var collected []*Tombstone
+	err = func() error {
+		rows, err := tx.Query("SELECT type, id, ver FROM tombstones")
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		for rows.Next() {
+			var ver int64
+			tombstone := &Tombstone{}
+
+			if err = rows.Scan(&tombstone.Type, &tombstone.ID, &ver); err != nil {
+				return err
+			}
+
+			if tombstone.Version = uint64(ver); tombstone.Version < horizon {
+				collected = append(collected, tombstone)
+			}
+		}
+		return rows.Err()
+	}()
+
+	for i := 0; err == nil && i < len(collected); i++ {
+		_, err = tx.Exec("DELETE FROM tombstones WHERE type = ? AND id = ?", collected[i].Type, collected[i].ID)
+		if err == nil {
+			_, err = tx.Exec("DELETE FROM history WHERE type = ? AND id = ?", collected[i].Type, collected[i].ID)
+		}
+	}
+
+	if err == nil {
+		_, err = tx.Exec("DELETE FROM horizon")
+	}
+
+	if err == nil {
+		_, err = tx.Exec("INSERT INTO horizon (ver) VALUES (?)", int64(horizon))
+	}
+
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// update reads the current state of the given type and ID and passes it to fn
+// within a single transaction.
+func (db *SQLiteConfigDB) update(typ, ID string, fn func(*sql.Tx, *TypeConfigs) error) error {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+
+	tx, err := db.DB.Begin()
+	if err != nil {
+		return err
+	}
+
+	state, err := db.get(tx, typ, ID)
+	if err == nil {
+		state.Horizon = db.horizon
+		err = fn(tx, state)
+	}
+
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
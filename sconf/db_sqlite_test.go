@@ -0,0 +1,90 @@
+// Copyright (c) 2014 Datacratic. All rights reserved.
+
+package sconf
+
+import (
+	_ "github.com/mattn/go-sqlite3"
+
+	"os"
+	"testing"
+)
+
+func TestConfigPersistSQLite(t *testing.T) {
+	test := NewConfigPersistUtilsTest(t)
+
+	file := test.NewFile()
+	defer os.Remove(file)
+
+	db0 := &SQLiteConfigDB{File: file}
+
+	db0.NewConfig(test.Config("c0", 0, "d0"))
+	db0.NewConfig(test.Config("c1", 0, "d1"))
+	db0.NewConfig(test.Config("c2", 0, "d2"))
+	db0.DeadConfig(test.Tomb("c1", 1))
+	db0.DeadConfig(test.Tomb("c2", 0))
+	db0.NewConfig(test.Config("c2", 1, "d3"))
+	db0.NewConfig(test.Config("c0", 0, "d4"))
+	db0.DeadConfig(test.Tomb("c1", 0))
+	db0.Close()
+
+	db1 := &SQLiteConfigDB{File: file}
+	test.DiffConfigs("db1", test.Load("db1", db1),
+		test.Config("c0", 0, "d0"),
+		test.Config("c2", 1, "d3"))
+	test.DiffTombs("db1", test.Load("db1", db1),
+		test.Tomb("c1", 1))
+
+	if result, ok, err := db1.Get(TestConfigType, "c2"); err != nil || !ok {
+		t.Errorf("FAIL(db1.get): unable to get config: %v %v", ok, err)
+
+	} else if data := result.Config.Data.(*TestConfig).Data; data != "d3" {
+		t.Errorf("FAIL(db1.get): unexpected config data: %s", data)
+	}
+
+	if _, ok, err := db1.Get(TestConfigType, "c5"); err != nil || ok {
+		t.Errorf("FAIL(db1.get): unexpected config: %v %v", ok, err)
+	}
+
+	db1.NewConfig(test.Config("c1", 3, "d4"))
+	db1.DeadConfig(test.Tomb("c2", 2))
+	db1.NewConfig(test.Config("c3", 2, "d5"))
+	db1.NewConfig(test.Config("c4", 1<<63+1, "d6"))
+	db1.NewConfig(test.Config("c4", 1, "d7"))
+	db1.Close()
+
+	db2 := &SQLiteConfigDB{File: file}
+	test.DiffConfigs("db2", test.Load("db2", db2),
+		test.Config("c0", 0, "d0"),
+		test.Config("c1", 3, "d4"),
+		test.Config("c3", 2, "d5"),
+		test.Config("c4", 1<<63+1, "d6"))
+	test.DiffTombs("db2", test.Load("db2", db2),
+		test.Tomb("c2", 2))
+	db2.Close()
+}
+
+func TestConfigPersistSQLiteConflict(t *testing.T) {
+	test := NewConfigPersistUtilsTest(t)
+
+	file := test.NewFile()
+	defer os.Remove(file)
+
+	a, b := test.Config("c0", 1, "a"), test.Config("c0", 1, "b")
+	winner := "a"
+	if b.wins(a, nil) {
+		winner = "b"
+	}
+
+	db0 := &SQLiteConfigDB{File: file}
+	db0.NewConfig(a)
+	db0.NewConfig(b)
+	db0.NewConfig(a)
+
+	if result, _, err := db0.Get(TestConfigType, "c0"); err != nil {
+		t.Errorf("FAIL(conflict): unable to get config: %s", err)
+
+	} else if data := result.Config.Data.(*TestConfig).Data; data != winner {
+		t.Errorf("FAIL(conflict): unexpected winner %s != %s", data, winner)
+	}
+	db0.Close()
+}
@@ -0,0 +1,231 @@
+// Copyright (c) 2014 Datacratic. All rights reserved.
+
+package sconf
+
+import (
+	"encoding/binary"
+	"hash"
+	"hash/fnv"
+	"sync/atomic"
+)
+
+// DigestBuckets is the number of buckets in a TypeDigest.
+const DigestBuckets = 256
+
+// ConfigDigest summarizes the content of a Configs object as a hash tree which
+// allows two peers to cheaply determine whether their configs differ and, if
+// they do, which types differ. The hashes cover the type, ID, version and
+// liveness of the configs and tombstones along with the data and version vector
+// of the configs such that configs in conflict also cause the digests to differ.
+type ConfigDigest struct {
+
+	// Root is the combined hash of all the types.
+	Root uint64 `json:"root"`
+
+	// Types contains the hash of each type with at least one config or
+	// tombstone.
+	Types map[string]uint64 `json:"types,omitempty"`
+}
+
+// Diff returns the types whose hash differ between the two digests.
+func (digest *ConfigDigest) Diff(other *ConfigDigest) (types []string) {
+	if digest.Root == other.Root {
+		return
+	}
+
+	for typ, hash := range digest.Types {
+		if other.Types[typ] != hash {
+			types = append(types, typ)
+		}
+	}
+
+	for typ := range other.Types {
+		if _, ok := digest.Types[typ]; !ok {
+			types = append(types, typ)
+		}
+	}
+
+	return
+}
+
+// TypeDigest summarizes the content of a TypeConfigs object as a fixed number
+// of buckets where each config or tombstone is assigned to a bucket based on
+// its ID. The hash of a bucket is the XOR of the hashes of its entries which
+// allows the digest to be updated incrementally.
+type TypeDigest []uint64
+
+// Hash returns the combined hash of all the buckets.
+func (digest TypeDigest) Hash() (hash uint64) {
+	for _, bucket := range digest {
+		hash ^= bucket
+	}
+	return
+}
+
+// Diff returns the index of the buckets that differ between the two digests.
+func (digest TypeDigest) Diff(other TypeDigest) (buckets []int) {
+	for i := 0; i < DigestBuckets; i++ {
+		var a, b uint64
+		if i < len(digest) {
+			a = digest[i]
+		}
+		if i < len(other) {
+			b = other[i]
+		}
+
+		if a != b {
+			buckets = append(buckets, i)
+		}
+	}
+	return
+}
+
+// DigestBucket returns the bucket of a TypeDigest that the given ID is assigned
+// to.
+func DigestBucket(ID string) int {
+	hash := fnv.New32a()
+	hash.Write([]byte(ID))
+	return int(hash.Sum32() % DigestBuckets)
+}
+
+func digestEntry(typ, ID string, version uint64, live bool) hash.Hash64 {
+	hash := fnv.New64a()
+	hash.Write([]byte(typ))
+	hash.Write([]byte{0})
+	hash.Write([]byte(ID))
+	hash.Write([]byte{0})
+
+	var buffer [9]byte
+	binary.BigEndian.PutUint64(buffer[:8], version)
+	if live {
+		buffer[8] = 1
+	}
+	hash.Write(buffer[:])
+
+	return hash
+}
+
+// configEntry returns the hash of a live config which covers its data and
+// version vector.
+func configEntry(config *Config, hashes dataHashes) uint64 {
+	hash := digestEntry(config.Type, config.ID, config.Version, true)
+	hash.Write(hashes.of(config))
+	config.Vector.hash(hash)
+	return hash.Sum64()
+}
+
+func (digest TypeDigest) addConfig(config *Config, hashes dataHashes) {
+	digest[DigestBucket(config.ID)] ^= configEntry(config, hashes)
+}
+
+func (digest TypeDigest) addTombstone(tombstone *Tombstone) {
+	hash := digestEntry(tombstone.Type, tombstone.ID, tombstone.Version, false)
+	digest[DigestBucket(tombstone.ID)] ^= hash.Sum64()
+}
+
+// Digest returns the digest of the container.
+func (configs *Configs) Digest() *ConfigDigest {
+	digest := &ConfigDigest{Types: make(map[string]uint64)}
+
+	for typ, state := range configs.Types {
+		if state.Len() == 0 {
+			continue
+		}
+
+		hash := state.Digest().Hash()
+		digest.Types[typ] = hash
+
+		typeHash := fnv.New64a()
+		typeHash.Write([]byte(typ))
+		digest.Root ^= typeHash.Sum64() ^ hash
+	}
+
+	return digest
+}
+
+// Bucket returns the configs and tombstones of the given type which are assigned
+// to the given bucket of the type's digest.
+func (configs *Configs) Bucket(typ string, bucket int) *Configs {
+	result := &Configs{}
+
+	if state, ok := configs.Types[typ]; ok {
+		result.Types = map[string]*TypeConfigs{typ: state.Bucket(bucket)}
+	}
+
+	return result
+}
+
+// Digest returns the digest of the container. The digest is maintained
+// incrementally by the mutating functions and computed from scratch otherwise.
+// The returned digest should not be modified.
+func (configs *TypeConfigs) Digest() TypeDigest {
+	if configs.digest != nil {
+		return configs.digest.digest
+	}
+	return configs.computeDigest()
+}
+
+func (configs *TypeConfigs) computeDigest() TypeDigest {
+	digest := make(TypeDigest, DigestBuckets)
+
+	configs.Configs.Range(func(ID string, config *Config) bool {
+		digest.addConfig(config, nil)
+		return true
+	})
+
+	configs.Tombstones.Range(func(ID string, tombstone *Tombstone) bool {
+		digest.addTombstone(tombstone)
+		return true
+	})
+
+	return digest
+}
+
+// mutableDigest returns the digest that should be updated by the mutating
+// functions. The digest is copied first if it's shared with another container.
+func (configs *TypeConfigs) mutableDigest() TypeDigest {
+	if configs.digest == nil {
+		configs.digest = &sharedDigest{digest: configs.computeDigest()}
+	} else if configs.digest.isShared() {
+		configs.digest = &sharedDigest{digest: append(TypeDigest(nil), configs.digest.digest...)}
+	}
+	return configs.digest.digest
+}
+
+// sharedDigest holds the digest of a TypeConfigs which is shared between the
+// copies of the container until one of them modifies it. Copies can be made
+// concurrently from the same container so the flag is set atomically.
+type sharedDigest struct {
+	digest TypeDigest
+	shared int32
+}
+
+func (digest *sharedDigest) share() {
+	atomic.StoreInt32(&digest.shared, 1)
+}
+
+func (digest *sharedDigest) isShared() bool {
+	return atomic.LoadInt32(&digest.shared) != 0
+}
+
+// Bucket returns the configs and tombstones assigned to the given bucket of the
+// digest.
+func (configs *TypeConfigs) Bucket(bucket int) *TypeConfigs {
+	result := &TypeConfigs{}
+
+	configs.Configs.Range(func(ID string, config *Config) bool {
+		if DigestBucket(ID) == bucket {
+			result.NewConfig(config)
+		}
+		return true
+	})
+
+	configs.Tombstones.Range(func(ID string, tombstone *Tombstone) bool {
+		if DigestBucket(ID) == bucket {
+			result.DeadConfig(tombstone)
+		}
+		return true
+	})
+
+	return result
+}
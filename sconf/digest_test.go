@@ -0,0 +1,143 @@
+// Copyright (c) 2014 Datacratic. All rights reserved.
+
+package sconf
+
+import (
+	"testing"
+)
+
+func TestConfigDigest(t *testing.T) {
+	test := NewTestRouterUtils(t)
+
+	a := &Configs{}
+	a.NewConfig(test.Config("c0", 1))
+	a.NewConfig(test.Config("c1", 1))
+	a.DeadConfig(test.Tomb("c2", 1))
+	a.NewConfig(test.ConfigT("other", "c3", 1))
+
+	// Same content applied in a different order and with extra history.
+	b := &Configs{}
+	b.NewConfig(test.ConfigT("other", "c3", 1))
+	b.NewConfig(test.Config("c2", 0))
+	b.DeadConfig(test.Tomb("c2", 1))
+	b.NewConfig(test.Config("c1", 0))
+	b.NewConfig(test.Config("c1", 1))
+	b.NewConfig(test.Config("c0", 1))
+
+	if da, db := a.Digest(), b.Digest(); da.Root != db.Root || len(da.Diff(db)) != 0 {
+		t.Errorf("FAIL(equal): digests differ %v != %v", da, db)
+	}
+
+	// The incremental digest must match the digest computed from scratch.
+	for typ, state := range b.Types {
+		if diff := state.Digest().Diff(state.computeDigest()); len(diff) != 0 {
+			t.Errorf("FAIL(incremental): digest of type %s is out of sync: %v", typ, diff)
+		}
+	}
+
+	c := b.Copy()
+	c.NewConfig(test.Config("c1", 2))
+
+	types := b.Digest().Diff(c.Digest())
+	if len(types) != 1 || types[0] != TestConfigType {
+		t.Fatalf("FAIL(diff): unexpected types %v", types)
+	}
+
+	buckets := b.Types[TestConfigType].Digest().Diff(c.Types[TestConfigType].Digest())
+	if len(buckets) != 1 || buckets[0] != DigestBucket("c1") {
+		t.Fatalf("FAIL(diff): unexpected buckets %v", buckets)
+	}
+
+	if bucket := c.Bucket(TestConfigType, buckets[0]); bucket.Len() == 0 {
+		t.Errorf("FAIL(bucket): empty bucket")
+	} else if result, _ := bucket.Get(TestConfigType, "c1"); result.Config == nil || result.Config.Version != 2 {
+		t.Errorf("FAIL(bucket): missing config: %v", result)
+	}
+
+	// Configs in conflict have the same version but different data.
+	d := b.Copy()
+	d.NewConfig((&TestConfig{Data: "conflict"}).Wrap("c1", 2))
+
+	if len(c.Digest().Diff(d.Digest())) != 1 {
+		t.Errorf("FAIL(conflict): digests of conflicting configs are equal")
+	}
+
+	// Copies must not share their digest.
+	if b.Types[TestConfigType].Digest().Diff(b.Types[TestConfigType].computeDigest()) != nil {
+		t.Errorf("FAIL(copy): digest was shared with copy")
+	}
+
+	// The digest is only copied once the source or the copy is modified.
+	e := b.Copy()
+	if e.Types[TestConfigType].digest != b.Types[TestConfigType].digest {
+		t.Errorf("FAIL(cow): digest was copied before being modified")
+	}
+
+	b.NewConfig(test.Config("c1", 3))
+	if e.Types[TestConfigType].Digest().Diff(e.Types[TestConfigType].computeDigest()) != nil {
+		t.Errorf("FAIL(cow): digest of copy was modified by the source")
+	}
+	if b.Types[TestConfigType].Digest().Diff(b.Types[TestConfigType].computeDigest()) != nil {
+		t.Errorf("FAIL(cow): digest of source is out of sync")
+	}
+}
+
+type TestDigestClient struct {
+	*Router
+	Buckets int
+}
+
+func (client *TestDigestClient) PullDigest() *ConfigDigest {
+	return client.PullConfigs().Digest()
+}
+
+func (client *TestDigestClient) PullTypeDigest(typ string) TypeDigest {
+	if state, ok := client.PullConfigs().Types[typ]; ok {
+		return state.Digest()
+	}
+	return nil
+}
+
+func (client *TestDigestClient) PullBucket(typ string, bucket int) *Configs {
+	client.Buckets++
+	return client.PullConfigs().Bucket(typ, bucket)
+}
+
+func TestPollerDigest(t *testing.T) {
+	test := NewTestRouterUtils(t)
+
+	local := test.NewRouter()
+	remote := &TestDigestClient{Router: test.NewRouter()}
+
+	for _, router := range []*Router{local, remote.Router} {
+		router.NewConfig(test.Config("c0", 1))
+		router.NewConfig(test.Config("c1", 1))
+	}
+	remote.NewConfig(test.Config("c2", 1))
+	local.NewConfig(test.Config("c3", 1))
+	test.WaitForPropagation()
+
+	poller := &Poller{Local: local, Remote: remote, Pull: true, Push: true}
+	poller.Init()
+	poller.poll()
+	test.WaitForPropagation()
+
+	exp := []*Config{
+		test.Config("c0", 1),
+		test.Config("c1", 1),
+		test.Config("c2", 1),
+		test.Config("c3", 1),
+	}
+	local.Expect(test, exp...)
+	remote.Expect(test, exp...)
+
+	buckets := map[int]bool{DigestBucket("c2"): true, DigestBucket("c3"): true}
+	if remote.Buckets != len(buckets) {
+		t.Errorf("FAIL(pull): unexpected bucket pulls %d != %d", remote.Buckets, len(buckets))
+	}
+
+	poller.poll()
+	if remote.Buckets != len(buckets) {
+		t.Errorf("FAIL(idle): unexpected bucket pulls %d != %d", remote.Buckets, len(buckets))
+	}
+}
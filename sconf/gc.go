@@ -0,0 +1,196 @@
+// Copyright (c) 2014 Datacratic. All rights reserved.
+
+package sconf
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+// TombstoneCollectable represents an object whose tombstones can be garbage
+// collected below a version horizon. Implemented by Router and by the
+// ConfigDB implementations.
+type TombstoneCollectable interface {
+	CollectTombstones(horizon uint64)
+}
+
+// DefaultTombstoneCollectRate is the default rate at which TombstoneCollector
+// collects tombstones.
+const DefaultTombstoneCollectRate = 1 * time.Minute
+
+// TombstoneCollector periodically computes a GC horizon and uses it to collect
+// the tombstones of a set of targets. A tombstone becomes collectable once it's
+// older then GracePeriod or once every known peer has acknowledged it,
+// whichever comes first. See the package notes in config.go for the safety
+// conditions of the horizon.
+//
+// Peers acknowledge tombstones via the Ack function by indicating the version
+// below which they've received all configs and tombstones. A peer that was
+// added but never acknowledged anything blocks the acknowledgement based
+// collection.
+type TombstoneCollector struct {
+	Component
+
+	// Targets is the list of objects whose tombstones are collected. Must be
+	// set before calling Init and can't be changed afterwards.
+	Targets []TombstoneCollectable
+
+	// GracePeriod indicates how long a tombstone must be kept around before it
+	// can be collected. Requires versions that can be derived from a time via
+	// the Version function. Defaults to 0 which disables the grace period
+	// collection.
+	GracePeriod time.Duration
+
+	// Version converts a time into a version and is used to compute the
+	// horizon of the grace period. Must be set along with GracePeriod since
+	// the unit of the versions depends on how they're generated: HLCVersion
+	// for versions stamped by a Versioner for example. A horizon computed in
+	// the wrong unit would reject every new config.
+	Version func(time.Time) uint64
+
+	// Rate indicates the frequency at which tombstones are collected. Defaults
+	// to DefaultTombstoneCollectRate.
+	Rate time.Duration
+
+	initialize sync.Once
+
+	lock    sync.Mutex
+	peers   map[string]uint64
+	horizon uint64
+
+	stopC chan int
+}
+
+// Init initializes the object.
+func (collector *TombstoneCollector) Init() {
+	collector.initialize.Do(collector.init)
+}
+
+func (collector *TombstoneCollector) init() {
+	if len(collector.Targets) == 0 {
+		log.Panic("Targets must be set in TombstoneCollector")
+	}
+
+	if collector.GracePeriod > 0 && collector.Version == nil {
+		log.Panic("Version must be set along with GracePeriod in TombstoneCollector")
+	}
+
+	if collector.Rate == 0 {
+		collector.Rate = DefaultTombstoneCollectRate
+	}
+
+	collector.peers = make(map[string]uint64)
+	collector.stopC = make(chan int)
+}
+
+// AddPeer adds a peer which must acknowledge tombstones before they can be
+// collected. Does nothing if the peer is already known.
+func (collector *TombstoneCollector) AddPeer(peer string) {
+	collector.Init()
+
+	collector.lock.Lock()
+	defer collector.lock.Unlock()
+
+	if _, ok := collector.peers[peer]; !ok {
+		collector.peers[peer] = 0
+	}
+}
+
+// RemovePeer removes a peer such that its acknowledgements are no longer
+// required.
+func (collector *TombstoneCollector) RemovePeer(peer string) {
+	collector.Init()
+
+	collector.lock.Lock()
+	defer collector.lock.Unlock()
+
+	delete(collector.peers, peer)
+}
+
+// Ack indicates that the given peer has received all the configs and
+// tombstones with a version lower then the given version. Adds the peer if it's
+// unknown. Acknowledgements can't go backwards.
+func (collector *TombstoneCollector) Ack(peer string, version uint64) {
+	collector.Init()
+
+	collector.lock.Lock()
+	defer collector.lock.Unlock()
+
+	if version > collector.peers[peer] {
+		collector.peers[peer] = version
+	}
+}
+
+// Horizon returns the current GC horizon which never decreases.
+func (collector *TombstoneCollector) Horizon() uint64 {
+	collector.Init()
+
+	collector.lock.Lock()
+	defer collector.lock.Unlock()
+
+	var horizon uint64
+
+	if collector.GracePeriod > 0 {
+		horizon = collector.Version(time.Now().Add(-collector.GracePeriod))
+	}
+
+	if len(collector.peers) > 0 {
+		acked := ^uint64(0)
+		for _, version := range collector.peers {
+			if version < acked {
+				acked = version
+			}
+		}
+
+		if acked > horizon {
+			horizon = acked
+		}
+	}
+
+	if horizon > collector.horizon {
+		collector.horizon = horizon
+	}
+
+	return collector.horizon
+}
+
+// Collect collects the tombstones of all the targets below the current horizon.
+func (collector *TombstoneCollector) Collect() {
+	horizon := collector.Horizon()
+	if horizon == 0 {
+		return
+	}
+
+	for _, target := range collector.Targets {
+		target.CollectTombstones(horizon)
+	}
+}
+
+// Start begins the periodic collection process in a background goroutine.
+func (collector *TombstoneCollector) Start() {
+	collector.Init()
+
+	go func() {
+		tickC := time.NewTicker(collector.Rate)
+		defer tickC.Stop()
+
+		for {
+			select {
+
+			case <-tickC.C:
+				collector.Collect()
+
+			case <-collector.stopC:
+				return
+
+			}
+		}
+	}()
+}
+
+// Stop ends the periodic collection process.
+func (collector *TombstoneCollector) Stop() {
+	collector.Init()
+	collector.stopC <- 1
+}
@@ -0,0 +1,170 @@
+// Copyright (c) 2014 Datacratic. All rights reserved.
+
+package sconf
+
+import (
+	"os"
+	"testing"
+	"time"
+)
+
+func TestConfigsGC(t *testing.T) {
+	test := NewTestRouterUtils(t)
+
+	configs := &Configs{}
+	configs.NewConfig(test.Config("c0", 5))
+	configs.DeadConfig(test.Tomb("c1", 5))
+	configs.DeadConfig(test.Tomb("c2", 10))
+
+	if collected := configs.GC(10); len(collected) != 1 || collected[0].ID != "c1" {
+		t.Errorf("FAIL(gc): unexpected collected tombstones: %v", collected)
+	}
+
+	if n := configs.Len(); n != 2 {
+		t.Errorf("FAIL(gc): unexpected length: %d", n)
+	}
+
+	// A stale peer can't resurrect a collected ID...
+	if _, isNew := configs.NewConfig(test.Config("c1", 4)); isNew {
+		t.Errorf("FAIL(stale): collected config was resurrected")
+	}
+
+	// ... but known IDs and newer versions are still accepted.
+	if _, isNew := configs.NewConfig(test.Config("c0", 6)); !isNew {
+		t.Errorf("FAIL(known): config below horizon was rejected")
+	}
+
+	if _, isNew := configs.NewConfig(test.Config("c1", 10)); !isNew {
+		t.Errorf("FAIL(new): config above horizon was rejected")
+	}
+
+	// The horizon never goes backwards and applies to new types.
+	configs.GC(2)
+	if _, isNew := configs.NewConfig(test.ConfigT("other", "c3", 9)); isNew {
+		t.Errorf("FAIL(type): config below horizon was accepted")
+	}
+
+	if copy := configs.Copy(); copy.Horizon != 10 || copy.Types[TestConfigType].Horizon != 10 {
+		t.Errorf("FAIL(copy): horizon wasn't copied")
+	}
+}
+
+func TestTombstoneCollector(t *testing.T) {
+	test := NewTestRouterUtils(t)
+
+	router := test.NewRouter()
+	router.NewConfig(test.Config("c0", 1))
+	router.DeadConfig(test.Tomb("c1", 2))
+	router.DeadConfig(test.Tomb("c2", 4))
+	test.WaitForPropagation()
+
+	collector := &TombstoneCollector{Targets: []TombstoneCollectable{router}}
+	collector.AddPeer("p0")
+	collector.AddPeer("p1")
+
+	collector.Ack("p0", 5)
+	if horizon := collector.Horizon(); horizon != 0 {
+		t.Errorf("FAIL(ack0): unexpected horizon: %d", horizon)
+	}
+
+	collector.Ack("p1", 3)
+	collector.Collect()
+	test.WaitForPropagation()
+
+	if n := router.PullConfigs().Len(); n != 2 {
+		t.Errorf("FAIL(ack1): unexpected length: %d", n)
+	}
+
+	collector.RemovePeer("p1")
+	collector.Collect()
+	test.WaitForPropagation()
+
+	if n := router.PullConfigs().Len(); n != 1 {
+		t.Errorf("FAIL(ack2): unexpected length: %d", n)
+	}
+
+	collector.Ack("p0", 1)
+	if horizon := collector.Horizon(); horizon != 5 {
+		t.Errorf("FAIL(ack3): horizon went backwards: %d", horizon)
+	}
+
+	grace := &TombstoneCollector{
+		Targets:     []TombstoneCollectable{router},
+		GracePeriod: time.Hour,
+		Version:     HLCVersion,
+	}
+
+	exp := HLCVersion(time.Now().Add(-time.Hour))
+	if horizon := grace.Horizon(); horizon < exp {
+		t.Errorf("FAIL(grace): unexpected horizon: %d < %d", horizon, exp)
+	}
+
+	// The unit of the versions must be explicit for the grace period.
+	defer func() {
+		if recover() == nil {
+			t.Errorf("FAIL(unit): expected panic")
+		}
+	}()
+	(&TombstoneCollector{Targets: []TombstoneCollectable{router}, GracePeriod: time.Hour}).Init()
+}
+
+func TestConfigPersistGC(t *testing.T) {
+	test := NewConfigPersistUtilsTest(t)
+
+	file := test.NewFile()
+	defer os.Remove(file)
+
+	dir := test.NewDir()
+	defer os.RemoveAll(dir)
+
+	sqlite := test.NewFile()
+	defer os.Remove(sqlite)
+
+	dbs := []struct {
+		Title string
+		New   func() ConfigDB
+	}{
+		{"aof", func() ConfigDB { return &AOFConfigDB{File: file} }},
+		{"dir", func() ConfigDB { return &DirConfigDB{Dir: dir} }},
+		{"sqlite", func() ConfigDB { return &SQLiteConfigDB{File: sqlite} }},
+	}
+
+	for _, db := range dbs {
+		db0 := db.New()
+		db0.NewConfig(test.Config("c0", 1, "d0"))
+		db0.DeadConfig(test.Tomb("c1", 2))
+		db0.DeadConfig(test.Tomb("c2", 4))
+		db0.(TombstoneCollectable).CollectTombstones(3)
+		db0.NewConfig(test.Config("c1", 1, "d1"))
+		db0.Close()
+
+		db1 := db.New()
+		test.DiffConfigs(db.Title, test.Load(db.Title, db1),
+			test.Config("c0", 1, "d0"))
+		test.DiffTombs(db.Title, test.Load(db.Title, db1),
+			test.Tomb("c2", 4))
+
+		db1.NewConfig(test.Config("c3", 2, "d3"))
+		db1.NewConfig(test.Config("c4", 3, "d4"))
+		db1.Close()
+
+		db2 := db.New()
+		test.DiffConfigs(db.Title, test.Load(db.Title, db2),
+			test.Config("c0", 1, "d0"),
+			test.Config("c4", 3, "d4"))
+		db2.Close()
+	}
+
+	aof := &AOFConfigDB{File: file}
+	if err := aof.Compact(); err != nil {
+		t.Fatalf("FAIL(compact): unable to compact: %s", err)
+	}
+	aof.Close()
+
+	aof = &AOFConfigDB{File: file}
+	aof.NewConfig(test.Config("c1", 2, "d1"))
+	test.DiffConfigs("compact", test.Load("compact", aof),
+		test.Config("c0", 1, "d0"),
+		test.Config("c4", 3, "d4"))
+	aof.Close()
+}
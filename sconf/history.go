@@ -0,0 +1,155 @@
+// Copyright (c) 2014 Datacratic. All rights reserved.
+
+package sconf
+
+// History contains the configs and tombstones successively held by a config ID
+// ordered from the oldest to the most recent. The length of the history is
+// bounded by the retention of the config's type. History is local to a
+// container: it only contains the entries that were new when they were added
+// and isn't exchanged between peers.
+type History []ConfigResult
+
+// Back returns the entry n steps back from the most recent entry where 0 is
+// the most recent entry and a bool indicating whether the entry exists.
+func (history History) Back(n int) (ConfigResult, bool) {
+	if n < 0 || n >= len(history) {
+		return ConfigResult{}, false
+	}
+	return history[len(history)-1-n], true
+}
+
+// At returns the most recent entry whose version is lower or equal to the
+// given version and a bool indicating whether such an entry exists. Configs
+// that are versioned using a clock can be queried as of a given time by
+// converting the time to a version using, for example, HLCVersion.
+func (history History) At(version uint64) (ConfigResult, bool) {
+	for i := len(history) - 1; i >= 0; i-- {
+		if history[i].version() <= version {
+			return history[i], true
+		}
+	}
+	return ConfigResult{}, false
+}
+
+// rollbackTarget returns the live config to roll back to from the given
+// current state. A version of 0 selects the most recent live config that
+// precedes the current state.
+func (history History) rollbackTarget(current ConfigResult, version uint64) (*Config, bool) {
+	for i := len(history) - 1; i >= 0; i-- {
+		config := history[i].Config
+		if config == nil {
+			continue
+		}
+
+		if version == 0 && config != current.Config {
+			return config, true
+		}
+
+		if version != 0 && config.Version == version {
+			return config, true
+		}
+	}
+
+	return nil, false
+}
+
+func (result ConfigResult) version() uint64 {
+	if result.Config != nil {
+		return result.Config.Version
+	}
+	if result.Tombstone != nil {
+		return result.Tombstone.Version
+	}
+	return 0
+}
+
+// History returns the history of the given type and ID which is empty unless a
+// retention was set for the type. The returned history should not be
+// modified.
+func (configs *Configs) History(typ, ID string) History {
+	if state, ok := configs.Types[typ]; ok {
+		return state.History(ID)
+	}
+	return nil
+}
+
+// History returns the history of the given ID which is empty unless a
+// retention was set. The returned history should not be modified.
+func (configs *TypeConfigs) History(ID string) History {
+	if history, ok := configs.history.get(ID); ok {
+		return history.(History)
+	}
+	return nil
+}
+
+// rangeHistory invokes fn on the history of every ID until fn returns false.
+func (configs *TypeConfigs) rangeHistory(fn func(ID string, history History) bool) {
+	configs.history.each(func(ID string, history interface{}) bool {
+		return fn(ID, history.(History))
+	})
+}
+
+// SetRetention sets the number of history entries to keep for each type where
+// the entry for the empty type name applies to all the types not in the map.
+// Existing histories are truncated if required.
+func (configs *Configs) SetRetention(retention map[string]int) {
+	configs.Retention = retention
+
+	for typ, state := range configs.Types {
+		state.setRetention(configs.retention(typ))
+	}
+}
+
+// historyLen returns the number of history entries for all types.
+func (configs *Configs) historyLen() (size int) {
+	for _, state := range configs.Types {
+		state.rangeHistory(func(ID string, history History) bool {
+			size += len(history)
+			return true
+		})
+	}
+	return
+}
+
+func (configs *Configs) retention(typ string) int {
+	return typeRetention(configs.Retention, typ)
+}
+
+// typeRetention returns the retention of the given type from a retention map as
+// described by Configs.SetRetention.
+func typeRetention(retention map[string]int, typ string) int {
+	if n, ok := retention[typ]; ok {
+		return n
+	}
+	return retention[""]
+}
+
+func (configs *TypeConfigs) setRetention(retention int) {
+	configs.Retention = retention
+
+	if retention <= 0 {
+		configs.history = pmap{}
+		return
+	}
+
+	configs.rangeHistory(func(ID string, history History) bool {
+		if len(history) > retention {
+			configs.history = configs.history.set(ID, history[len(history)-retention:])
+		}
+		return true
+	})
+}
+
+// record adds an entry to the history of the given ID.
+func (configs *TypeConfigs) record(ID string, entry ConfigResult) {
+	if configs.Retention <= 0 {
+		return
+	}
+
+	history := configs.History(ID)
+	if len(history) >= configs.Retention {
+		history = history[len(history)-configs.Retention+1:]
+	}
+
+	configs.history = configs.history.set(ID, appendHistory(history, entry))
+}
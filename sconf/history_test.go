@@ -0,0 +1,257 @@
+// Copyright (c) 2014 Datacratic. All rights reserved.
+
+package sconf
+
+import (
+	"os"
+	"testing"
+)
+
+func (t TestConfigUtils) ExpectHistory(title string, history History, exp ...uint64) {
+	if len(history) != len(exp) {
+		t.Errorf("FAIL(%s): unexpected history length %d != %d", title, len(history), len(exp))
+		return
+	}
+
+	for i, entry := range history {
+		if entry.version() != exp[i] {
+			t.Errorf("FAIL(%s): unexpected version at %d: %d != %d", title, i, entry.version(), exp[i])
+		}
+	}
+}
+
+func TestConfigsHistory(test *testing.T) {
+	t := NewTestConfigsUtils(test)
+
+	c := &Configs{}
+	c.SetRetention(map[string]int{TestConfigType: 3})
+
+	c.NewConfig(t.Config("c0", 1))
+	c.NewConfig(t.Config("c0", 2))
+	c.NewConfig(t.Config("c0", 0))
+	c.DeadConfig(t.Tomb("c0", 4))
+	c.NewConfig(t.ConfigT("other", "c0", 1))
+	t.ExpectHistory("add", c.History(TestConfigType, "c0"), 1, 2, 4)
+	t.ExpectHistory("type", c.History("other", "c0"))
+
+	c.NewConfig(t.Config("c0", 5))
+	t.ExpectHistory("trim", c.History(TestConfigType, "c0"), 2, 4, 5)
+
+	history := c.History(TestConfigType, "c0")
+	if entry, ok := history.Back(1); !ok || entry.Tombstone == nil || entry.Tombstone.Version != 4 {
+		t.Errorf("FAIL(back): unexpected entry %v", entry)
+	}
+	if _, ok := history.Back(3); ok {
+		t.Errorf("FAIL(back): unexpected entry past the history")
+	}
+	if entry, ok := history.At(3); !ok || entry.Config == nil || entry.Config.Version != 2 {
+		t.Errorf("FAIL(at): unexpected entry %v", entry)
+	}
+	if _, ok := history.At(1); ok {
+		t.Errorf("FAIL(at): unexpected entry before the history")
+	}
+
+	// Copies must not share their history.
+	other := c.Copy()
+	other.NewConfig(t.Config("c0", 6))
+	t.ExpectHistory("copy", c.History(TestConfigType, "c0"), 2, 4, 5)
+	t.ExpectHistory("copy", other.History(TestConfigType, "c0"), 4, 5, 6)
+
+	c.SetRetention(map[string]int{"": 1})
+	t.ExpectHistory("retention", c.History(TestConfigType, "c0"), 5)
+	c.NewConfig(t.ConfigT("other", "c0", 2))
+	t.ExpectHistory("default", c.History("other", "c0"), 2)
+}
+
+func TestRouterHistory(t *testing.T) {
+	test := NewTestRouterUtils(t)
+
+	router := &Router{HistoryRetention: map[string]int{TestConfigType: 2}}
+	router.NewConfig(test.Config("c0", 1))
+	router.NewConfig(test.Config("c0", 2))
+	router.NewConfig(test.Config("c0", 3))
+	test.WaitForPropagation()
+
+	test.ExpectHistory("router", router.History(TestConfigType, "c0"), 2, 3)
+}
+
+func TestConfigPersistHistory(t *testing.T) {
+	test := NewConfigPersistUtilsTest(t)
+
+	file := test.NewFile()
+	defer os.Remove(file)
+
+	dir := test.NewDir()
+	defer os.RemoveAll(dir)
+
+	sqlite := test.NewFile()
+	defer os.Remove(sqlite)
+
+	retention := map[string]int{TestConfigType: 3}
+
+	dbs := []struct {
+		Title string
+		New   func() ConfigDB
+	}{
+		{"aof", func() ConfigDB { return &AOFConfigDB{File: file, HistoryRetention: retention} }},
+		{"dir", func() ConfigDB { return &DirConfigDB{Dir: dir, HistoryRetention: retention} }},
+		{"sqlite", func() ConfigDB { return &SQLiteConfigDB{File: sqlite, HistoryRetention: retention} }},
+	}
+
+	for _, db := range dbs {
+		db0 := db.New()
+		db0.NewConfig(test.Config("c0", 1, "d0"))
+		db0.NewConfig(test.Config("c0", 2, "d1"))
+		db0.DeadConfig(test.Tomb("c0", 3))
+		db0.NewConfig(test.Config("c0", 4, "d2"))
+		db0.NewConfig(test.Config("c1", 1, "d3"))
+		db0.Close()
+
+		db1 := db.New()
+		configs, err := db1.Load()
+		if err != nil {
+			t.Errorf("FAIL(%s): unable to load db: %s", db.Title, err)
+			continue
+		}
+
+		test.ExpectHistory(db.Title, configs.History(TestConfigType, "c0"), 2, 3, 4)
+		test.ExpectHistory(db.Title, configs.History(TestConfigType, "c1"), 1)
+
+		if aof, ok := db1.(*AOFConfigDB); ok {
+			if err := aof.Compact(); err != nil {
+				t.Fatalf("FAIL(%s): unable to compact: %s", db.Title, err)
+			}
+		}
+
+		db1.NewConfig(test.Config("c0", 5, "d4"))
+		db1.Close()
+
+		db2 := db.New()
+		if configs, err = db2.Load(); err != nil {
+			t.Errorf("FAIL(%s): unable to load db: %s", db.Title, err)
+			continue
+		}
+
+		test.ExpectHistory(db.Title, configs.History(TestConfigType, "c0"), 3, 4, 5)
+
+		// The history of collected tombstones is dropped.
+		db2.DeadConfig(test.Tomb("c1", 2))
+		db2.(TombstoneCollectable).CollectTombstones(3)
+		db2.Close()
+
+		db3 := db.New()
+		if configs, err = db3.Load(); err != nil {
+			t.Errorf("FAIL(%s): unable to load db: %s", db.Title, err)
+			continue
+		}
+
+		test.ExpectHistory(db.Title+"-gc", configs.History(TestConfigType, "c1"))
+		db3.Close()
+	}
+
+	if _, err := os.Stat((&DirConfigDB{Dir: dir}).historyPath(TestConfigType, "c1")); !os.IsNotExist(err) {
+		t.Errorf("FAIL(dir): history file of collected tombstone wasn't removed: %v", err)
+	}
+
+	sqliteDB := &SQLiteConfigDB{File: sqlite, HistoryRetention: retention}
+	defer sqliteDB.Close()
+
+	if history, err := sqliteDB.History(TestConfigType, "c0"); err != nil {
+		t.Errorf("FAIL(sqlite): unable to read history: %s", err)
+	} else {
+		test.ExpectHistory("sqlite", history, 3, 4, 5)
+	}
+
+	if history, err := sqliteDB.History(TestConfigType, "c1"); err != nil || len(history) != 0 {
+		t.Errorf("FAIL(sqlite): history of collected tombstone wasn't removed: %v %v", history, err)
+	}
+}
+
+func TestRouterRollback(t *testing.T) {
+	test := NewTestRouterUtils(t)
+
+	router := &Router{HistoryRetention: map[string]int{TestConfigType: 4}, WriterID: "w2"}
+
+	data := func(ID string) string {
+		result, _ := router.PullConfigs().Get(TestConfigType, ID)
+		if result.Config == nil {
+			return ""
+		}
+		return result.Config.Data.(*TestConfig).Data
+	}
+
+	labeled := (&TestConfig{Data: "d0"}).Wrap("c0", 1)
+	labeled.Labels = map[string]string{"env": "prod"}
+
+	router.NewConfig(labeled)
+	router.NewConfig((&TestConfig{Data: "d1"}).Wrap("c0", 2))
+	router.NewConfig((&TestConfig{Data: "d2"}).Wrap("c0", 3))
+	test.WaitForPropagation()
+
+	if config, err := router.Rollback(TestConfigType, "c0", 1); err != nil {
+		t.Errorf("FAIL(version): unexpected error: %s", err)
+	} else if config.Version != 4 {
+		t.Errorf("FAIL(version): unexpected version %d != 4", config.Version)
+	} else if config.Labels["env"] != "prod" {
+		t.Errorf("FAIL(version): labels weren't rolled back: %v", config.Labels)
+	}
+	test.WaitForPropagation()
+
+	if d := data("c0"); d != "d0" {
+		t.Errorf("FAIL(version): unexpected data '%s' != 'd0'", d)
+	}
+
+	if _, err := router.Rollback(TestConfigType, "c0", 0); err != nil {
+		t.Errorf("FAIL(previous): unexpected error: %s", err)
+	}
+	test.WaitForPropagation()
+
+	if d := data("c0"); d != "d2" {
+		t.Errorf("FAIL(previous): unexpected data '%s' != 'd2'", d)
+	}
+
+	router.DeadConfig(test.Tomb("c0", 10))
+	test.WaitForPropagation()
+
+	if config, err := router.Rollback(TestConfigType, "c0", 0); err != nil {
+		t.Errorf("FAIL(resurrect): unexpected error: %s", err)
+	} else if config.Version != 11 {
+		t.Errorf("FAIL(resurrect): unexpected version %d != 11", config.Version)
+	}
+	test.WaitForPropagation()
+
+	if d := data("c0"); d != "d2" {
+		t.Errorf("FAIL(resurrect): unexpected data '%s' != 'd2'", d)
+	}
+
+	if _, err := router.Rollback(TestConfigType, "c0", 1); err == nil {
+		t.Errorf("FAIL(retention): expected error for trimmed version")
+	}
+
+	if _, err := router.Rollback(TestConfigType, "c1", 0); err == nil {
+		t.Errorf("FAIL(unknown): expected error for unknown ID")
+	}
+
+	// The vector of the new config descends from the current vector.
+	v1 := VersionVector{}.Update("w0")
+	v2 := v1.Update("w1")
+	router.NewConfigSync(&Config{Type: TestConfigType, ID: "c2", Version: v1.Version(), Vector: v1, Data: &TestConfig{Data: "v1"}})
+	router.NewConfigSync(&Config{Type: TestConfigType, ID: "c2", Version: v2.Version(), Vector: v2, Data: &TestConfig{Data: "v2"}})
+
+	if config, err := router.Rollback(TestConfigType, "c2", 0); err != nil {
+		t.Errorf("FAIL(vector): unexpected error: %s", err)
+	} else if config.Vector.Compare(v2) != VectorAfter || config.Vector["w2"] != 1 {
+		t.Errorf("FAIL(vector): vector %v doesn't descend from %v", config.Vector, v2)
+	} else if d := data("c2"); d != "v1" {
+		t.Errorf("FAIL(vector): unexpected data '%s' != 'v1'", d)
+	}
+
+	// Rollbacks of vectors require a unique writer ID.
+	anonymous := &Router{HistoryRetention: map[string]int{TestConfigType: 4}}
+	anonymous.NewConfigSync(&Config{Type: TestConfigType, ID: "c2", Version: v1.Version(), Vector: v1, Data: &TestConfig{Data: "v1"}})
+	anonymous.NewConfigSync(&Config{Type: TestConfigType, ID: "c2", Version: v2.Version(), Vector: v2, Data: &TestConfig{Data: "v2"}})
+
+	if _, err := anonymous.Rollback(TestConfigType, "c2", 0); err == nil {
+		t.Errorf("FAIL(writer): expected error without a writer ID")
+	}
+}
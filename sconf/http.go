@@ -7,10 +7,12 @@ import (
 	"github.com/datacratic/gometer/meter"
 	"github.com/datacratic/gorest/rest"
 
+	"encoding/json"
 	"fmt"
 	"log"
 	"net/http"
 	"net/url"
+	"strconv"
 	"sync"
 	"time"
 )
@@ -38,15 +40,35 @@ type HTTPEndpoint struct {
 	// Router will be used to process config events received by this endpoint.
 	Router *Router
 
+	// Registry is used to decode the configs received by this endpoint.
+	// Defaults to the registry of the Router or to DefaultTypeRegistry if the
+	// Router doesn't have one.
+	Registry *TypeRegistry
+
+	// WaitForApply indicates that the endpoint should wait until the events it
+	// receives are processed by the Router before responding such that the
+	// effects of a write are visible to the requests that follow it. Errors
+	// returned by the Router's Configurable objects are counted as errors in
+	// the endpoint's metrics.
+	WaitForApply bool
+
 	initialize sync.Once
 
 	metrics struct {
 		GetConfig   httpMetrics
+		GetHistory  httpMetrics
+		Rollback    httpMetrics
 		ListConfigs httpMetrics
 		PullConfigs httpMetrics
+		PullMissing httpMetrics
+		PullSelect  httpMetrics
+		ListSelect  httpMetrics
 		PushConfigs httpMetrics
 		NewConfig   httpMetrics
 		DeadConfig  httpMetrics
+		PullDigest  httpMetrics
+		PullTypes   httpMetrics
+		PullBucket  httpMetrics
 	}
 }
 
@@ -59,12 +81,21 @@ func (endpoint *HTTPEndpoint) RESTRoutes() rest.Routes {
 
 	return rest.Routes{
 		rest.NewRoute(path, "GET", endpoint.PullConfigs),
-		rest.NewRoute(path, "PUT", endpoint.PushConfigs),
-		rest.NewRoute(path, "POST", endpoint.NewConfig),
+		rest.NewRoute(path, "PUT", endpoint.pushConfigsJSON),
+		rest.NewRoute(path, "POST", endpoint.newConfigJSON),
 		rest.NewRoute(path, "DELETE", endpoint.DeadConfig),
 
 		rest.NewRoute(path+"/list", "GET", endpoint.ListConfigs),
+		rest.NewRoute(path+"/missing", "POST", endpoint.PullMissing),
+		rest.NewRoute(path+"/select/:selector", "GET", endpoint.PullSelected),
+		rest.NewRoute(path+"/select/:selector/list", "GET", endpoint.ListSelected),
 		rest.NewRoute(path+"/:type/:id", "GET", endpoint.GetConfig),
+		rest.NewRoute(path+"/:type/:id/history", "GET", endpoint.GetHistory),
+		rest.NewRoute(path+"/:type/:id/rollback/:version", "POST", endpoint.Rollback),
+
+		rest.NewRoute(path+"/digest", "GET", endpoint.PullDigest),
+		rest.NewRoute(path+"/digest/:type/buckets", "GET", endpoint.PullTypeDigest),
+		rest.NewRoute(path+"/digest/:type/buckets/:bucket", "GET", endpoint.PullBucket),
 	}
 }
 
@@ -101,6 +132,51 @@ func (endpoint *HTTPEndpoint) GetConfig(typ, ID string) (result ConfigResult, er
 	return
 }
 
+// GetHistory returns the history of the config associated with the given ID and
+// type managed by this endpoint. The history is empty unless the endpoint's
+// Router retains history for the type.
+func (endpoint *HTTPEndpoint) GetHistory(typ, ID string) History {
+	endpoint.Init()
+
+	t0 := time.Now()
+	endpoint.metrics.GetHistory.Requests.Hit()
+
+	history := endpoint.Router.History(typ, ID)
+	if history == nil {
+		history = History{}
+	}
+
+	endpoint.metrics.GetHistory.Latency.RecordSince(t0)
+	return history
+}
+
+// Rollback rolls back the config associated with the given ID and type managed
+// by this endpoint to the given version and returns the new config. See
+// Router.Rollback for more details. Returns a 400 REST error if the version is
+// invalid and a 404 REST error if the rollback wasn't applied because the
+// version isn't in the history for example.
+func (endpoint *HTTPEndpoint) Rollback(typ, ID, version string) (config *Config, err error) {
+	endpoint.Init()
+
+	t0 := time.Now()
+	endpoint.metrics.Rollback.Requests.Hit()
+
+	ver, err := strconv.ParseUint(version, 10, 64)
+	if err != nil {
+		err = &rest.CodedError{Code: http.StatusBadRequest, Sub: err}
+
+	} else if config, err = endpoint.Router.Rollback(typ, ID, ver); err != nil && config == nil {
+		err = &rest.CodedError{Code: http.StatusNotFound, Sub: err}
+	}
+
+	if err != nil {
+		endpoint.metrics.Rollback.Errors.Hit()
+	}
+
+	endpoint.metrics.Rollback.Latency.RecordSince(t0)
+	return
+}
+
 // ListConfigs returns a mappiong of config IDs to config version managed by
 // this endpoint.
 func (endpoint *HTTPEndpoint) ListConfigs() ConfigList {
@@ -128,6 +204,94 @@ func (endpoint *HTTPEndpoint) PullConfigs() *Configs {
 	return configs
 }
 
+// PullMissing returns the configs and tombstones managed by this endpoint that
+// are missing from a container with the given ID to version mapping.
+func (endpoint *HTTPEndpoint) PullMissing(list ConfigList) *Configs {
+	endpoint.Init()
+
+	t0 := time.Now()
+	endpoint.metrics.PullMissing.Requests.Hit()
+
+	configs := endpoint.Router.PullConfigs().Missing(list)
+
+	endpoint.metrics.PullMissing.Latency.RecordSince(t0)
+	return configs
+}
+
+// PullSelected returns the live configs managed by this endpoint whose labels
+// match the given selector. The selector uses the syntax of ParseSelector and
+// is passed as a URL-escaped path segment. Returns a 400 REST error if the
+// selector is invalid.
+func (endpoint *HTTPEndpoint) PullSelected(selector string) (configs *Configs, err error) {
+	endpoint.Init()
+
+	t0 := time.Now()
+	endpoint.metrics.PullSelect.Requests.Hit()
+
+	sel, err := ParseSelector(selector)
+	if err != nil {
+		endpoint.metrics.PullSelect.Errors.Hit()
+		err = &rest.CodedError{Code: http.StatusBadRequest, Sub: err}
+	} else {
+		configs = endpoint.Router.PullConfigs().Select(sel)
+	}
+
+	endpoint.metrics.PullSelect.Latency.RecordSince(t0)
+	return
+}
+
+// ListSelected returns a mapping of config IDs to config version for the live
+// configs managed by this endpoint whose labels match the given selector. See
+// PullSelected for the format of the selector.
+func (endpoint *HTTPEndpoint) ListSelected(selector string) (list ConfigList, err error) {
+	endpoint.Init()
+
+	t0 := time.Now()
+	endpoint.metrics.ListSelect.Requests.Hit()
+
+	sel, err := ParseSelector(selector)
+	if err != nil {
+		endpoint.metrics.ListSelect.Errors.Hit()
+		err = &rest.CodedError{Code: http.StatusBadRequest, Sub: err}
+	} else {
+		list = endpoint.Router.PullConfigs().Select(sel).List()
+	}
+
+	endpoint.metrics.ListSelect.Latency.RecordSince(t0)
+	return
+}
+
+func (endpoint *HTTPEndpoint) registry() *TypeRegistry {
+	if endpoint.Registry != nil {
+		return endpoint.Registry
+	}
+	return endpoint.Router.Registry
+}
+
+// pushConfigsJSON decodes the configs using the registry of the endpoint before
+// calling PushConfigs. Returns a 400 REST error if the configs can't be decoded.
+func (endpoint *HTTPEndpoint) pushConfigsJSON(body json.RawMessage) error {
+	configs := &Configs{}
+	if err := endpoint.registry().Unmarshal(body, configs); err != nil {
+		return &rest.CodedError{Code: http.StatusBadRequest, Sub: err}
+	}
+
+	endpoint.PushConfigs(configs)
+	return nil
+}
+
+// newConfigJSON decodes the config using the registry of the endpoint before
+// calling NewConfig. Returns a 400 REST error if the config can't be decoded.
+func (endpoint *HTTPEndpoint) newConfigJSON(body json.RawMessage) error {
+	config := &Config{}
+	if err := endpoint.registry().Unmarshal(body, config); err != nil {
+		return &rest.CodedError{Code: http.StatusBadRequest, Sub: err}
+	}
+
+	endpoint.NewConfig(config)
+	return nil
+}
+
 // PushConfigs merges the given configs with the configs managed by the endpoint.
 func (endpoint *HTTPEndpoint) PushConfigs(configs *Configs) {
 	endpoint.Init()
@@ -135,7 +299,11 @@ func (endpoint *HTTPEndpoint) PushConfigs(configs *Configs) {
 	t0 := time.Now()
 	endpoint.metrics.PushConfigs.Requests.Hit()
 
-	endpoint.Router.PushConfigs(configs)
+	if !endpoint.WaitForApply {
+		endpoint.Router.PushConfigs(configs)
+	} else if result := endpoint.Router.PushConfigsSync(configs); result.Err != nil {
+		endpoint.metrics.PushConfigs.Errors.Hit()
+	}
 
 	endpoint.metrics.PushConfigs.Latency.RecordSince(t0)
 }
@@ -147,7 +315,11 @@ func (endpoint *HTTPEndpoint) NewConfig(config *Config) {
 	t0 := time.Now()
 	endpoint.metrics.NewConfig.Requests.Hit()
 
-	endpoint.Router.NewConfig(config)
+	if !endpoint.WaitForApply {
+		endpoint.Router.NewConfig(config)
+	} else if result := endpoint.Router.NewConfigSync(config); result.Err != nil {
+		endpoint.metrics.NewConfig.Errors.Hit()
+	}
 
 	endpoint.metrics.NewConfig.Latency.RecordSince(t0)
 }
@@ -159,11 +331,72 @@ func (endpoint *HTTPEndpoint) DeadConfig(tombstone *Tombstone) {
 	t0 := time.Now()
 	endpoint.metrics.DeadConfig.Requests.Hit()
 
-	endpoint.Router.DeadConfig(tombstone)
+	if !endpoint.WaitForApply {
+		endpoint.Router.DeadConfig(tombstone)
+	} else if result := endpoint.Router.DeadConfigSync(tombstone); result.Err != nil {
+		endpoint.metrics.DeadConfig.Errors.Hit()
+	}
 
 	endpoint.metrics.DeadConfig.Latency.RecordSince(t0)
 }
 
+// PullDigest returns the digest of the configs managed by this endpoint.
+func (endpoint *HTTPEndpoint) PullDigest() *ConfigDigest {
+	endpoint.Init()
+
+	t0 := time.Now()
+	endpoint.metrics.PullDigest.Requests.Hit()
+
+	digest := endpoint.Router.PullConfigs().Digest()
+
+	endpoint.metrics.PullDigest.Latency.RecordSince(t0)
+	return digest
+}
+
+// PullTypeDigest returns the digest of the given type managed by this
+// endpoint.
+func (endpoint *HTTPEndpoint) PullTypeDigest(typ string) TypeDigest {
+	endpoint.Init()
+
+	t0 := time.Now()
+	endpoint.metrics.PullTypes.Requests.Hit()
+
+	var digest TypeDigest
+	if state, ok := endpoint.Router.PullConfigs().Types[typ]; ok {
+		digest = state.Digest()
+	} else {
+		digest = make(TypeDigest, DigestBuckets)
+	}
+
+	endpoint.metrics.PullTypes.Latency.RecordSince(t0)
+	return digest
+}
+
+// PullBucket returns the configs and tombstones of the given type which are
+// assigned to the given digest bucket. Returns a 400 REST error if the bucket
+// is invalid.
+func (endpoint *HTTPEndpoint) PullBucket(typ, bucket string) (configs *Configs, err error) {
+	endpoint.Init()
+
+	t0 := time.Now()
+	endpoint.metrics.PullBucket.Requests.Hit()
+
+	i, err := strconv.Atoi(bucket)
+	if err == nil && (i < 0 || i >= DigestBuckets) {
+		err = fmt.Errorf("bucket '%s' is out of range", bucket)
+	}
+
+	if err != nil {
+		endpoint.metrics.PullBucket.Errors.Hit()
+		err = &rest.CodedError{Code: http.StatusBadRequest, Sub: err}
+	} else {
+		configs = endpoint.Router.PullConfigs().Bucket(typ, i)
+	}
+
+	endpoint.metrics.PullBucket.Latency.RecordSince(t0)
+	return
+}
+
 // HTTPClientMetrics contains the result of an HTTP config event sent by an
 // HTTPClient.
 type HTTPClientMetrics struct {
@@ -184,6 +417,16 @@ type HTTPClientMetrics struct {
 	// configs and tombstones.
 	PullConfigs bool
 
+	// PullSelected indicates that a request was made to retrieve the configs
+	// matching a label selector.
+	PullSelected bool
+
+	// PullDigest indicates that a request was made to retrieve a digest.
+	PullDigest bool
+
+	// Rollback indicates that a rollback was requested.
+	Rollback bool
+
 	// Error indicates the outcome of the request.
 	Error rest.ErrorType
 
@@ -201,6 +444,10 @@ type HTTPClient struct {
 	// communication.
 	HTTPClient *http.Client
 
+	// Registry is used to decode the configs received from the config
+	// endpoint. Defaults to DefaultTypeRegistry.
+	Registry *TypeRegistry
+
 	initialize sync.Once
 
 	RESTClient *rest.Client
@@ -246,43 +493,152 @@ func (client *HTTPClient) init() {
 
 // NewConfig sends a new config to the config endpoint.
 func (client *HTTPClient) NewConfig(config *Config) {
-	client.sendRequest("POST", config, nil, &HTTPClientMetrics{NewConfig: true})
+	client.sendRequest("POST", "", config, nil, &HTTPClientMetrics{NewConfig: true})
 }
 
 // DeadConfig sends a config tombstone to the config endpoint.
 func (client *HTTPClient) DeadConfig(tombstone *Tombstone) {
-	client.sendRequest("DELETE", tombstone, nil, &HTTPClientMetrics{DeadConfig: true})
+	client.sendRequest("DELETE", "", tombstone, nil, &HTTPClientMetrics{DeadConfig: true})
 }
 
 // PushConfigs sends the given set of configs and tombstones to the config
 // endpoint.
 func (client *HTTPClient) PushConfigs(configs *Configs) {
-	client.sendRequest("PUT", configs, nil, &HTTPClientMetrics{PushConfigs: true})
+	client.sendRequest("PUT", "", configs, nil, &HTTPClientMetrics{PushConfigs: true})
 }
 
 // PullConfigs retrieves the set of configs and tombstones from the config
 // endpoint.
 func (client *HTTPClient) PullConfigs() *Configs {
 	configs := &Configs{}
-	client.sendRequest("GET", nil, configs, &HTTPClientMetrics{PullConfigs: true})
+	client.sendRequest("GET", "", nil, configs, &HTTPClientMetrics{PullConfigs: true})
 	return configs
 }
 
-func (client *HTTPClient) sendRequest(method string, input, output interface{}, metrics *HTTPClientMetrics) {
+// PullMissing retrieves the configs and tombstones from the config endpoint that
+// are missing from a container with the given ID to version mapping. Returns nil
+// if the request failed which is the case for endpoints that predate the
+// protocol. Failures aren't reported as errors.
+func (client *HTTPClient) PullMissing(list ConfigList) *Configs {
+	configs := &Configs{}
+	if !client.probeRequest("POST", "/missing", list, configs, &HTTPClientMetrics{PullConfigs: true}) {
+		return nil
+	}
+	return configs
+}
+
+// PullDigest retrieves the digest of the configs from the config endpoint.
+// Returns nil if the request failed which is the case for endpoints that predate
+// the protocol. Failures aren't reported as errors.
+func (client *HTTPClient) PullDigest() *ConfigDigest {
+	digest := &ConfigDigest{}
+	if !client.probeRequest("GET", "/digest", nil, digest, &HTTPClientMetrics{PullDigest: true}) {
+		return nil
+	}
+	return digest
+}
+
+// PullTypeDigest retrieves the digest of the given type from the config
+// endpoint. Returns nil if the request failed.
+func (client *HTTPClient) PullTypeDigest(typ string) TypeDigest {
+	var digest TypeDigest
+	path := "/digest/" + url.QueryEscape(typ) + "/buckets"
+	if !client.sendRequest("GET", path, nil, &digest, &HTTPClientMetrics{PullDigest: true}) {
+		return nil
+	}
+	return digest
+}
+
+// PullBucket retrieves the configs and tombstones of the given type assigned to
+// the given digest bucket from the config endpoint. Returns nil if the request
+// failed.
+func (client *HTTPClient) PullBucket(typ string, bucket int) *Configs {
+	configs := &Configs{}
+	path := fmt.Sprintf("/digest/%s/buckets/%d", url.QueryEscape(typ), bucket)
+	if !client.sendRequest("GET", path, nil, configs, &HTTPClientMetrics{PullConfigs: true}) {
+		return nil
+	}
+	return configs
+}
+
+// PullSelected retrieves the live configs whose labels match the given
+// selector from the config endpoint. The selector must not be empty. Returns nil
+// if the request failed.
+func (client *HTTPClient) PullSelected(selector Selector) *Configs {
+	configs := &Configs{}
+	path := "/select/" + url.QueryEscape(selector.String())
+	if !client.sendRequest("GET", path, nil, configs, &HTTPClientMetrics{PullSelected: true}) {
+		return nil
+	}
+	return configs
+}
+
+// Rollback requests the rollback of the config of the given type and ID to the
+// given version and returns the version of the new config. See Router.Rollback
+// for more details. The data of the new config isn't decoded such that the
+// type doesn't need to be registered. Returns false if the request failed.
+func (client *HTTPClient) Rollback(typ, ID string, version uint64) (uint64, bool) {
+	var result struct {
+		Version uint64 `json:"ver"`
+	}
+
+	path := fmt.Sprintf("/%s/%s/rollback/%d", url.QueryEscape(typ), url.QueryEscape(ID), version)
+	if !client.sendRequest("POST", path, nil, &result, &HTTPClientMetrics{Rollback: true}) {
+		return 0, false
+	}
+
+	return result.Version, true
+}
+
+func (client *HTTPClient) sendRequest(method, path string, input, output interface{}, metrics *HTTPClientMetrics) bool {
+	err := client.send(method, path, input, output, metrics)
+	if err != nil {
+		client.Error(err)
+	}
+	return err == nil
+}
+
+// probeRequest behaves like sendRequest except that failures aren't reported
+// as errors since the routes of the digest and delta protocols don't exist on
+// endpoints that predate them. Failures are still recorded in the metrics.
+func (client *HTTPClient) probeRequest(method, path string, input, output interface{}, metrics *HTTPClientMetrics) bool {
+	return client.send(method, path, input, output, metrics) == nil
+}
+
+func (client *HTTPClient) send(method, path string, input, output interface{}, metrics *HTTPClientMetrics) *rest.Error {
 	client.Init()
 
 	t0 := time.Now()
 	metrics.Request = true
 
-	resp := client.RESTClient.NewRequest(method).SetBody(input).Send()
+	req := client.RESTClient.NewRequest(method)
+	if len(path) > 0 {
+		req.SetPath(path)
+	}
+
+	resp := req.SetBody(input).Send()
+
+	var err *rest.Error
+	if client.Registry == nil || output == nil {
+		err = resp.GetBody(output)
+
+	} else {
+		var body json.RawMessage
+		if err = resp.GetBody(&body); err == nil {
+			if sub := client.Registry.Unmarshal(body, output); sub != nil {
+				err = &rest.Error{Type: rest.UnmarshalError, Sub: sub}
+			}
+		}
+	}
 
-	if err := resp.GetBody(output); err != nil {
+	if err != nil {
 		metrics.Error = err.Type
-		client.Error(err)
 	}
 
 	metrics.Latency = time.Since(t0)
 	client.RecordMetrics(metrics)
+
+	return err
 }
 
 func init() {
@@ -72,3 +72,42 @@ func TestConfigSyncPushHTTP(t *testing.T) {
 
 	test.Run("syncPushTest", inRouter, handler)
 }
+
+func TestHTTPClientSelect(t *testing.T) {
+	test := NewTestRouterUtils(t)
+
+	router := test.NewRouter()
+	router.NewConfig(test.Labeled("c0", 1, "env", "prod"))
+	router.NewConfig(test.Labeled("c1", 1, "env", "dev"))
+	test.WaitForPropagation()
+
+	endpoint := test.Endpoint(router)
+	defer endpoint.Close()
+
+	client := &HTTPClient{URL: endpoint.RootedURL()}
+
+	// The pull and list routes must keep working without a selector.
+	if configs := client.PullConfigs(); configs.Len() != 2 {
+		t.Errorf("FAIL(pull): unexpected configs %v", configs)
+	}
+
+	var list ConfigList
+	if !client.sendRequest("GET", "/list", nil, &list, &HTTPClientMetrics{}) {
+		t.Errorf("FAIL(list): request failed")
+	} else if state := list[TestConfigType]; state == nil || len(state.Configs) != 2 {
+		t.Errorf("FAIL(list): unexpected list %v", list)
+	}
+
+	if configs := client.PullSelected(MustParseSelector("env=prod")); configs == nil {
+		t.Errorf("FAIL(select): request failed")
+	} else {
+		test.Diff("select", configs.ConfigArray(), test.Config("c0", 1))
+	}
+
+	list = nil
+	if !client.sendRequest("GET", "/select/env%3Ddev/list", nil, &list, &HTTPClientMetrics{}) {
+		t.Errorf("FAIL(select-list): request failed")
+	} else if state := list[TestConfigType]; state == nil || len(state.Configs) != 1 || state.Configs["c1"] != 1 {
+		t.Errorf("FAIL(select-list): unexpected list %v", list)
+	}
+}
@@ -0,0 +1,165 @@
+// Copyright (c) 2014 Datacratic. All rights reserved.
+
+package sconf
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+)
+
+// Selectable allows an object to indicate which configs it is interested in
+// receiving based on the labels of the configs. Can be combined with Routable
+// in which case a config must satisfy both to be routed to the object.
+type Selectable interface {
+
+	// ConfigSelector returns the selector that the labels of a config must
+	// match to be routed to the handler/object. The selector should not
+	// change over the lifetime of the object.
+	ConfigSelector() Selector
+}
+
+type selectorOp int
+
+const (
+	selectEqual selectorOp = iota
+	selectNotEqual
+	selectExists
+	selectNotExists
+)
+
+type selectorTerm struct {
+	Key   string
+	Value string
+	Op    selectorOp
+}
+
+// Selector is a conjunction of label requirements parsed by ParseSelector. The
+// empty selector matches all the configs.
+type Selector []selectorTerm
+
+// ParseSelector parses a comma separated list of label requirements where each
+// requirement is one of: key=value, key==value, key!=value, key which requires
+// that the label exists and !key which requires that the label doesn't exist.
+// Note that a config without the label satisfies key!=value.
+func ParseSelector(str string) (selector Selector, err error) {
+	for _, term := range strings.Split(str, ",") {
+		term = strings.TrimSpace(term)
+		if len(term) == 0 {
+			continue
+		}
+
+		var result selectorTerm
+
+		if i := strings.Index(term, "!="); i >= 0 {
+			result = selectorTerm{Key: term[:i], Value: term[i+2:], Op: selectNotEqual}
+		} else if i := strings.Index(term, "=="); i >= 0 {
+			result = selectorTerm{Key: term[:i], Value: term[i+2:], Op: selectEqual}
+		} else if i := strings.Index(term, "="); i >= 0 {
+			result = selectorTerm{Key: term[:i], Value: term[i+1:], Op: selectEqual}
+		} else if strings.HasPrefix(term, "!") {
+			result = selectorTerm{Key: term[1:], Op: selectNotExists}
+		} else {
+			result = selectorTerm{Key: term, Op: selectExists}
+		}
+
+		result.Key = strings.TrimSpace(result.Key)
+		result.Value = strings.TrimSpace(result.Value)
+
+		if len(result.Key) == 0 || strings.ContainsAny(result.Key, "=!") || strings.ContainsAny(result.Value, "=!") {
+			return nil, fmt.Errorf("invalid selector term '%s'", term)
+		}
+
+		selector = append(selector, result)
+	}
+
+	return
+}
+
+// MustParseSelector is similar to ParseSelector but panics if the selector is
+// invalid.
+func MustParseSelector(str string) Selector {
+	selector, err := ParseSelector(str)
+	if err != nil {
+		panic(err.Error())
+	}
+	return selector
+}
+
+// Matches returns true if the labels satisfy all the requirements of the
+// selector.
+func (selector Selector) Matches(labels map[string]string) bool {
+	for _, term := range selector {
+		value, ok := labels[term.Key]
+
+		switch term.Op {
+		case selectEqual:
+			ok = ok && value == term.Value
+		case selectNotEqual:
+			ok = !ok || value != term.Value
+		case selectNotExists:
+			ok = !ok
+		}
+
+		if !ok {
+			return false
+		}
+	}
+
+	return true
+}
+
+// String returns the selector in the format accepted by ParseSelector.
+func (selector Selector) String() string {
+	buffer := new(bytes.Buffer)
+
+	for i, term := range selector {
+		if i > 0 {
+			buffer.WriteString(",")
+		}
+
+		switch term.Op {
+		case selectEqual:
+			buffer.WriteString(term.Key + "=" + term.Value)
+		case selectNotEqual:
+			buffer.WriteString(term.Key + "!=" + term.Value)
+		case selectExists:
+			buffer.WriteString(term.Key)
+		case selectNotExists:
+			buffer.WriteString("!" + term.Key)
+		}
+	}
+
+	return buffer.String()
+}
+
+// Select returns the live configs whose labels match the given selector.
+// Tombstones don't have labels and are never selected.
+func (configs *Configs) Select(selector Selector) *Configs {
+	result := &Configs{Types: make(map[string]*TypeConfigs)}
+
+	for _, state := range configs.Types {
+		state.Configs.Range(func(ID string, config *Config) bool {
+			if selector.Matches(config.Labels) {
+				result.NewConfig(config)
+			}
+			return true
+		})
+	}
+
+	return result
+}
+
+// selectorOf returns the selector of the object if it implements Selectable.
+func selectorOf(obj interface{}) (Selector, bool) {
+	if selectable, ok := obj.(Selectable); ok {
+		return selectable.ConfigSelector(), true
+	}
+	return nil, false
+}
+
+// selects returns true if the config should be routed to the object.
+func selects(obj interface{}, config *Config) bool {
+	selector, ok := selectorOf(obj)
+	return !ok || selector.Matches(config.Labels)
+}
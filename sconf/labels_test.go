@@ -0,0 +1,194 @@
+// Copyright (c) 2014 Datacratic. All rights reserved.
+
+package sconf
+
+import (
+	"os"
+	"testing"
+)
+
+func (t TestConfigUtils) Labeled(ID string, version uint64, labels ...string) *Config {
+	config := t.Config(ID, version)
+	config.Labels = make(map[string]string)
+	for i := 0; i+1 < len(labels); i += 2 {
+		config.Labels[labels[i]] = labels[i+1]
+	}
+	return config
+}
+
+type TestSelectableHandler struct {
+	*TestHandler
+	Selector Selector
+}
+
+func (h *TestSelectableHandler) ConfigSelector() Selector { return h.Selector }
+
+type TestSelectableConfigurable struct {
+	*TestConfigurable
+	Selector Selector
+}
+
+func (obj *TestSelectableConfigurable) ConfigSelector() Selector { return obj.Selector }
+
+func (obj *TestSelectableConfigurable) Copy() Configurable {
+	obj.TestConfigurable.Copy()
+	return obj
+}
+
+func TestSelector(t *testing.T) {
+	labels := map[string]string{"env": "prod", "tier": "web"}
+
+	tests := []struct {
+		Selector string
+		Match    bool
+	}{
+		{"", true},
+		{"env=prod", true},
+		{"env==prod", true},
+		{"env=dev", false},
+		{"env!=dev", true},
+		{"region!=eu", true},
+		{"tier", true},
+		{"!tier", false},
+		{"!region", true},
+		{"env=prod, tier=web", true},
+		{"env=prod,tier=db", false},
+	}
+
+	for _, test := range tests {
+		selector, err := ParseSelector(test.Selector)
+		if err != nil {
+			t.Errorf("FAIL(%s): unexpected error: %s", test.Selector, err)
+			continue
+		}
+
+		if match := selector.Matches(labels); match != test.Match {
+			t.Errorf("FAIL(%s): unexpected match %t != %t", test.Selector, match, test.Match)
+		}
+
+		if other := MustParseSelector(selector.String()); other.String() != selector.String() {
+			t.Errorf("FAIL(%s): string doesn't round trip '%s' != '%s'", test.Selector, other, selector)
+		}
+	}
+
+	for _, str := range []string{"=prod", "env=a=b", "!", "env!=!"} {
+		if _, err := ParseSelector(str); err == nil {
+			t.Errorf("FAIL(%s): expected error", str)
+		}
+	}
+}
+
+func TestConfigsSelect(test *testing.T) {
+	t := NewTestConfigsUtils(test)
+
+	c := &Configs{}
+	c.NewConfig(t.Labeled("c0", 1, "env", "prod"))
+	c.NewConfig(t.Labeled("c1", 1, "env", "dev"))
+	c.NewConfig(t.Labeled("c2", 1, "env", "prod"))
+	c.NewConfig(t.Config("c3", 1))
+	c.DeadConfig(t.Tomb("c2", 2))
+
+	t.Diff("select", c.Select(MustParseSelector("env=prod")).ConfigArray(), t.Config("c0", 1))
+	t.Diff("missing", c.Select(MustParseSelector("!env")).ConfigArray(), t.Config("c3", 1))
+	t.Diff("all", c.Select(nil).ConfigArray(), t.Config("c0", 1), t.Config("c1", 1), t.Config("c3", 1))
+}
+
+func TestRouterSelect(t *testing.T) {
+	test := NewTestRouterUtils(t)
+
+	handler := &TestSelectableHandler{test.NewHandler(), MustParseSelector("env=prod")}
+	router := test.NewRouter(handler)
+
+	obj := &TestSelectableConfigurable{test.NewConfigurable("o0"), MustParseSelector("env=prod")}
+	obj.newConfigC = make(chan string, 100)
+	obj.deadConfigC = make(chan string, 100)
+
+	router.NewConfig(test.Labeled("c0", 1, "env", "prod"))
+	router.NewConfig(test.Labeled("c1", 1, "env", "dev"))
+	handler.ExpectNew(test.Config("c0", 1))
+
+	router.RegisterState(obj.Name, obj)
+	obj.Expect("register", []string{"c0"}, []string{}, false)
+
+	// Configs that leave the selection are seen as killed.
+	router.NewConfig(test.Labeled("c0", 2, "env", "dev"))
+	router.NewConfig(test.Labeled("c1", 2, "env", "prod"))
+	handler.ExpectNew(test.Config("c1", 2))
+	handler.ExpectDead(test.Config("c0", 2))
+	obj.Expect("update", []string{"c1"}, []string{"c0"}, true)
+
+	router.DeadConfig(test.Tomb("c0", 3))
+	router.DeadConfig(test.Tomb("c1", 3))
+	router.DeadConfig(test.Tomb("c2", 3))
+	handler.ExpectNew()
+	handler.ExpectDead(test.Config("c1", 3))
+	obj.Expect("dead", []string{}, []string{"c1"}, true)
+}
+
+func TestHTTPEndpointSelect(test *testing.T) {
+	t := NewTestRouterUtils(test)
+
+	router := t.NewRouter()
+	router.NewConfig(t.Labeled("c0", 1, "env", "prod"))
+	router.NewConfig(t.Labeled("c1", 1, "env", "dev"))
+	t.WaitForPropagation()
+
+	endpoint := &HTTPEndpoint{Router: router}
+
+	configs, err := endpoint.PullSelected("env=prod")
+	if err != nil {
+		t.Fatalf("FAIL(pull): unexpected error: %s", err)
+	}
+	t.Diff("pull", configs.ConfigArray(), t.Config("c0", 1))
+
+	list, err := endpoint.ListSelected("env=dev")
+	if err != nil {
+		t.Fatalf("FAIL(list): unexpected error: %s", err)
+	} else if state := list[TestConfigType]; state == nil || len(state.Configs) != 1 || state.Configs["c1"] != 1 {
+		t.Errorf("FAIL(list): unexpected list %v", list)
+	}
+
+	if _, err := endpoint.PullSelected("="); err == nil {
+		t.Errorf("FAIL(invalid): expected error")
+	}
+}
+
+func TestConfigPersistLabels(t *testing.T) {
+	test := NewConfigPersistUtilsTest(t)
+
+	file := test.NewFile()
+	defer os.Remove(file)
+
+	dir := test.NewDir()
+	defer os.RemoveAll(dir)
+
+	sqlite := test.NewFile()
+	defer os.Remove(sqlite)
+
+	dbs := []struct {
+		Title string
+		New   func() ConfigDB
+	}{
+		{"aof", func() ConfigDB { return &AOFConfigDB{File: file} }},
+		{"dir", func() ConfigDB { return &DirConfigDB{Dir: dir} }},
+		{"sqlite", func() ConfigDB { return &SQLiteConfigDB{File: sqlite} }},
+	}
+
+	for _, db := range dbs {
+		db0 := db.New()
+		db0.NewConfig(test.Labeled("c0", 1, "env", "prod"))
+		db0.Close()
+
+		db1 := db.New()
+		state := test.Load(db.Title, db1)
+		db1.Close()
+
+		if state == nil {
+			continue
+		}
+
+		if config, _ := state.Configs.Get("c0"); config == nil || config.Labels["env"] != "prod" {
+			t.Errorf("FAIL(%s): labels were not persisted: %v", db.Title, config)
+		}
+	}
+}
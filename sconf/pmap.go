@@ -0,0 +1,359 @@
+// Copyright (c) 2014 Datacratic. All rights reserved.
+
+package sconf
+
+import (
+	"hash/fnv"
+)
+
+// The persistent map is a hash array mapped trie (HAMT) where each node holds
+// up to 32 entries indexed by 5 bits of the hash of the key. Nodes are never
+// modified once created: an update copies the path from the root to the
+// modified entry which makes copies of the map O(1) and updates O(log n).
+
+const (
+	hamtBits  = 5
+	hamtMask  = 1<<hamtBits - 1
+	hamtDepth = 32
+)
+
+type hamtLeaf struct {
+	hash  uint32
+	key   string
+	value interface{}
+}
+
+// hamtEntry is either a leaf or a sub-node.
+type hamtEntry struct {
+	leaf *hamtLeaf
+	node *hamtNode
+}
+
+// hamtNode holds the entries whose bit is set in bitmap ordered by bit. Nodes
+// past the depth of the hash hold the leaves whose hashes collide.
+type hamtNode struct {
+	bitmap  uint32
+	entries []hamtEntry
+	leaves  []*hamtLeaf
+}
+
+func hamtHash(key string) uint32 {
+	hash := fnv.New32a()
+	hash.Write([]byte(key))
+	return hash.Sum32()
+}
+
+func popcount(x uint32) (n int) {
+	for ; x != 0; x &= x - 1 {
+		n++
+	}
+	return
+}
+
+func (node *hamtNode) index(hash uint32, shift uint) (uint32, int) {
+	bit := uint32(1) << ((hash >> shift) & hamtMask)
+	return bit, popcount(node.bitmap & (bit - 1))
+}
+
+func (node *hamtNode) get(hash uint32, shift uint, key string) (interface{}, bool) {
+	for ; shift < hamtDepth; shift += hamtBits {
+		bit, i := node.index(hash, shift)
+		if node.bitmap&bit == 0 {
+			return nil, false
+		}
+
+		entry := node.entries[i]
+		if entry.leaf != nil {
+			if entry.leaf.key == key {
+				return entry.leaf.value, true
+			}
+			return nil, false
+		}
+
+		node = entry.node
+	}
+
+	for _, leaf := range node.leaves {
+		if leaf.key == key {
+			return leaf.value, true
+		}
+	}
+
+	return nil, false
+}
+
+// set returns a copy of the node with the leaf added and whether the key of the
+// leaf is new.
+func (node *hamtNode) set(shift uint, leaf *hamtLeaf) (*hamtNode, bool) {
+	if shift >= hamtDepth {
+		result := &hamtNode{leaves: make([]*hamtLeaf, 0, len(node.leaves)+1)}
+		isNew := true
+
+		for _, other := range node.leaves {
+			if other.key == leaf.key {
+				other, isNew = leaf, false
+			}
+			result.leaves = append(result.leaves, other)
+		}
+
+		if isNew {
+			result.leaves = append(result.leaves, leaf)
+		}
+
+		return result, isNew
+	}
+
+	bit, i := node.index(leaf.hash, shift)
+
+	if node.bitmap&bit == 0 {
+		result := &hamtNode{bitmap: node.bitmap | bit, entries: make([]hamtEntry, len(node.entries)+1)}
+		copy(result.entries, node.entries[:i])
+		result.entries[i] = hamtEntry{leaf: leaf}
+		copy(result.entries[i+1:], node.entries[i:])
+		return result, true
+	}
+
+	result := &hamtNode{bitmap: node.bitmap, entries: append([]hamtEntry(nil), node.entries...)}
+	entry := node.entries[i]
+	isNew := true
+
+	if entry.node != nil {
+		result.entries[i].node, isNew = entry.node.set(shift+hamtBits, leaf)
+
+	} else if entry.leaf.key == leaf.key {
+		result.entries[i].leaf = leaf
+		isNew = false
+
+	} else {
+		child, _ := (&hamtNode{}).set(shift+hamtBits, entry.leaf)
+		child, _ = child.set(shift+hamtBits, leaf)
+		result.entries[i] = hamtEntry{node: child}
+	}
+
+	return result, isNew
+}
+
+// remove returns a copy of the node without the key and whether the key was
+// present. The node itself is returned if the key wasn't present.
+func (node *hamtNode) remove(hash uint32, shift uint, key string) (*hamtNode, bool) {
+	if shift >= hamtDepth {
+		for i, leaf := range node.leaves {
+			if leaf.key == key {
+				result := &hamtNode{leaves: make([]*hamtLeaf, 0, len(node.leaves)-1)}
+				result.leaves = append(result.leaves, node.leaves[:i]...)
+				result.leaves = append(result.leaves, node.leaves[i+1:]...)
+				return result, true
+			}
+		}
+		return node, false
+	}
+
+	bit, i := node.index(hash, shift)
+	if node.bitmap&bit == 0 {
+		return node, false
+	}
+
+	entry := node.entries[i]
+	var replacement *hamtEntry
+
+	if entry.node != nil {
+		child, ok := entry.node.remove(hash, shift+hamtBits, key)
+		if !ok {
+			return node, false
+		}
+
+		// Sub-nodes left with a single leaf are collapsed into their parent.
+		if leaf := child.single(); leaf != nil {
+			replacement = &hamtEntry{leaf: leaf}
+		} else if !child.empty() {
+			replacement = &hamtEntry{node: child}
+		}
+
+	} else if entry.leaf.key != key {
+		return node, false
+	}
+
+	if replacement != nil {
+		result := &hamtNode{bitmap: node.bitmap, entries: append([]hamtEntry(nil), node.entries...)}
+		result.entries[i] = *replacement
+		return result, true
+	}
+
+	result := &hamtNode{bitmap: node.bitmap &^ bit, entries: make([]hamtEntry, 0, len(node.entries)-1)}
+	result.entries = append(result.entries, node.entries[:i]...)
+	result.entries = append(result.entries, node.entries[i+1:]...)
+	return result, true
+}
+
+func (node *hamtNode) empty() bool {
+	return len(node.entries) == 0 && len(node.leaves) == 0
+}
+
+// single returns the only leaf of the node if the node has no sub-nodes and a
+// single leaf.
+func (node *hamtNode) single() *hamtLeaf {
+	if len(node.leaves) == 1 && len(node.entries) == 0 {
+		return node.leaves[0]
+	}
+	if len(node.entries) == 1 && node.entries[0].leaf != nil {
+		return node.entries[0].leaf
+	}
+	return nil
+}
+
+// each invokes fn on every leaf until fn returns false. Returns false if the
+// iteration was interrupted.
+func (node *hamtNode) each(fn func(key string, value interface{}) bool) bool {
+	for _, entry := range node.entries {
+		if entry.leaf != nil {
+			if !fn(entry.leaf.key, entry.leaf.value) {
+				return false
+			}
+		} else if !entry.node.each(fn) {
+			return false
+		}
+	}
+
+	for _, leaf := range node.leaves {
+		if !fn(leaf.key, leaf.value) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// pmap is an immutable string keyed map whose zero value is the empty map.
+// Updates return a new map and leave the original untouched.
+type pmap struct {
+	root *hamtNode
+	size int
+}
+
+func (m pmap) len() int { return m.size }
+
+func (m pmap) get(key string) (interface{}, bool) {
+	if m.root == nil {
+		return nil, false
+	}
+	return m.root.get(hamtHash(key), 0, key)
+}
+
+func (m pmap) set(key string, value interface{}) pmap {
+	root := m.root
+	if root == nil {
+		root = &hamtNode{}
+	}
+
+	root, isNew := root.set(0, &hamtLeaf{hash: hamtHash(key), key: key, value: value})
+	if isNew {
+		return pmap{root, m.size + 1}
+	}
+	return pmap{root, m.size}
+}
+
+func (m pmap) remove(key string) pmap {
+	if m.root == nil {
+		return m
+	}
+
+	if root, ok := m.root.remove(hamtHash(key), 0, key); ok {
+		return pmap{root, m.size - 1}
+	}
+	return m
+}
+
+func (m pmap) each(fn func(key string, value interface{}) bool) {
+	if m.root != nil {
+		m.root.each(fn)
+	}
+}
+
+// ConfigMap is an immutable mapping of config ID to config. The zero value is
+// the empty map and copying a ConfigMap is O(1). Set and Delete return a new
+// map in O(log n) and leave the original map untouched.
+type ConfigMap struct{ m pmap }
+
+// Len returns the number of configs in the map.
+func (configs ConfigMap) Len() int { return configs.m.len() }
+
+// Get returns the config associated with the given ID and a bool indicating
+// whether the ID is present in the map.
+func (configs ConfigMap) Get(ID string) (*Config, bool) {
+	if value, ok := configs.m.get(ID); ok {
+		return value.(*Config), true
+	}
+	return nil, false
+}
+
+// Set returns a map where the config is associated with its ID.
+func (configs ConfigMap) Set(config *Config) ConfigMap {
+	return ConfigMap{configs.m.set(config.ID, config)}
+}
+
+// Delete returns a map without the given ID.
+func (configs ConfigMap) Delete(ID string) ConfigMap {
+	return ConfigMap{configs.m.remove(ID)}
+}
+
+// Range invokes fn on every config of the map in an unspecified order until fn
+// returns false.
+func (configs ConfigMap) Range(fn func(ID string, config *Config) bool) {
+	configs.m.each(func(key string, value interface{}) bool {
+		return fn(key, value.(*Config))
+	})
+}
+
+// Map returns the content of the map as a regular go map.
+func (configs ConfigMap) Map() map[string]*Config {
+	result := make(map[string]*Config, configs.Len())
+	configs.Range(func(ID string, config *Config) bool {
+		result[ID] = config
+		return true
+	})
+	return result
+}
+
+// TombstoneMap is an immutable mapping of config ID to tombstone. See ConfigMap
+// for more details.
+type TombstoneMap struct{ m pmap }
+
+// Len returns the number of tombstones in the map.
+func (tombstones TombstoneMap) Len() int { return tombstones.m.len() }
+
+// Get returns the tombstone associated with the given ID and a bool indicating
+// whether the ID is present in the map.
+func (tombstones TombstoneMap) Get(ID string) (*Tombstone, bool) {
+	if value, ok := tombstones.m.get(ID); ok {
+		return value.(*Tombstone), true
+	}
+	return nil, false
+}
+
+// Set returns a map where the tombstone is associated with its ID.
+func (tombstones TombstoneMap) Set(tombstone *Tombstone) TombstoneMap {
+	return TombstoneMap{tombstones.m.set(tombstone.ID, tombstone)}
+}
+
+// Delete returns a map without the given ID.
+func (tombstones TombstoneMap) Delete(ID string) TombstoneMap {
+	return TombstoneMap{tombstones.m.remove(ID)}
+}
+
+// Range invokes fn on every tombstone of the map in an unspecified order until
+// fn returns false.
+func (tombstones TombstoneMap) Range(fn func(ID string, tombstone *Tombstone) bool) {
+	tombstones.m.each(func(key string, value interface{}) bool {
+		return fn(key, value.(*Tombstone))
+	})
+}
+
+// Map returns the content of the map as a regular go map.
+func (tombstones TombstoneMap) Map() map[string]*Tombstone {
+	result := make(map[string]*Tombstone, tombstones.Len())
+	tombstones.Range(func(ID string, tombstone *Tombstone) bool {
+		result[ID] = tombstone
+		return true
+	})
+	return result
+}
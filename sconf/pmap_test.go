@@ -0,0 +1,182 @@
+// Copyright (c) 2014 Datacratic. All rights reserved.
+
+package sconf
+
+import (
+	"fmt"
+	"math/rand"
+	"testing"
+)
+
+func (m pmap) expect(t *testing.T, title string, exp map[string]int) {
+	if m.len() != len(exp) {
+		t.Errorf("FAIL(%s): unexpected len %d != %d", title, m.len(), len(exp))
+	}
+
+	for key, value := range exp {
+		if result, ok := m.get(key); !ok || result.(int) != value {
+			t.Errorf("FAIL(%s): unexpected value for %s: %v != %d", title, key, result, value)
+		}
+	}
+
+	n := 0
+	m.each(func(key string, value interface{}) bool {
+		if exp[key] != value.(int) {
+			t.Errorf("FAIL(%s): unexpected entry %s -> %v", title, key, value)
+		}
+		n++
+		return true
+	})
+
+	if n != len(exp) {
+		t.Errorf("FAIL(%s): unexpected number of entries %d != %d", title, n, len(exp))
+	}
+}
+
+func TestPersistentMap(t *testing.T) {
+	rng := rand.New(rand.NewSource(0))
+
+	m := pmap{}
+	exp := make(map[string]int)
+
+	type snapshot struct {
+		m   pmap
+		exp map[string]int
+	}
+	var snapshots []snapshot
+
+	for i := 0; i < 10000; i++ {
+		key := fmt.Sprintf("c%d", rng.Intn(2000))
+
+		if rng.Intn(3) == 0 {
+			m = m.remove(key)
+			delete(exp, key)
+		} else {
+			m = m.set(key, i)
+			exp[key] = i
+		}
+
+		if i%1000 == 0 {
+			copy := make(map[string]int)
+			for key, value := range exp {
+				copy[key] = value
+			}
+			snapshots = append(snapshots, snapshot{m, copy})
+		}
+	}
+
+	m.expect(t, "random", exp)
+
+	for i, snapshot := range snapshots {
+		snapshot.m.expect(t, fmt.Sprintf("snapshot-%d", i), snapshot.exp)
+	}
+
+	for key := range exp {
+		m = m.remove(key)
+	}
+	m.expect(t, "empty", nil)
+
+	if _, ok := m.get("c0"); ok {
+		t.Errorf("FAIL(empty): unexpected key")
+	}
+}
+
+func TestPersistentMapCollisions(t *testing.T) {
+	leaf := func(key string) *hamtLeaf { return &hamtLeaf{hash: 42, key: key, value: key} }
+
+	root, _ := (&hamtNode{}).set(0, leaf("a"))
+	root, _ = root.set(0, leaf("b"))
+	root, _ = root.set(0, leaf("c"))
+
+	if _, isNew := root.set(0, leaf("b")); isNew {
+		t.Errorf("FAIL(set): existing key reported as new")
+	}
+
+	for _, key := range []string{"a", "b", "c"} {
+		if value, ok := root.get(42, 0, key); !ok || value != key {
+			t.Errorf("FAIL(get): unexpected value for %s: %v", key, value)
+		}
+	}
+
+	removed, ok := root.remove(42, 0, "b")
+	if !ok {
+		t.Errorf("FAIL(remove): missing key")
+	}
+
+	if _, ok := removed.get(42, 0, "b"); ok {
+		t.Errorf("FAIL(remove): key was not removed")
+	}
+
+	if _, ok := root.get(42, 0, "b"); !ok {
+		t.Errorf("FAIL(remove): original node was modified")
+	}
+
+	removed, _ = removed.remove(42, 0, "a")
+	if value, ok := removed.get(42, 0, "c"); !ok || value != "c" {
+		t.Errorf("FAIL(collapse): unexpected value %v", value)
+	}
+}
+
+func newBenchConfigs(n int) *Configs {
+	configs := &Configs{}
+	for i := 0; i < n; i++ {
+		configs.NewConfig((&TestConfig{Data: "d"}).Wrap(fmt.Sprintf("c%d", i), 1))
+	}
+	return configs
+}
+
+// benchmarkConfigsCopy measures the cost of a router event: a copy of the
+// configs followed by the update of a single config.
+func benchmarkConfigsCopy(b *testing.B, n int) {
+	configs := newBenchConfigs(n)
+	configs.Types[TestConfigType].mutableDigest()
+
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		configs = configs.Copy()
+		configs.NewConfig((&TestConfig{Data: "d"}).Wrap(fmt.Sprintf("c%d", i%n), uint64(i+2)))
+	}
+}
+
+// benchmarkConfigsCopyMap measures the same operations using plain go maps
+// which are deep copied on every event.
+func benchmarkConfigsCopyMap(b *testing.B, n int) {
+	state := make(map[string]*Config)
+	for i := 0; i < n; i++ {
+		state[fmt.Sprintf("c%d", i)] = (&TestConfig{Data: "d"}).Wrap(fmt.Sprintf("c%d", i), 1)
+	}
+
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		copy := make(map[string]*Config, len(state))
+		for ID, config := range state {
+			copy[ID] = config
+		}
+
+		state = copy
+		config := (&TestConfig{Data: "d"}).Wrap(fmt.Sprintf("c%d", i%n), uint64(i+2))
+		state[config.ID] = config
+	}
+}
+
+func BenchmarkConfigsCopy1k(b *testing.B)     { benchmarkConfigsCopy(b, 1000) }
+func BenchmarkConfigsCopy10k(b *testing.B)    { benchmarkConfigsCopy(b, 10000) }
+func BenchmarkConfigsCopyMap1k(b *testing.B)  { benchmarkConfigsCopyMap(b, 1000) }
+func BenchmarkConfigsCopyMap10k(b *testing.B) { benchmarkConfigsCopyMap(b, 10000) }
+
+func BenchmarkRouterNewConfig(b *testing.B) {
+	router := &Router{Configs: newBenchConfigs(10000)}
+
+	for i := 0; i < 100; i++ {
+		obj := &TestConfigurable{Name: fmt.Sprintf("o%d", i), Types: []string{"other"}}
+		router.RegisterState(obj.Name, obj)
+	}
+
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		router.NewConfigSync((&TestConfig{Data: "d"}).Wrap(fmt.Sprintf("c%d", i%10000), uint64(i+2)))
+	}
+}
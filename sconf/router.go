@@ -7,6 +7,7 @@ import (
 	"github.com/datacratic/goklog/klog"
 
 	"encoding/json"
+	"fmt"
 	"log"
 	"sync"
 	"sync/atomic"
@@ -35,7 +36,8 @@ type Routable interface {
 type Configurable interface {
 
 	// Copy returns a copy of the object which will be used by subsequent calls
-	// to NewConfig and DeadConfig to mutate the object without data-races.
+	// to NewConfig and DeadConfig to mutate the object without data-races. The
+	// router only copies an object when an event is routed to it.
 	Copy() Configurable
 
 	// NewConfig mutates the object's state to include the new configuration.
@@ -69,18 +71,70 @@ type keyedConfigurable struct {
 	Object Configurable
 }
 
+type keyedHandler struct {
+	Key     string
+	Handler Handler
+	Replay  bool
+
+	doneC chan int
+}
+
+// RouterResult is the result of a configuration event pushed via one of the
+// acknowledged variants of the Router functions.
+type RouterResult struct {
+
+	// IsNew indicates whether at least one config or tombstone of the event
+	// was new and was therefore forwarded to the handlers and objects.
+	IsNew bool
+
+	// Replaced contains the configs that were replaced or killed by the
+	// event.
+	Replaced []*Config
+
+	// Err combines the errors returned by the Configurable objects while
+	// processing the event along with conflicting configs. These errors are
+	// also logged by the router.
+	Err error
+
+	// Rejected indicates that the event was rejected by a Configurable object
+	// while the router is in transactional mode. None of the effects of a
+	// rejected event are applied.
+	Rejected bool
+
+	// failed indicates that a Configurable object returned an error.
+	failed bool
+}
+
+// routerWrite is an acknowledged event processed by the router's goroutine.
+// Exactly one of Config, Tombstone or Configs is set.
+type routerWrite struct {
+	Config    *Config
+	Tombstone *Tombstone
+	Configs   *Configs
+
+	result RouterResult
+	doneC  chan RouterResult
+}
+
 // DefaultRouterQueueSize represents the number of events that the router can
 // buffer before forcing the batch processing of events.
 const DefaultRouterQueueSize = 1 << 8
 
 // Router routes configuration events to handlers and objects. If an object or a
 // handler implements the Routable interface then only the configuration events
-// for the desired types will be routed to that handler/object.
+// for the desired types will be routed to that handler/object. Similarly, if an
+// object or a handler implements the Selectable interface then only the configs
+// whose labels match its selector will be routed to that handler/object. A
+// config whose labels stop matching the selector is seen as killed by the
+// handler/object.
 //
 // Configuration events are first merged into the internal Configs object and
 // only new events are forwarded to the handlers and objects.  All configuration
 // event notifications are defered to the router's goroutine where all event
-// processing takes place.
+// processing takes place. The Sync variants of NewConfig, DeadConfig and
+// PushConfigs wait until the event was processed and the new state is visible
+// via State and PullConfigs before returning the result of the event. The new
+// events can also be observed as a channel via Watch.
 type Router struct {
 	Name string
 
@@ -98,23 +152,74 @@ type Router struct {
 
 	// Handlers is the list of handlers that will be executed for each new
 	// configuration events. Can be set during construction but can't be changed
-	// afterwards.
+	// afterwards. Additional handlers can be registered via RegisterHandler and
+	// configuration events can also be observed via Watch.
 	Handlers []Handler
 
 	// QueueSize indicates the number of events that can be buffered before
 	// forcing the batch processing of events.
 	QueueSize int
 
+	// Versioner is used to stamp a version on the configs and tombstones
+	// pushed via NewConfig and DeadConfig with a version of 0. The versioner
+	// is also added to the list of handlers such that it observes the versions
+	// of all new configuration events. Can be set during construction but
+	// can't be changed afterwards.
+	Versioner *Versioner
+
+	// HistoryRetention indicates the number of history entries to keep for
+	// each config type where the entry for the empty type name applies to all
+	// the types not in the map. Defaults to no history. Can be set during
+	// construction but can't be changed afterwards. See Configs.SetRetention
+	// for more details.
+	HistoryRetention map[string]int
+
+	// Registry is used to resolve the siblings of concurrent updates. Defaults
+	// to DefaultTypeRegistry. Can be set during construction but can't be
+	// changed afterwards.
+	Registry *TypeRegistry
+
+	// WriterID identifies the router in the version vectors of the configs it
+	// writes and must be unique among all the writers of the configs. Unlike
+	// Name, it has no default since two routers sharing a writer ID would
+	// produce equal vectors for concurrent updates. Required by Rollback for
+	// configs with version vectors. Can be set during construction but can't
+	// be changed afterwards.
+	WriterID string
+
+	// Transactional indicates that an event, either a single config or
+	// tombstone or all the configs and tombstones of a PushConfigs call, should
+	// be rejected if any of the Configurable objects returns an error while
+	// processing it. A rejected event leaves the configs and the objects of
+	// the router untouched and isn't forwarded to the handlers and
+	// subscriptions. The rejection is reported to the caller via the Sync
+	// variants and to RejectHandler. Can be set during construction but can't
+	// be changed afterwards.
+	Transactional bool
+
+	// RejectHandler is invoked in transactional mode with each rejected
+	// config, tombstone or configs object along with the error that caused
+	// the rejection. Invoked from the router's goroutine.
+	RejectHandler func(obj interface{}, err error)
+
 	initialize sync.Once
 
 	state unsafe.Pointer
 
 	closeC           chan int
+	closedC          chan int
 	newConfigC       chan *Config
 	deadConfigC      chan *Tombstone
 	pushConfigsC     chan *Configs
+	collectC         chan uint64
 	registerStateC   chan keyedConfigurable
 	unregisterStateC chan string
+	writeC           chan *routerWrite
+	watchC           chan *Subscription
+	unwatchC         chan *Subscription
+
+	registerHandlerC   chan *keyedHandler
+	unregisterHandlerC chan *keyedHandler
 }
 
 // Init initializes the router. Note that calling this function explicitly is
@@ -128,7 +233,18 @@ func (router *Router) init() {
 		router.Name = "configRouter"
 	}
 
-	state := newRouterState(router.Configs, router.Handlers)
+	handlers := router.Handlers
+	if router.Versioner != nil {
+		handlers = append(append([]Handler{}, handlers...), router.Versioner)
+	}
+
+	state := newRouterState(router.Configs, handlers)
+	if router.HistoryRetention != nil {
+		state.Configs.SetRetention(router.HistoryRetention)
+	}
+	if router.Registry != nil {
+		state.Configs.setRegistry(router.Registry)
+	}
 	if router.States != nil {
 		for key, obj := range router.States {
 			state.RegisterState(key, obj)
@@ -142,14 +258,21 @@ func (router *Router) init() {
 	}
 
 	router.closeC = make(chan int)
+	router.closedC = make(chan int)
 
 	// If we start falling behind, the bigger queues allows us to catch up by
 	// batching multiple updates which avoids copies.
 	router.newConfigC = make(chan *Config, queueSize)
 	router.deadConfigC = make(chan *Tombstone, queueSize)
 	router.pushConfigsC = make(chan *Configs, queueSize)
+	router.collectC = make(chan uint64, queueSize)
 	router.registerStateC = make(chan keyedConfigurable, queueSize)
 	router.unregisterStateC = make(chan string, queueSize)
+	router.writeC = make(chan *routerWrite, queueSize)
+	router.watchC = make(chan *Subscription, queueSize)
+	router.unwatchC = make(chan *Subscription, queueSize)
+	router.registerHandlerC = make(chan *keyedHandler, queueSize)
+	router.unregisterHandlerC = make(chan *keyedHandler, queueSize)
 
 	go func() {
 		for {
@@ -161,6 +284,12 @@ func (router *Router) init() {
 			case key := <-router.unregisterStateC:
 				router.unregisterState(key)
 
+			case msg := <-router.registerHandlerC:
+				router.registerHandler(msg)
+
+			case msg := <-router.unregisterHandlerC:
+				router.unregisterHandler(msg)
+
 			case config := <-router.newConfigC:
 				router.newConfig(config)
 
@@ -170,7 +299,23 @@ func (router *Router) init() {
 			case configs := <-router.pushConfigsC:
 				router.pushConfigs(configs)
 
+			case horizon := <-router.collectC:
+				router.collectTombstones(horizon)
+
+			case write := <-router.writeC:
+				router.write(write)
+
+			case sub := <-router.watchC:
+				router.watch(sub)
+
+			case sub := <-router.unwatchC:
+				router.unwatch(sub)
+
 			case <-router.closeC:
+				state := router.get().Copy()
+				state.closeWatchers()
+				router.set(state)
+				close(router.closedC)
 				return
 
 			}
@@ -178,7 +323,9 @@ func (router *Router) init() {
 	}()
 }
 
-// Close terminates the router's goroutine.
+// Close terminates the router's goroutine and closes the channels of all the
+// subscriptions. Cancelling a subscription once the router is closed returns
+// immediately.
 func (router *Router) Close() {
 	router.Init()
 	router.closeC <- 1
@@ -202,6 +349,37 @@ func (router *Router) UnregisterState(key string) {
 	router.unregisterStateC <- key
 }
 
+// RegisterHandler registers the given handler with the given key which must be
+// unique among the registered handlers. Once called, the handler will start
+// receiving new configuration events. If replay is set then the live configs
+// and the tombstones currently held by the router are first forwarded to the
+// handler which can be used to attach a mirror, an AOFConfigDB for example, to
+// a running router. If the handler implements the Routable or Selectable
+// interfaces then only the desired configs are forwarded. Note that tombstones
+// are not replayed to Selectable handlers. Returns once the handler is
+// registered such that it receives all the events pushed afterwards.
+// RegisterHandler and UnregisterHandler must not be called from a handler or
+// object of the router.
+func (router *Router) RegisterHandler(key string, handler Handler, replay bool) {
+	router.Init()
+	assertf(len(key) > 0, "RegisterHandler's key parameter must not be nil in Router")
+
+	msg := &keyedHandler{Key: key, Handler: handler, Replay: replay, doneC: make(chan int, 1)}
+	router.registerHandlerC <- msg
+	<-msg.doneC
+}
+
+// UnregisterHandler removes the handler associated with the given key and
+// returns once the handler stopped receiving events. Handlers provided via the
+// Handlers field can't be unregistered.
+func (router *Router) UnregisterHandler(key string) {
+	router.Init()
+
+	msg := &keyedHandler{Key: key, doneC: make(chan int, 1)}
+	router.unregisterHandlerC <- msg
+	<-msg.doneC
+}
+
 // Register is a convenience function which checks whether the given handler
 // implements the ConfigurableHandler interface and calls RegisterState if it
 // does.
@@ -212,17 +390,122 @@ func (router *Router) Register(handler interface{}) {
 }
 
 // NewConfig pushes a given configuration into the router and generates the
-// required events if the configuration is new.
+// required events if the configuration is new. If Versioner is set and the
+// config has a version of 0 then a copy of the config is stamped with a new
+// version. Configs with decoded data are also stamped with the current schema
+// version of their type in Registry.
 func (router *Router) NewConfig(config *Config) {
 	router.Init()
-	router.newConfigC <- config
+	router.newConfigC <- router.stampConfig(config)
+}
+
+// NewConfigSync is similar to NewConfig but waits until the config was
+// processed and returns the result.
+func (router *Router) NewConfigSync(config *Config) RouterResult {
+	router.Init()
+	return router.sync(&routerWrite{Config: router.stampConfig(config)})
+}
+
+func (router *Router) stampConfig(config *Config) *Config {
+	config = router.Registry.stamp(config)
+
+	if router.Versioner != nil && config.Version == 0 {
+		stamped := *config
+		stamped.Version = router.Versioner.Next()
+		config = &stamped
+	}
+	return config
 }
 
 // DeadConfig pushes the given configuration tombstones into the router and
-// generates the required events if the tombstone is new.
+// generates the required events if the tombstone is new. If Versioner is set
+// and the tombstone has a version of 0 then a copy of the tombstone is stamped
+// with a new version.
 func (router *Router) DeadConfig(tombstone *Tombstone) {
 	router.Init()
-	router.deadConfigC <- tombstone
+	router.deadConfigC <- router.stampTombstone(tombstone)
+}
+
+// DeadConfigSync is similar to DeadConfig but waits until the tombstone was
+// processed and returns the result.
+func (router *Router) DeadConfigSync(tombstone *Tombstone) RouterResult {
+	router.Init()
+	return router.sync(&routerWrite{Tombstone: router.stampTombstone(tombstone)})
+}
+
+func (router *Router) stampTombstone(tombstone *Tombstone) *Tombstone {
+	if router.Versioner != nil && tombstone.Version == 0 {
+		stamped := *tombstone
+		stamped.Version = router.Versioner.Next()
+		tombstone = &stamped
+	}
+	return tombstone
+}
+
+// Rollback re-emits the config of the given type and ID at the given version,
+// along with its labels, as a new config with a version greater then the
+// current config or tombstone. A version of 0 rolls back to the live config
+// that precedes the current state which resurrects the config if it was
+// killed. If the configs have version vectors then the vector of the new config
+// descends from the current vector and is updated with WriterID which must be
+// set. The rollback requires the history of the
+// config, see HistoryRetention, and is processed like any other config event
+// via NewConfigSync which means that it must not be called from a handler or
+// object of the router. Returns the new config along with the error of the
+// RouterResult or only an error if the rollback wasn't applied.
+func (router *Router) Rollback(typ, ID string, version uint64) (*Config, error) {
+	router.Init()
+
+	configs := router.get().Configs
+
+	current, ok := configs.Get(typ, ID)
+	if !ok {
+		return nil, fmt.Errorf("ID '%s' doesn't exist for type '%s'", ID, typ)
+	}
+
+	target, ok := configs.History(typ, ID).rollbackTarget(current, version)
+	if !ok {
+		return nil, fmt.Errorf("no version %d in the history of ID '%s' for type '%s'", version, ID, typ)
+	}
+
+	if len(target.Siblings) > 0 {
+		return nil, fmt.Errorf("unable to rollback to unresolved siblings %s", target)
+	}
+
+	config := *target
+	config.Version = current.version() + 1
+
+	if current.Config != nil && current.Config.Vector != nil || target.Vector != nil {
+		if len(router.WriterID) == 0 {
+			return nil, fmt.Errorf("WriterID must be set in Router '%s' to rollback configs with version vectors", router.Name)
+		}
+
+		var vector VersionVector
+		if current.Config != nil {
+			vector = current.Config.Vector
+		}
+
+		config.Vector = vector.Join(target.Vector).Update(router.WriterID)
+		if next := config.Vector.Version(); next > config.Version {
+			config.Version = next
+		}
+
+	} else if router.Versioner != nil {
+		if next := router.Versioner.Next(); next > config.Version {
+			config.Version = next
+		}
+	}
+
+	result := router.NewConfigSync(&config)
+	if result.Rejected {
+		return nil, result.Err
+	}
+
+	if !result.IsNew {
+		return nil, fmt.Errorf("rollback of ID '%s' for type '%s' was superseded by a newer version", ID, typ)
+	}
+
+	return &config, result.Err
 }
 
 // PushConfigs adds a configs object to the router and generates the required
@@ -232,6 +515,28 @@ func (router *Router) PushConfigs(configs *Configs) {
 	router.pushConfigsC <- configs
 }
 
+// PushConfigsSync is similar to PushConfigs but waits until the configs were
+// processed and returns the combined result of all the configs and tombstones.
+func (router *Router) PushConfigsSync(configs *Configs) RouterResult {
+	router.Init()
+	return router.sync(&routerWrite{Configs: configs})
+}
+
+func (router *Router) sync(write *routerWrite) RouterResult {
+	write.doneC = make(chan RouterResult, 1)
+	router.writeC <- write
+	return <-write.doneC
+}
+
+// CollectTombstones garbage collects the tombstones below the given horizon.
+// Handlers and objects are not notified of the collected tombstones. Note that
+// events are not processed in order so events pushed before the call may be
+// processed after the collection. See Configs.GC for more details.
+func (router *Router) CollectTombstones(horizon uint64) {
+	router.Init()
+	router.collectC <- horizon
+}
+
 // PullConfigs returns the current list of active configs managed by the
 // router. The returned object should not be modified.
 func (router *Router) PullConfigs() *Configs {
@@ -239,6 +544,13 @@ func (router *Router) PullConfigs() *Configs {
 	return router.get().Configs
 }
 
+// History returns the history of the config of the given type and ID. The
+// returned history should not be modified.
+func (router *Router) History(typ, ID string) History {
+	router.Init()
+	return router.get().Configs.History(typ, ID)
+}
+
 // State returns the current state of the router. The state is read atomically
 // and is guaranteed to be consistent.
 func (router *Router) State() RouterState {
@@ -259,52 +571,124 @@ func (router *Router) registerState(key string, obj Configurable) {
 	state := router.get().Copy()
 
 	state.RegisterState(key, obj)
-	router.processMore(state)
-
-	router.set(state)
+	router.commit(state)
 }
 
 func (router *Router) unregisterState(key string) {
 	state := router.get().Copy()
 
 	state.UnregisterState(key)
-	router.processMore(state)
+	router.commit(state)
+}
 
-	router.set(state)
+func (router *Router) registerHandler(msg *keyedHandler) {
+	state := router.get().Copy()
+
+	state.registerHandler(msg.Key, msg.Handler, msg.Replay)
+	msg.doneC <- 1
+	router.commit(state)
 }
 
-func (router *Router) newConfig(config *Config) {
+func (router *Router) unregisterHandler(msg *keyedHandler) {
 	state := router.get().Copy()
 
-	if err := state.NewConfig(config); err != nil {
-		router.error(err, config)
-	}
-	router.processMore(state)
+	state.unregisterHandler(msg.Key)
+	msg.doneC <- 1
+	router.commit(state)
+}
 
-	router.set(state)
+func (router *Router) newConfig(config *Config) {
+	state := router.get().Copy()
+
+	router.applyWrite(state, &routerWrite{Config: config})
+	router.commit(state)
 }
 
 func (router *Router) deadConfig(tombstone *Tombstone) {
 	state := router.get().Copy()
 
-	if err := state.DeadConfig(tombstone); err != nil {
-		router.error(err, tombstone)
-	}
-	router.processMore(state)
-
-	router.set(state)
+	router.applyWrite(state, &routerWrite{Tombstone: tombstone})
+	router.commit(state)
 }
 
 func (router *Router) pushConfigs(configs *Configs) {
 	state := router.get().Copy()
 
-	state.PushConfigs(configs)
-	router.processMore(state)
+	router.applyWrite(state, &routerWrite{Configs: configs})
+	router.commit(state)
+}
+
+func (router *Router) write(write *routerWrite) {
+	state := router.get().Copy()
+
+	router.applyWrite(state, write)
+	router.commit(state, write)
+}
+
+// applyWrite applies the event to the state. In transactional mode, the event
+// is applied to a copy of the state which replaces the state only if none of
+// the objects returned an error.
+func (router *Router) applyWrite(state *routerState, write *routerWrite) {
+	target := state
+	if router.Transactional {
+		target = state.begin()
+	}
+
+	var obj interface{}
+
+	if write.Config != nil {
+		obj = write.Config
+		write.result = target.newConfig(write.Config)
+
+	} else if write.Tombstone != nil {
+		obj = write.Tombstone
+		write.result = target.deadConfig(write.Tombstone)
+
+	} else if write.Configs != nil {
+		obj = write.Configs
+		write.result = target.pushConfigs(write.Configs)
+	}
+
+	if router.Transactional && write.result.failed {
+		write.result = RouterResult{Err: write.result.Err, Rejected: true}
+		router.error(write.result.Err, obj)
+
+		if router.RejectHandler != nil {
+			router.RejectHandler(obj, write.result.Err)
+		}
+		return
+	}
+
+	if router.Transactional {
+		state.end(target)
+	}
+
+	// Errors of PushConfigs are only returned to the Sync variant.
+	if write.result.Err != nil && write.Configs == nil {
+		router.error(write.result.Err, obj)
+	}
+}
+
+// commit processes more of the queued events before swapping in the new state
+// after which the acknowledged events are notified of their result.
+func (router *Router) commit(state *routerState, writes ...*routerWrite) {
+	writes = router.processMore(state, writes)
 
 	router.set(state)
+
+	for _, write := range writes {
+		write.doneC <- write.result
+	}
+}
+
+func (router *Router) collectTombstones(horizon uint64) {
+	state := router.get().Copy()
+
+	state.Configs.GC(horizon)
+	router.commit(state)
 }
 
-func (router *Router) processMore(state *routerState) {
+func (router *Router) processMore(state *routerState, writes []*routerWrite) []*routerWrite {
 	for i := 0; i < 16; i++ {
 		select {
 
@@ -314,46 +698,79 @@ func (router *Router) processMore(state *routerState) {
 		case key := <-router.unregisterStateC:
 			state.UnregisterState(key)
 
+		case msg := <-router.registerHandlerC:
+			state.registerHandler(msg.Key, msg.Handler, msg.Replay)
+			msg.doneC <- 1
+
+		case msg := <-router.unregisterHandlerC:
+			state.unregisterHandler(msg.Key)
+			msg.doneC <- 1
+
 		case config := <-router.newConfigC:
-			if err := state.NewConfig(config); err != nil {
-				router.error(err, config)
-			}
+			router.applyWrite(state, &routerWrite{Config: config})
 
 		case tombstone := <-router.deadConfigC:
-			if err := state.DeadConfig(tombstone); err != nil {
-				router.error(err, tombstone)
-			}
+			router.applyWrite(state, &routerWrite{Tombstone: tombstone})
 
 		case configs := <-router.pushConfigsC:
-			state.PushConfigs(configs)
+			router.applyWrite(state, &routerWrite{Configs: configs})
+
+		case horizon := <-router.collectC:
+			state.Configs.GC(horizon)
+
+		case write := <-router.writeC:
+			router.applyWrite(state, write)
+			writes = append(writes, write)
+
+		case sub := <-router.watchC:
+			state.watch(sub)
+
+		case sub := <-router.unwatchC:
+			state.unwatch(sub)
 
 		default:
-			return
+			return writes
 
 		}
 	}
+
+	return writes
 }
 
 func (router *Router) error(err error, obj interface{}) {
-	if data, err := json.Marshal(obj); err == nil {
+	if data, jsonErr := json.Marshal(obj); jsonErr == nil {
 		klog.KPrintf(router.Name+".error", "%s -> %s", err.Error(), string(data))
 	} else {
-		log.Panic(err.Error())
+		log.Panic(jsonErr.Error())
 	}
 }
 
 type routerState struct {
 	Configs *Configs
 
-	// Only keyed is visible to the outside world is the only one that should be
-	// CoW-ed. Unfortunately, when we copy Keyed we also have to rebuild the
-	// Typed and Untyped fields because they will no longer point to the current
-	// Configurable.
+	// Only keyed is visible to the outside world and is the only one that
+	// should be CoW-ed. The typed and untyped fields refer to the objects by
+	// key so that they can be shared between copies and objects are only
+	// copied when an event is routed to them. owned contains the keys of the
+	// objects that were copied or registered since the state was copied and
+	// can therefore be mutated.
 	KeyedStates   map[string]Configurable
-	typedStates   map[string][]Configurable
-	untypedStates []Configurable
-
-	// Read-only
+	typedStates   map[string][]string
+	untypedStates []string
+	owned         map[string]bool
+
+	// watchers is shared between copies and is never modified in place.
+	watchers []*Subscription
+
+	// pending contains the notifications of the handlers and subscriptions
+	// that are deferred until the end of a transaction. Only set for states
+	// returned by begin.
+	pending *[]func(*routerState)
+
+	// The handlers are shared between copies and are never modified in place.
+	// keyedHandlers only contains the handlers registered via
+	// RegisterHandler.
+	keyedHandlers   map[string]Handler
 	untypedHandlers []Handler
 	typedHandlers   map[string][]Handler
 }
@@ -366,7 +783,8 @@ func newRouterState(configs *Configs, handlers []Handler) *routerState {
 	state := &routerState{
 		Configs:       configs,
 		KeyedStates:   make(map[string]Configurable),
-		typedStates:   make(map[string][]Configurable),
+		typedStates:   make(map[string][]string),
+		owned:         make(map[string]bool),
 		typedHandlers: make(map[string][]Handler),
 	}
 
@@ -389,24 +807,191 @@ func newRouterState(configs *Configs, handlers []Handler) *routerState {
 	return state
 }
 
+// Copy returns a copy of the state which shares its objects with the original
+// state. Objects are copied by mutable the first time they're mutated.
 func (state *routerState) Copy() *routerState {
 	newState := &routerState{
 		Configs: state.Configs.Copy(),
 
-		KeyedStates: make(map[string]Configurable),
-		typedStates: make(map[string][]Configurable),
+		KeyedStates:   make(map[string]Configurable, len(state.KeyedStates)),
+		typedStates:   make(map[string][]string, len(state.typedStates)),
+		untypedStates: state.untypedStates,
+		owned:         make(map[string]bool),
+		watchers:      state.watchers,
 
+		keyedHandlers:   state.keyedHandlers,
 		untypedHandlers: state.untypedHandlers,
 		typedHandlers:   state.typedHandlers,
 	}
 
-	for key, state := range state.KeyedStates {
-		newState.registerState(key, state.Copy(), false)
+	for key, obj := range state.KeyedStates {
+		newState.KeyedStates[key] = obj
+	}
+
+	for typ, keys := range state.typedStates {
+		newState.typedStates[typ] = keys
 	}
 
 	return newState
 }
 
+// begin returns a copy of the state to which an event can be applied and later
+// either discarded or applied to the state via end. Objects owned by the state
+// are copied again when mutated since they must be left untouched if the copy
+// is discarded.
+func (state *routerState) begin() *routerState {
+	tx := state.Copy()
+	tx.pending = new([]func(*routerState))
+	return tx
+}
+
+// end replaces the content of the state by the content of the transaction and
+// delivers the deferred notifications.
+func (state *routerState) end(tx *routerState) {
+	owned := state.owned
+	for key := range tx.owned {
+		owned[key] = true
+	}
+
+	pending := *tx.pending
+
+	*state = *tx
+	state.owned = owned
+	state.pending = nil
+
+	for _, notify := range pending {
+		notify(state)
+	}
+}
+
+// notify delivers the notifications of the handlers and subscriptions unless
+// they are deferred until the end of a transaction.
+func (state *routerState) notify(fn func(*routerState)) {
+	if state.pending != nil {
+		*state.pending = append(*state.pending, fn)
+	} else {
+		fn(state)
+	}
+}
+
+// mutable returns the object of the given key after copying it if it's still
+// shared with a previous state.
+func (state *routerState) mutable(key string) Configurable {
+	obj := state.KeyedStates[key]
+
+	if !state.owned[key] {
+		obj = obj.Copy()
+		state.KeyedStates[key] = obj
+		state.owned[key] = true
+	}
+
+	return obj
+}
+
+// copyHandlers replaces the handler maps by copies that can be modified.
+func (state *routerState) copyHandlers() {
+	keyed := make(map[string]Handler, len(state.keyedHandlers)+1)
+	for key, handler := range state.keyedHandlers {
+		keyed[key] = handler
+	}
+	state.keyedHandlers = keyed
+
+	typed := make(map[string][]Handler, len(state.typedHandlers))
+	for typ, handlers := range state.typedHandlers {
+		typed[typ] = handlers
+	}
+	state.typedHandlers = typed
+}
+
+func (state *routerState) registerHandler(key string, handler Handler, replay bool) {
+	if _, ok := state.keyedHandlers[key]; ok {
+		log.Panicf("handler '%s' was already registered in Router", key)
+	}
+
+	state.copyHandlers()
+	state.keyedHandlers[key] = handler
+
+	var types []string
+	if routable, ok := handler.(Routable); ok {
+		types = routable.AllowedConfigTypes()
+	}
+
+	if len(types) == 0 {
+		state.untypedHandlers = appendHandler(state.untypedHandlers, handler)
+	} else {
+		for _, typ := range types {
+			state.typedHandlers[typ] = appendHandler(state.typedHandlers[typ], handler)
+		}
+	}
+
+	if !replay {
+		return
+	}
+
+	_, isSelectable := selectorOf(handler)
+
+	for typ, configs := range state.Configs.Types {
+		if len(types) > 0 && !containsString(types, typ) {
+			continue
+		}
+
+		for _, config := range configs.ConfigArray() {
+			if selects(handler, config) {
+				handler.NewConfig(config)
+			}
+		}
+
+		if !isSelectable {
+			for _, tombstone := range configs.TombstoneArray() {
+				handler.DeadConfig(tombstone)
+			}
+		}
+	}
+}
+
+func (state *routerState) unregisterHandler(target string) {
+	targetHandler, ok := state.keyedHandlers[target]
+	assertf(ok, "handler '%s' was not registered in Router", target)
+
+	state.copyHandlers()
+	delete(state.keyedHandlers, target)
+
+	removeTarget := func(list []Handler) []Handler {
+		for i, handler := range list {
+			if handler == targetHandler {
+				result := make([]Handler, 0, len(list)-1)
+				result = append(result, list[0:i]...)
+				return append(result, list[(i+1):len(list)]...)
+			}
+		}
+		log.Panicf("unable to find handler for key '%s'", target)
+		return nil
+	}
+
+	var types []string
+	if routable, ok := targetHandler.(Routable); ok {
+		types = routable.AllowedConfigTypes()
+	}
+
+	if len(types) == 0 {
+		state.untypedHandlers = removeTarget(state.untypedHandlers)
+
+	} else {
+		for _, typ := range types {
+			state.typedHandlers[typ] = removeTarget(state.typedHandlers[typ])
+		}
+	}
+}
+
+func containsString(list []string, str string) bool {
+	for _, item := range list {
+		if item == str {
+			return true
+		}
+	}
+	return false
+}
+
 func (state *routerState) RegisterState(key string, obj Configurable) {
 	state.registerState(key, obj, true)
 }
@@ -416,6 +1001,7 @@ func (state *routerState) registerState(key string, obj Configurable, notify boo
 		log.Panicf("state '%s' was already registered in Router", key)
 	}
 	state.KeyedStates[key] = obj
+	state.owned[key] = true
 
 	var types []string
 	if routable, ok := obj.(Routable); ok {
@@ -423,19 +1009,23 @@ func (state *routerState) registerState(key string, obj Configurable, notify boo
 	}
 
 	if len(types) == 0 {
-		state.untypedStates = append(state.untypedStates, obj)
+		state.untypedStates = appendKey(state.untypedStates, key)
 		if notify {
 			for _, config := range state.Configs.ConfigArray() {
-				obj.NewConfig(config)
+				if selects(obj, config) {
+					obj.NewConfig(config)
+				}
 			}
 		}
 
 	} else {
 		for _, typ := range types {
-			state.typedStates[typ] = append(state.typedStates[typ], obj)
+			state.typedStates[typ] = appendKey(state.typedStates[typ], key)
 			if configs, ok := state.Configs.Types[typ]; notify && ok {
-				for _, config := range configs.Configs {
-					obj.NewConfig(config)
+				for _, config := range configs.ConfigArray() {
+					if selects(obj, config) {
+						obj.NewConfig(config)
+					}
 				}
 			}
 		}
@@ -447,11 +1037,14 @@ func (state *routerState) UnregisterState(target string) {
 	assertf(ok, "key '%s' was not registered in Router", target)
 
 	delete(state.KeyedStates, target)
-
-	removeTarget := func(list []Configurable) []Configurable {
-		for i, item := range list {
-			if item == targetObj {
-				return append(list[0:i], list[(i+1):len(list)]...)
+	delete(state.owned, target)
+
+	removeTarget := func(list []string) []string {
+		for i, key := range list {
+			if key == target {
+				result := make([]string, 0, len(list)-1)
+				result = append(result, list[0:i]...)
+				return append(result, list[(i+1):len(list)]...)
 			}
 		}
 		log.Panicf("unable to find object for key '%s'", target)
@@ -473,92 +1066,208 @@ func (state *routerState) UnregisterState(target string) {
 	}
 }
 
-func (state *routerState) NewConfig(config *Config) (err error) {
-	oldConfig, isNew := state.Configs.NewConfig(config)
+func (state *routerState) NewConfig(config *Config) error {
+	return state.newConfig(config).Err
+}
+
+func (state *routerState) newConfig(config *Config) (result RouterResult) {
+	hashes := make(dataHashes)
+
+	var conflict error
+	if current, ok := state.Configs.Get(config.Type, config.ID); ok && current.Config != nil {
+		if isConflict(current.Config, config, hashes) {
+			conflict = fmt.Errorf("conflicting configs of the same version: %s", config)
+		}
+	}
+
+	oldConfig, isNew := state.Configs.newConfig(config, hashes)
 	if !isNew {
+		result.Err = conflict
 		return
 	}
 
-	for _, handler := range state.untypedHandlers {
-		handler.NewConfig(config)
+	result.IsNew = true
+	if oldConfig != nil {
+		result.Replaced = []*Config{oldConfig}
 	}
 
-	if handlers, ok := state.typedHandlers[config.Type]; ok {
-		for _, handler := range handlers {
-			handler.NewConfig(config)
-		}
+	// Configs with version vectors can be merged with the existing config.
+	if current, _ := state.Configs.Get(config.Type, config.ID); current.Config != nil {
+		config = current.Config
 	}
 
-	var errors []error
+	state.notify(func(state *routerState) {
+		for _, handler := range state.untypedHandlers {
+			handlerNewConfig(handler, oldConfig, config)
+		}
 
-	for _, obj := range state.untypedStates {
-		if oldConfig != nil {
-			errors = appendError(errors, obj.DeadConfig(oldConfig))
+		if handlers, ok := state.typedHandlers[config.Type]; ok {
+			for _, handler := range handlers {
+				handlerNewConfig(handler, oldConfig, config)
+			}
 		}
-		errors = appendError(errors, obj.NewConfig(config))
+
+		state.watchNewConfig(oldConfig, config)
+	})
+
+	var errors []error
+
+	for _, key := range state.untypedStates {
+		errors = state.stateNewConfig(errors, key, oldConfig, config)
 	}
 
 	if typed, ok := state.typedStates[config.Type]; ok {
-		for _, obj := range typed {
-			if oldConfig != nil {
-				errors = appendError(errors, obj.DeadConfig(oldConfig))
-			}
-			errors = appendError(errors, obj.NewConfig(config))
+		for _, key := range typed {
+			errors = state.stateNewConfig(errors, key, oldConfig, config)
 		}
 	}
 
-	return combineErrors(errors...)
+	result.failed = len(errors) > 0
+	result.Err = combineErrors(appendError(errors, conflict)...)
+	return
+}
+
+// handlerNewConfig forwards a new config to the handler if the config is
+// selected by the handler. A config that is no longer selected is forwarded as
+// a tombstone if the previous config was selected.
+func handlerNewConfig(handler Handler, oldConfig, config *Config) {
+	if selects(handler, config) {
+		handler.NewConfig(config)
+	} else if oldConfig != nil && selects(handler, oldConfig) {
+		handler.DeadConfig(&Tombstone{Type: config.Type, ID: config.ID, Version: config.Version})
+	}
 }
 
-func (state *routerState) DeadConfig(tombstone *Tombstone) (err error) {
+// stateNewConfig replaces the old config by the new config in the object of
+// the given key where each is only applied if it's selected by the object. The
+// object is only copied if one of the configs is selected.
+func (state *routerState) stateNewConfig(errors []error, key string, oldConfig, config *Config) []error {
+	obj := state.KeyedStates[key]
+
+	if oldConfig != nil && selects(obj, oldConfig) {
+		errors = appendError(errors, state.mutable(key).DeadConfig(oldConfig))
+	}
+	if selects(obj, config) {
+		errors = appendError(errors, state.mutable(key).NewConfig(config))
+	}
+	return errors
+}
+
+// stateDeadConfig removes the old config from the object of the given key if
+// the config is selected by the object.
+func (state *routerState) stateDeadConfig(errors []error, key string, oldConfig *Config) []error {
+	if selects(state.KeyedStates[key], oldConfig) {
+		errors = appendError(errors, state.mutable(key).DeadConfig(oldConfig))
+	}
+	return errors
+}
+
+// appendKey returns the list with the key added at the end. The lists of the
+// router state and the histories of the configs are shared between copies so,
+// unlike append, the append helpers never write to the array of the given list
+// even if it has spare capacity.
+func appendKey(keys []string, key string) []string {
+	return append(keys[:len(keys):len(keys)], key)
+}
+
+// appendHandler is the equivalent of appendKey for lists of handlers.
+func appendHandler(handlers []Handler, handler Handler) []Handler {
+	return append(handlers[:len(handlers):len(handlers)], handler)
+}
+
+// appendWatcher is the equivalent of appendKey for lists of subscriptions.
+func appendWatcher(watchers []*Subscription, sub *Subscription) []*Subscription {
+	return append(watchers[:len(watchers):len(watchers)], sub)
+}
+
+// appendHistory is the equivalent of appendKey for histories.
+func appendHistory(history History, entry ConfigResult) History {
+	return append(history[:len(history):len(history)], entry)
+}
+
+// handlerDeadConfig forwards a tombstone to the handler unless the handler is
+// selectable and didn't select the killed config.
+func handlerDeadConfig(handler Handler, oldConfig *Config, tombstone *Tombstone) {
+	if _, ok := selectorOf(handler); !ok || (oldConfig != nil && selects(handler, oldConfig)) {
+		handler.DeadConfig(tombstone)
+	}
+}
+
+func (state *routerState) DeadConfig(tombstone *Tombstone) error {
+	return state.deadConfig(tombstone).Err
+}
+
+func (state *routerState) deadConfig(tombstone *Tombstone) (result RouterResult) {
 	oldConfig, isNew := state.Configs.DeadConfig(tombstone)
 	if !isNew {
 		return
 	}
 
-	for _, handler := range state.untypedHandlers {
-		handler.DeadConfig(tombstone)
-	}
+	result.IsNew = true
 
-	if handlers, ok := state.typedHandlers[tombstone.Type]; ok {
-		for _, handler := range handlers {
-			handler.DeadConfig(tombstone)
+	state.notify(func(state *routerState) {
+		for _, handler := range state.untypedHandlers {
+			handlerDeadConfig(handler, oldConfig, tombstone)
+		}
+
+		if handlers, ok := state.typedHandlers[tombstone.Type]; ok {
+			for _, handler := range handlers {
+				handlerDeadConfig(handler, oldConfig, tombstone)
+			}
 		}
-	}
+
+		state.watchDeadConfig(oldConfig, tombstone)
+	})
 
 	if oldConfig == nil {
 		return
 	}
 
+	result.Replaced = []*Config{oldConfig}
+
 	var errors []error
 
-	for _, obj := range state.untypedStates {
-		errors = appendError(errors, obj.DeadConfig(oldConfig))
+	for _, key := range state.untypedStates {
+		errors = state.stateDeadConfig(errors, key, oldConfig)
 	}
 
 	if typed, ok := state.typedStates[tombstone.Type]; ok {
-		for _, obj := range typed {
-			errors = appendError(errors, obj.DeadConfig(oldConfig))
+		for _, key := range typed {
+			errors = state.stateDeadConfig(errors, key, oldConfig)
 		}
 	}
 
-	return combineErrors(errors...)
+	result.failed = len(errors) > 0
+	result.Err = combineErrors(errors...)
+	return
 }
 
-func (state *routerState) PushConfigs(configs *Configs) (err error) {
+func (state *routerState) PushConfigs(configs *Configs) error {
+	return state.pushConfigs(configs).Err
+}
+
+func (state *routerState) pushConfigs(configs *Configs) (result RouterResult) {
 	var errors []error
 
+	add := func(other RouterResult) {
+		result.IsNew = result.IsNew || other.IsNew
+		result.Replaced = append(result.Replaced, other.Replaced...)
+		result.failed = result.failed || other.failed
+		errors = appendError(errors, other.Err)
+	}
+
 	for _, typed := range configs.Types {
-		for _, config := range typed.Configs {
-			errors = appendError(errors, state.NewConfig(config))
+		for _, config := range typed.ConfigArray() {
+			add(state.newConfig(config))
 		}
 
-		for _, tombstone := range typed.Tombstones {
-			errors = appendError(errors, state.DeadConfig(tombstone))
+		for _, tombstone := range typed.TombstoneArray() {
+			add(state.deadConfig(tombstone))
 		}
 	}
 
-	return combineErrors(errors...)
+	result.Err = combineErrors(errors...)
+	return
 }
 
 func init() {
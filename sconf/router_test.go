@@ -5,6 +5,7 @@ package sconf
 import (
 	"github.com/datacratic/goset"
 
+	"fmt"
 	"sync/atomic"
 	"testing"
 	"time"
@@ -178,18 +179,16 @@ func (test TestRouterUtils) Run(title string, in *Router, out *TestHandler) {
 	configs := &Configs{
 		Types: map[string]*TypeConfigs{
 			TestConfigType: &TypeConfigs{
-				Configs: map[string]*Config{
-					"c1": test.Config("c1", 0),
-					"c4": test.Config("c4", 1),
-					"c5": test.Config("c5", 2),
-					"c9": test.Config("c9", 1),
-				},
-				Tombstones: map[string]*Tombstone{
-					"c6":  test.Tomb("c6", 0),
-					"c7":  test.Tomb("c7", 1),
-					"c8":  test.Tomb("c8", 2),
-					"c10": test.Tomb("c10", 1),
-				},
+				Configs: ConfigMap{}.
+					Set(test.Config("c1", 0)).
+					Set(test.Config("c4", 1)).
+					Set(test.Config("c5", 2)).
+					Set(test.Config("c9", 1)),
+				Tombstones: TombstoneMap{}.
+					Set(test.Tomb("c6", 0)).
+					Set(test.Tomb("c7", 1)).
+					Set(test.Tomb("c8", 2)).
+					Set(test.Tomb("c10", 1)),
 			},
 		},
 	}
@@ -222,6 +221,45 @@ func TestRouterHandlers(t *testing.T) {
 	test.Run("push-local", router, handler)
 }
 
+type TestRoutableHandler struct {
+	*TestHandler
+	Types []string
+}
+
+func (h *TestRoutableHandler) AllowedConfigTypes() []string { return h.Types }
+
+func TestRouterRegisterHandler(t *testing.T) {
+	test := NewTestRouterUtils(t)
+
+	router := &Router{}
+	router.NewConfig(test.ConfigT("t1", "c0", 1))
+	router.NewConfig(test.ConfigT("t2", "c1", 1))
+	router.DeadConfig(test.TombT("t2", "c2", 1))
+	test.WaitForPropagation()
+
+	h0 := test.NewHandler()
+	router.RegisterHandler("h0", h0, true)
+	h0.ExpectNew(test.ConfigT("t1", "c0", 1), test.ConfigT("t2", "c1", 1))
+	h0.ExpectDead(test.ConfigT("t2", "c2", 1))
+
+	h1 := &TestRoutableHandler{test.NewHandler(), []string{"t2"}}
+	router.RegisterHandler("h1", h1, false)
+	h1.ExpectNew()
+
+	router.NewConfig(test.ConfigT("t1", "c0", 2))
+	router.NewConfig(test.ConfigT("t2", "c1", 2))
+	h0.ExpectNew(test.ConfigT("t1", "c0", 2), test.ConfigT("t2", "c1", 2))
+	h1.ExpectNew(test.ConfigT("t2", "c1", 2))
+
+	router.UnregisterHandler("h1")
+	router.UnregisterHandler("h0")
+	router.DeadConfig(test.TombT("t2", "c1", 3))
+	test.WaitForPropagation()
+
+	h0.ExpectDead()
+	h1.ExpectDead()
+}
+
 type TestConfigurable struct {
 	T TestRouterUtils
 
@@ -348,3 +386,205 @@ func TestRouterConfigurable(t *testing.T) {
 	o2.Expect("s4", []string{}, []string{}, true)
 	o3.Expect("s4", []string{"c3"}, []string{"c3"}, true)
 }
+
+func TestRouterLazyCopy(t *testing.T) {
+	test := NewTestRouterUtils(t)
+
+	o1 := test.NewConfigurable("o1", "t1")
+	o2 := test.NewConfigurable("o2", "t2")
+
+	router := new(Router)
+	o1.RegisterState(router)
+	o2.RegisterState(router)
+
+	router.NewConfigSync(test.ConfigT("t1", "c1", 1))
+	router.NewConfigSync(test.ConfigT("t1", "c2", 1))
+
+	o1.Expect("t1", []string{"c1", "c2"}, []string{}, true)
+	o2.Expect("t1", []string{}, []string{}, false)
+
+	if copies := atomic.LoadInt32(&o2.copies); copies != 0 {
+		t.Errorf("FAIL(t1): unexpected copies of o2: %d", copies)
+	}
+
+	router.DeadConfigSync(test.ConfigT("t2", "c3", 1).Tombstone())
+
+	if copies := atomic.LoadInt32(&o2.copies); copies != 0 {
+		t.Errorf("FAIL(t2): unexpected copies of o2: %d", copies)
+	}
+
+	router.NewConfigSync(test.ConfigT("t2", "c3", 2))
+	o2.Expect("t2", []string{"c3"}, []string{}, true)
+}
+
+func TestRouterConflict(t *testing.T) {
+	test := NewTestRouterUtils(t)
+
+	handler := test.NewHandler()
+	router := test.NewRouter(handler)
+
+	a := (&TestConfig{Data: "a"}).Wrap("c0", 1)
+	b := (&TestConfig{Data: "b"}).Wrap("c0", 1)
+
+	winner := a
+	if b.wins(a, nil) {
+		winner = b
+	}
+
+	router.NewConfig(a)
+	test.WaitForPropagation()
+	router.NewConfig(b)
+	test.WaitForPropagation()
+
+	if result, _ := router.PullConfigs().Get(TestConfigType, "c0"); result.Config != winner {
+		t.Errorf("FAIL(conflict): unexpected winner: %v", result.Config.Data)
+	}
+}
+
+type TestFailingConfigurable struct{}
+
+func (obj TestFailingConfigurable) Copy() Configurable { return obj }
+
+func (obj TestFailingConfigurable) NewConfig(newConfig *Config) error {
+	if newConfig.ID == "fail" {
+		return fmt.Errorf("rejected config %s", newConfig.ID)
+	}
+	return nil
+}
+
+func (obj TestFailingConfigurable) DeadConfig(oldConfig *Config) error { return nil }
+
+func TestRouterSync(t *testing.T) {
+	test := NewTestRouterUtils(t)
+
+	router := &Router{States: map[string]Configurable{"fail": TestFailingConfigurable{}}}
+
+	expect := func(title string, result RouterResult, isNew bool, replaced []*Config, fail bool) {
+		if result.IsNew != isNew {
+			t.Errorf("FAIL(%s): unexpected new %t != %t", title, result.IsNew, isNew)
+		}
+		test.Diff(title, result.Replaced, replaced...)
+		if (result.Err != nil) != fail {
+			t.Errorf("FAIL(%s): unexpected error: %v", title, result.Err)
+		}
+	}
+
+	c0 := test.Config("c0", 1)
+	expect("new", router.NewConfigSync(c0), true, nil, false)
+
+	// The state must be visible as soon as the call returns.
+	if result, _ := router.PullConfigs().Get(TestConfigType, "c0"); result.Config != c0 {
+		t.Errorf("FAIL(visible): unexpected config %v", result.Config)
+	}
+
+	expect("old", router.NewConfigSync(test.Config("c0", 1)), false, nil, false)
+	expect("replace", router.NewConfigSync(test.Config("c0", 2)), true, []*Config{c0}, false)
+	expect("error", router.NewConfigSync(test.Config("fail", 1)), true, nil, true)
+	expect("dead", router.DeadConfigSync(test.Tomb("c0", 3)), true, []*Config{test.Config("c0", 2)}, false)
+
+	configs := &Configs{}
+	configs.NewConfig(test.Config("c1", 1))
+	configs.NewConfig(test.Config("fail", 2))
+	configs.DeadConfig(test.Tomb("c0", 1))
+	expect("push", router.PushConfigsSync(configs), true, []*Config{test.Config("fail", 1)}, true)
+	router.Expect(test, test.Config("c1", 1), test.Config("fail", 2))
+}
+
+type TestMapConfigurable map[string]uint64
+
+func (obj TestMapConfigurable) Copy() Configurable {
+	result := make(TestMapConfigurable)
+	for ID, version := range obj {
+		result[ID] = version
+	}
+	return result
+}
+
+func (obj TestMapConfigurable) NewConfig(newConfig *Config) error {
+	obj[newConfig.ID] = newConfig.Version
+	return nil
+}
+
+func (obj TestMapConfigurable) DeadConfig(oldConfig *Config) error {
+	delete(obj, oldConfig.ID)
+	return nil
+}
+
+func TestRouterTransactional(t *testing.T) {
+	test := NewTestRouterUtils(t)
+
+	rejectC := make(chan interface{}, 10)
+	handler := test.NewHandler()
+
+	router := &Router{
+		Handlers:      []Handler{handler},
+		States:        map[string]Configurable{"fail": TestFailingConfigurable{}, "map": TestMapConfigurable{}},
+		Transactional: true,
+		RejectHandler: func(obj interface{}, err error) { rejectC <- obj },
+	}
+	sub := router.Watch(WatchOptions{})
+
+	expectState := func(title string, exp ...string) {
+		state := router.State().States["map"].(TestMapConfigurable)
+		if len(state) != len(exp) {
+			t.Errorf("FAIL(%s): unexpected state %v", title, state)
+		}
+		for _, ID := range exp {
+			if _, ok := state[ID]; !ok {
+				t.Errorf("FAIL(%s): missing %s in state %v", title, ID, state)
+			}
+		}
+	}
+
+	expectReject := func(title string, exp interface{}) {
+		select {
+		case obj := <-rejectC:
+			if obj != exp {
+				t.Errorf("FAIL(%s): unexpected rejection %v", title, obj)
+			}
+		case <-time.After(100 * time.Millisecond):
+			t.Errorf("FAIL(%s): missing rejection", title)
+		}
+	}
+
+	c0 := test.Config("c0", 1)
+	if result := router.NewConfigSync(c0); result.Rejected || result.Err != nil {
+		t.Errorf("FAIL(new): unexpected result %v", result)
+	}
+	handler.ExpectNew(c0)
+	sub.Expect(t, "new", "new:c0:1")
+	expectState("new", "c0")
+
+	fail := test.Config("fail", 1)
+	if result := router.NewConfigSync(fail); !result.Rejected || result.Err == nil || result.IsNew {
+		t.Errorf("FAIL(reject): unexpected result %v", result)
+	}
+	expectReject("reject", fail)
+	handler.ExpectNew()
+	sub.Expect(t, "reject")
+	expectState("reject", "c0")
+	router.Expect(test, c0)
+
+	configs := &Configs{}
+	configs.NewConfig(test.Config("c1", 1))
+	configs.NewConfig(test.Config("fail", 2))
+	configs.DeadConfig(test.Tomb("c0", 2))
+
+	if result := router.PushConfigsSync(configs); !result.Rejected || len(result.Replaced) > 0 {
+		t.Errorf("FAIL(push): unexpected result %v", result)
+	}
+	expectReject("push", configs)
+	handler.ExpectNew()
+	handler.ExpectDead()
+	sub.Expect(t, "push")
+	expectState("push", "c0")
+	router.Expect(test, c0)
+
+	fail = test.Config("fail", 3)
+	router.NewConfig(fail)
+	router.NewConfig(test.Config("c1", 1))
+	handler.ExpectNew(test.Config("c1", 1))
+	expectReject("async", fail)
+	expectState("async", "c0", "c1")
+	router.Expect(test, c0, test.Config("c1", 1))
+}
@@ -0,0 +1,100 @@
+// Copyright (c) 2014 Datacratic. All rights reserved.
+
+package sconf
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+)
+
+// Upgrade transforms the JSON encoded data of a config from one schema version
+// to the next.
+type Upgrade func(data json.RawMessage) (json.RawMessage, error)
+
+// Schema is a TypeOption which sets the current schema version of a config type
+// along with the chain of upgrades used to transform the data of configs
+// written with an older schema version. Upgrades[i] transforms the data from
+// version i to version i+1 such that the number of upgrades must be equal to
+// the version. Configs created before the type had a schema have version 0.
+//
+// The schema version is written along with the data of a config and the
+// upgrades are applied whenever a config is decoded which includes
+// Config.UnmarshalJSON, loading a config database and the configs received by
+// an HTTPEndpoint. The schema is specific to the registry such that the same
+// runtime type can be registered with different schemas in different
+// registries. The data of a config whose schema version is newer then the
+// registered version is kept as a json.RawMessage, as with
+// TypeRegistry.Passthrough, which allows nodes that weren't upgraded yet to
+// relay the config during a rolling upgrade. Decoding such a config via
+// Config.Decode fails. Stored configs can be rewritten with the newest schema
+// via AOFConfigDB.Compact.
+type Schema struct {
+	Version  int
+	Upgrades []Upgrade
+}
+
+func (schema Schema) applyType(name string, entry *registeredType) {
+	if entry.schema.Version > 0 {
+		log.Panicf("multiple schemas for config type '%s'", name)
+	}
+
+	if schema.Version < 0 || len(schema.Upgrades) != schema.Version {
+		log.Panicf("schema version %d of config type '%s' requires %d upgrades, got %d",
+			schema.Version, name, schema.Version, len(schema.Upgrades))
+	}
+
+	entry.schema = schema
+}
+
+// upgrade applies the upgrades required to bring data of the given schema
+// version to the current version.
+func (schema Schema) upgrade(name string, version int, data json.RawMessage) (json.RawMessage, error) {
+	if version > schema.Version {
+		return nil, &newerSchemaError{name, version, schema.Version}
+	}
+
+	for ; version < schema.Version; version++ {
+		var err error
+		if data, err = schema.Upgrades[version](data); err != nil {
+			return nil, fmt.Errorf("unable to upgrade config type '%s' to schema version %d: %s", name, version+1, err)
+		}
+	}
+
+	return data, nil
+}
+
+// newerSchemaError is returned when decoding data whose schema version is newer
+// then the version registered for its type.
+type newerSchemaError struct {
+	name    string
+	version int
+	current int
+}
+
+func (err *newerSchemaError) Error() string {
+	return fmt.Sprintf("schema version %d of config type '%s' is newer then %d", err.version, err.name, err.current)
+}
+
+// stamp returns the config with its schema version set to the current version
+// of its type in the registry. Decoded data is always of the current version
+// while raw data keeps the version it was received with. Returns the config
+// itself if the version is already set or if the type isn't registered.
+func (registry *TypeRegistry) stamp(config *Config) *Config {
+	if config.Data == nil {
+		return config
+	}
+
+	if _, isRaw := config.Data.(json.RawMessage); isRaw {
+		return config
+	}
+
+	entry, ok := registry.lookup(config.Type)
+	if !ok || entry.schema.Version == config.Schema {
+		return config
+	}
+
+	stamped := *config
+	stamped.Schema = entry.schema.Version
+	return &stamped
+}
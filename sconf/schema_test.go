@@ -0,0 +1,157 @@
+// Copyright (c) 2014 Datacratic. All rights reserved.
+
+package sconf
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+)
+
+const TestSchemaConfigType string = "test-schema"
+
+// TestSchemaConfig was {"name": string} at version 0 and {"data": string} at
+// version 1.
+type TestSchemaConfig struct {
+	Data  string `json:"data"`
+	Count int    `json:"count"`
+}
+
+func NewTestSchemaRegistry() *TypeRegistry {
+	rename := func(data json.RawMessage) (json.RawMessage, error) {
+		var old struct {
+			Name string `json:"name"`
+		}
+		if err := json.Unmarshal(data, &old); err != nil {
+			return nil, err
+		}
+		return json.Marshal(map[string]string{"data": old.Name})
+	}
+
+	count := func(data json.RawMessage) (json.RawMessage, error) {
+		var value map[string]interface{}
+		if err := json.Unmarshal(data, &value); err != nil {
+			return nil, err
+		}
+		value["count"] = 1
+		return json.Marshal(value)
+	}
+
+	registry := &TypeRegistry{}
+	registry.Register(TestSchemaConfigType, reflect.TypeOf(TestSchemaConfig{}), Schema{2, []Upgrade{rename, count}})
+	return registry
+}
+
+func TestSchemaUpgrade(t *testing.T) {
+	registry := NewTestSchemaRegistry()
+
+	tests := []struct {
+		Body string
+		Exp  TestSchemaConfig
+	}{
+		{`{"type":"test-schema","id":"c0","ver":1,"data":{"name":"a"}}`, TestSchemaConfig{"a", 1}},
+		{`{"type":"test-schema","id":"c0","ver":1,"data":{"data":"b"},"schema":1}`, TestSchemaConfig{"b", 1}},
+		{`{"type":"test-schema","id":"c0","ver":1,"data":{"data":"c","count":2},"schema":2}`, TestSchemaConfig{"c", 2}},
+	}
+
+	for _, test := range tests {
+		config := &Config{}
+		if err := registry.Unmarshal([]byte(test.Body), config); err != nil {
+			t.Errorf("FAIL(%s): unexpected error: %s", test.Body, err)
+			continue
+		}
+
+		if data := config.Data.(*TestSchemaConfig); *data != test.Exp {
+			t.Errorf("FAIL(%s): unexpected data %v != %v", test.Body, *data, test.Exp)
+		}
+
+		if config.Schema != 2 {
+			t.Errorf("FAIL(%s): unexpected schema %d != 2", test.Body, config.Schema)
+		}
+	}
+
+	// Configs of a newer schema are kept as raw data.
+	future := `{"type":"test-schema","id":"c0","ver":1,"data":{"data":"e"},"schema":3}`
+	configs := &Configs{}
+	if err := registry.Unmarshal([]byte(`{"Types":{"test-schema":{"live":[`+future+`]}}}`), configs); err != nil {
+		t.Errorf("FAIL(future): unexpected error: %s", err)
+	} else if result, _ := configs.Get(TestSchemaConfigType, "c0"); result.Config == nil {
+		t.Errorf("FAIL(future): missing config")
+	} else if _, isRaw := result.Config.Data.(json.RawMessage); !isRaw || result.Config.Schema != 3 {
+		t.Errorf("FAIL(future): unexpected config %v", result.Config)
+	} else if _, err := registry.Decode(result.Config); err == nil {
+		t.Errorf("FAIL(future): expected decode error for newer schema")
+	}
+
+	// New configs are stamped with the current schema by the router.
+	router := &Router{Registry: registry}
+	router.NewConfigSync(&Config{Type: TestSchemaConfigType, ID: "c0", Version: 1, Data: &TestSchemaConfig{"d", 3}})
+
+	result, _ := router.PullConfigs().Get(TestSchemaConfigType, "c0")
+	body, _ := json.Marshal(result.Config)
+	if !bytes.Contains(body, []byte(`"schema":2`)) {
+		t.Errorf("FAIL(marshal): missing schema version in '%s'", body)
+	}
+}
+
+func TestSchemaRegistries(t *testing.T) {
+	// The same runtime type can have a different schema in each registry.
+	other := &TypeRegistry{}
+	other.Register(TestSchemaConfigType, reflect.TypeOf(TestSchemaConfig{}))
+
+	registry := NewTestSchemaRegistry()
+
+	config := &Config{Type: TestSchemaConfigType, ID: "c0", Version: 1, Data: &TestSchemaConfig{"a", 1}}
+	if stamped := other.stamp(config); stamped.Schema != 0 {
+		t.Errorf("FAIL(other): unexpected schema %d != 0", stamped.Schema)
+	}
+	if stamped := registry.stamp(config); stamped.Schema != 2 {
+		t.Errorf("FAIL(registry): unexpected schema %d != 2", stamped.Schema)
+	}
+
+	body := `{"type":"test-schema","id":"c0","ver":1,"data":{"data":"b"}}`
+	if err := other.Unmarshal([]byte(body), config); err != nil || config.Schema != 0 {
+		t.Errorf("FAIL(decode): unexpected result %v %v", config, err)
+	}
+}
+
+func TestSchemaPersist(t *testing.T) {
+	test := NewConfigPersistUtilsTest(t)
+
+	file := test.NewFile()
+	defer os.Remove(file)
+
+	// Write configs of the original schema by relaying their raw data.
+	old := &AOFConfigDB{File: file, Registry: &TypeRegistry{Passthrough: true}}
+	old.NewConfig(&Config{Type: TestSchemaConfigType, ID: "c0", Version: 1, Data: json.RawMessage(`{"name":"a"}`)})
+	old.Close()
+
+	db := &AOFConfigDB{File: file, Registry: NewTestSchemaRegistry()}
+	defer db.Close()
+
+	configs, err := db.Load()
+	if err != nil {
+		t.Fatalf("FAIL(load): unable to load db: %s", err)
+	}
+
+	result, _ := configs.Get(TestSchemaConfigType, "c0")
+	if result.Config == nil || *result.Config.Data.(*TestSchemaConfig) != (TestSchemaConfig{"a", 1}) {
+		t.Fatalf("FAIL(load): unexpected config %v", result.Config)
+	}
+
+	if err := db.Compact(); err != nil {
+		t.Fatalf("FAIL(compact): unable to compact: %s", err)
+	}
+
+	body, err := ioutil.ReadFile(file)
+	if err != nil {
+		t.Fatalf("FAIL(compact): unable to read AOF: %s", err)
+	}
+
+	if bytes.Contains(body, []byte(`"name"`)) || !bytes.Contains(body, []byte(`"schema":2`)) {
+		t.Errorf("FAIL(compact): data wasn't rewritten '%s'", body)
+	}
+}
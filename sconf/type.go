@@ -3,38 +3,368 @@
 package sconf
 
 import (
+	"encoding/json"
 	"fmt"
 	"log"
 	"reflect"
+	"sync"
 )
 
-var typeRegistry map[string]reflect.Type
+// TypeRegistry associates config type names with the runtime types used to
+// decode the data of configs and with the Resolver used to collapse the
+// siblings of concurrent updates. A TypeRegistry can be attached to a Router,
+// HTTPEndpoint, HTTPClient or to any of the config databases to use a set of
+// types that is independent from DefaultTypeRegistry. The zero value is an empty registry
+// and a nil registry refers to DefaultTypeRegistry. All methods are safe to
+// call concurrently.
+type TypeRegistry struct {
+
+	// Passthrough indicates that the data of configs whose type wasn't
+	// registered should be kept as a json.RawMessage instead of failing to
+	// decode. The raw data is re-encoded as is which allows a node that only
+	// relays configs, an HTTPEndpoint backed by an AOFConfigDB for example, to
+	// do so without registering the types of the configs. The raw data can
+	// later be decoded via Config.Decode once the type is registered. Should be
+	// set before any config is decoded with the registry.
+	Passthrough bool
+
+	mutex sync.RWMutex
+	types map[string]*registeredType
+}
+
+// DefaultTypeRegistry is the registry used by RegisterType and NewConfig and by
+// all the components that don't have a registry attached.
+var DefaultTypeRegistry = &TypeRegistry{}
+
+func (registry *TypeRegistry) orDefault() *TypeRegistry {
+	if registry == nil {
+		return DefaultTypeRegistry
+	}
+	return registry
+}
 
 // RegisterType associates the config type name with the given runtime
-// reflected type. This is used to unmarshal config object based on the type
-// name.
-func RegisterType(name string, typ reflect.Type) {
-	if typeRegistry == nil {
-		typeRegistry = make(map[string]reflect.Type)
+// reflected type in DefaultTypeRegistry. See TypeRegistry.Register for more
+// details.
+func RegisterType(name string, typ reflect.Type, options ...TypeOption) {
+	DefaultTypeRegistry.Register(name, typ, options...)
+}
+
+// NewConfig creates a new config object for the given config type name
+// registered via the RegisterType function.
+func NewConfig(name string) (interface{}, error) {
+	return DefaultTypeRegistry.NewConfig(name)
+}
+
+// TypeOption is an optional setting of a type registered via Register. Resolver
+// and Schema are the available options.
+type TypeOption interface {
+	applyType(name string, entry *registeredType)
+}
+
+type registeredType struct {
+	typ      reflect.Type
+	resolver Resolver
+	schema   Schema
+}
+
+func (resolver Resolver) applyType(name string, entry *registeredType) {
+	if entry.resolver != nil {
+		log.Panicf("multiple resolvers for config type '%s'", name)
 	}
+	entry.resolver = resolver
+}
+
+// Register associates the config type name with the given runtime reflected
+// type. This is used to unmarshal config object based on the type name. An
+// optional Resolver can be provided to collapse the siblings of concurrent
+// updates to configs with version vectors and an optional Schema can be
+// provided to upgrade the data of older configs. Panics if the type name was
+// already registered with the registry.
+func (registry *TypeRegistry) Register(name string, typ reflect.Type, options ...TypeOption) {
+	registry = registry.orDefault()
 
 	if typ.Kind() == reflect.Ptr {
 		log.Panicf("config type for '%s' should not be a pointer", name)
 	}
 
-	if _, ok := typeRegistry[name]; ok {
+	entry := &registeredType{typ: typ}
+	for _, option := range options {
+		option.applyType(name, entry)
+	}
+
+	registry.mutex.Lock()
+	defer registry.mutex.Unlock()
+
+	if registry.types == nil {
+		registry.types = make(map[string]*registeredType)
+	}
+
+	if _, ok := registry.types[name]; ok {
 		log.Panicf("duplicated config registration of type '%s'", name)
 	}
 
-	typeRegistry[name] = typ
+	registry.types[name] = entry
 }
 
 // NewConfig creates a new config object for the given config type name
-// registered via the RegisterType function.
-func NewConfig(name string) (interface{}, error) {
-	if typ, ok := typeRegistry[name]; ok {
-		return reflect.New(typ).Interface(), nil
+// registered via the Register function.
+func (registry *TypeRegistry) NewConfig(name string) (interface{}, error) {
+	if entry, ok := registry.lookup(name); ok {
+		return reflect.New(entry.typ).Interface(), nil
 	}
 
 	return nil, fmt.Errorf("unknown config type '%s'", name)
 }
+
+func (registry *TypeRegistry) lookup(name string) (*registeredType, bool) {
+	registry = registry.orDefault()
+
+	registry.mutex.RLock()
+	defer registry.mutex.RUnlock()
+
+	entry, ok := registry.types[name]
+	return entry, ok
+}
+
+func (registry *TypeRegistry) resolver(name string) Resolver {
+	if entry, ok := registry.lookup(name); ok {
+		return entry.resolver
+	}
+	return nil
+}
+
+// Decode returns a copy of the config where data kept as a json.RawMessage is
+// upgraded to the current schema and decoded into the type registered with the
+// registry. Returns the config itself if its data doesn't need to be decoded
+// and an error if the type is not registered.
+func (registry *TypeRegistry) Decode(config *Config) (*Config, error) {
+	raw, isRaw := config.Data.(json.RawMessage)
+	if !isRaw && len(config.Siblings) == 0 {
+		return config, nil
+	}
+
+	result := *config
+
+	if isRaw {
+		var err error
+		if result.Data, result.Schema, err = registry.decodeData(config.Type, config.Schema, raw, false); err != nil {
+			return nil, err
+		}
+	}
+
+	if len(config.Siblings) > 0 {
+		result.Siblings = make([]*Config, len(config.Siblings))
+
+		for i, sibling := range config.Siblings {
+			var err error
+			if result.Siblings[i], err = registry.Decode(sibling); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return &result, nil
+}
+
+// Unmarshal deserializes the given json blob into the given object using the
+// registry to decode the data of the configs. Supports Config, TypeConfigs,
+// Configs, ConfigResult and History objects and defers to json.Unmarshal for
+// all other objects.
+func (registry *TypeRegistry) Unmarshal(body []byte, value interface{}) (err error) {
+	switch obj := value.(type) {
+
+	case *Config:
+		var raw configJSON
+		if err = json.Unmarshal(body, &raw); err != nil {
+			return
+		}
+
+		var config *Config
+		if config, err = registry.config(&raw); err == nil {
+			*obj = *config
+		}
+
+	case *TypeConfigs:
+		var raw typeConfigsJSON
+		if err = json.Unmarshal(body, &raw); err != nil {
+			return
+		}
+
+		obj.Registry = registry
+		err = registry.typeConfigs(&raw, obj)
+
+	case *Configs:
+		var raw struct{ Types map[string]*typeConfigsJSON }
+		if err = json.Unmarshal(body, &raw); err != nil {
+			return
+		}
+
+		obj.Registry = registry
+		obj.Types = make(map[string]*TypeConfigs)
+
+		for typ, rawTypeConfigs := range raw.Types {
+			state := &TypeConfigs{Registry: registry}
+			if err = registry.typeConfigs(rawTypeConfigs, state); err != nil {
+				return
+			}
+			obj.Types[typ] = state
+		}
+
+	case *ConfigResult:
+		var raw configResultJSON
+		if err = json.Unmarshal(body, &raw); err != nil {
+			return
+		}
+
+		*obj, err = registry.configResult(&raw)
+
+	case *History:
+		var raw []*configResultJSON
+		if err = json.Unmarshal(body, &raw); err != nil {
+			return
+		}
+
+		var history History
+		for _, rawEntry := range raw {
+			var entry ConfigResult
+			if entry, err = registry.configResult(rawEntry); err != nil {
+				return
+			}
+			history = append(history, entry)
+		}
+		*obj = history
+
+	default:
+		err = json.Unmarshal(body, value)
+	}
+
+	return
+}
+
+// configJSON is the JSON representation of a Config whose data is decoded
+// separately since its type is only known once the type name is decoded.
+type configJSON struct {
+	Type    string          `json:"type"`
+	ID      string          `json:"id"`
+	Version uint64          `json:"ver"`
+	Data    json.RawMessage `json:"data,omitempty"`
+	Schema  int             `json:"schema,omitempty"`
+
+	Labels   map[string]string `json:"labels,omitempty"`
+	Vector   VersionVector     `json:"vv,omitempty"`
+	Siblings []*configJSON     `json:"siblings,omitempty"`
+}
+
+// typeConfigsJSON is the JSON representation of a TypeConfigs object.
+type typeConfigsJSON struct {
+	Configs    []*configJSON `json:"live,omitempty"`
+	Tombstones []*Tombstone  `json:"dead,omitempty"`
+}
+
+// configResultJSON is the JSON representation of a ConfigResult object.
+type configResultJSON struct {
+	Config    *configJSON `json:"live,omitempty"`
+	Tombstone *Tombstone  `json:"dead,omitempty"`
+}
+
+func (registry *TypeRegistry) config(raw *configJSON) (config *Config, err error) {
+	config = &Config{
+		Type:    raw.Type,
+		ID:      raw.ID,
+		Version: raw.Version,
+		Schema:  raw.Schema,
+
+		Labels: raw.Labels,
+		Vector: raw.Vector,
+	}
+
+	for _, rawSibling := range raw.Siblings {
+		var sibling *Config
+		if sibling, err = registry.config(rawSibling); err != nil {
+			return nil, err
+		}
+		config.Siblings = append(config.Siblings, sibling)
+	}
+
+	if raw.Data != nil {
+		config.Data, config.Schema, err = registry.decodeData(raw.Type, raw.Schema, raw.Data, registry.orDefault().Passthrough)
+
+		// Data of a newer schema is relayed as is such that a single config
+		// can't prevent the others from being decoded.
+		if _, isNewer := err.(*newerSchemaError); isNewer {
+			config.Data, config.Schema, err = append(json.RawMessage(nil), raw.Data...), raw.Schema, nil
+		}
+
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return
+}
+
+func (registry *TypeRegistry) configResult(raw *configResultJSON) (result ConfigResult, err error) {
+	result.Tombstone = raw.Tombstone
+	if raw.Config != nil {
+		result.Config, err = registry.config(raw.Config)
+	}
+	return
+}
+
+func (registry *TypeRegistry) typeConfigs(raw *typeConfigsJSON, configs *TypeConfigs) error {
+	configs.digest = nil
+	configs.history = pmap{}
+
+	configs.Configs = ConfigMap{}
+	for _, rawConfig := range raw.Configs {
+		config, err := registry.config(rawConfig)
+		if err != nil {
+			return err
+		}
+
+		if _, ok := configs.Configs.Get(config.ID); ok {
+			return fmt.Errorf("duplicate config: %v", *config)
+		}
+
+		configs.Configs = configs.Configs.Set(config)
+	}
+
+	configs.Tombstones = TombstoneMap{}
+	for _, tombstone := range raw.Tombstones {
+		if _, ok := configs.Tombstones.Get(tombstone.ID); ok {
+			return fmt.Errorf("duplicate tombstone: %v", *tombstone)
+		}
+
+		configs.Tombstones = configs.Tombstones.Set(tombstone)
+	}
+
+	return nil
+}
+
+// decodeData upgrades the JSON encoded data of a config of the given type name
+// and schema version and decodes it as the registered type. Returns the data as
+// a json.RawMessage if the type isn't registered and passthrough is set. Also
+// returns the schema version of the returned data.
+func (registry *TypeRegistry) decodeData(name string, schema int, body json.RawMessage, passthrough bool) (interface{}, int, error) {
+	entry, ok := registry.lookup(name)
+	if !ok && passthrough {
+		return append(json.RawMessage(nil), body...), schema, nil
+	}
+
+	if !ok {
+		return nil, 0, fmt.Errorf("unknown config type '%s'", name)
+	}
+
+	body, err := entry.schema.upgrade(name, schema, body)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	data := reflect.New(entry.typ).Interface()
+	if err = json.Unmarshal(body, data); err != nil {
+		return nil, 0, err
+	}
+
+	return data, entry.schema.Version, nil
+}
@@ -0,0 +1,206 @@
+// Copyright (c) 2014 Datacratic. All rights reserved.
+
+package sconf
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"reflect"
+	"testing"
+)
+
+const TestOpaqueConfigType string = "test-opaque"
+
+func TestPassthrough(t *testing.T) {
+	test := NewConfigPersistUtilsTest(t)
+
+	body := []byte(`{"type":"test-opaque","id":"c0","ver":1,"data":{"b":[1,2],"a":"x"}}`)
+
+	config := &Config{}
+	if err := json.Unmarshal(body, config); err == nil {
+		t.Fatalf("FAIL(strict): expected error for unregistered type")
+	}
+
+	registry := &TypeRegistry{Passthrough: true}
+	if err := registry.Unmarshal(body, config); err != nil {
+		t.Fatalf("FAIL(decode): unexpected error: %s", err)
+	}
+
+	if result, err := json.Marshal(config); err != nil {
+		t.Errorf("FAIL(encode): unexpected error: %s", err)
+	} else if !bytes.Equal(result, body) {
+		t.Errorf("FAIL(encode): body doesn't round trip '%s' != '%s'", result, body)
+	}
+
+	router := &Router{Registry: registry}
+	router.NewConfig(config)
+	NewTestRouterUtils(t).WaitForPropagation()
+
+	result, _ := router.PullConfigs().Get(TestOpaqueConfigType, "c0")
+	if result.Config != config {
+		t.Errorf("FAIL(router): unexpected config %v", result.Config)
+	}
+
+	file := test.NewFile()
+	defer os.Remove(file)
+
+	db0 := &AOFConfigDB{File: file, Registry: registry}
+	db0.NewConfig(config)
+	db0.Close()
+
+	db1 := &AOFConfigDB{File: file, Registry: registry}
+	defer db1.Close()
+
+	configs, err := db1.Load()
+	if err != nil {
+		t.Fatalf("FAIL(aof): unable to load db: %s", err)
+	}
+
+	result, _ = configs.Get(TestOpaqueConfigType, "c0")
+	if result.Config == nil || IsConflict(result.Config, config) {
+		t.Errorf("FAIL(aof): unexpected config %v", result.Config)
+	}
+
+	// Registered types are still decoded.
+	typed := &Config{}
+	if err := json.Unmarshal([]byte(`{"type":"test","id":"c0","ver":1,"data":{"data":"d0"}}`), typed); err != nil {
+		t.Errorf("FAIL(typed): unexpected error: %s", err)
+	} else if _, ok := typed.Data.(*TestConfig); !ok {
+		t.Errorf("FAIL(typed): unexpected data %T", typed.Data)
+	}
+}
+
+func TestConfigDecode(t *testing.T) {
+	raw := &Config{Type: TestConfigType, ID: "c0", Version: 1, Data: json.RawMessage(`{"data":"d0"}`)}
+	sibling := &Config{Type: TestConfigType, ID: "c0", Version: 2, Data: json.RawMessage(`{"data":"d1"}`)}
+	parent := &Config{Type: TestConfigType, ID: "c0", Version: 3, Siblings: []*Config{raw, sibling}}
+
+	config, err := raw.Decode()
+	if err != nil {
+		t.Fatalf("FAIL(decode): unexpected error: %s", err)
+	}
+
+	if data, ok := config.Data.(*TestConfig); !ok || data.Data != "d0" {
+		t.Errorf("FAIL(decode): unexpected data %v", config.Data)
+	}
+
+	if _, ok := raw.Data.(json.RawMessage); !ok {
+		t.Errorf("FAIL(decode): original config was modified")
+	}
+
+	if config, err = parent.Decode(); err != nil {
+		t.Fatalf("FAIL(siblings): unexpected error: %s", err)
+	}
+
+	if data, ok := config.Siblings[1].Data.(*TestConfig); !ok || data.Data != "d1" {
+		t.Errorf("FAIL(siblings): unexpected data %v", config.Siblings[1].Data)
+	}
+
+	opaque := &Config{Type: TestOpaqueConfigType, ID: "c0", Version: 1, Data: json.RawMessage(`{}`)}
+	if _, err := opaque.Decode(); err == nil {
+		t.Errorf("FAIL(unknown): expected error for unregistered type")
+	}
+}
+
+type TestOtherConfig struct {
+	Value int `json:"data"`
+}
+
+func TestTypeRegistry(t *testing.T) {
+	test := NewConfigPersistUtilsTest(t)
+
+	// The registry can reuse a type name of the default registry.
+	registry := &TypeRegistry{}
+	registry.Register(TestConfigType, reflect.TypeOf(TestOtherConfig{}), Resolver(func(siblings []*Config) *Config {
+		return siblings[len(siblings)-1]
+	}))
+
+	body := []byte(`{"type":"test","id":"c0","ver":1,"data":{"data":1}}`)
+
+	config := &Config{}
+	if err := registry.Unmarshal(body, config); err != nil {
+		t.Fatalf("FAIL(config): unexpected error: %s", err)
+	}
+	if _, ok := config.Data.(*TestOtherConfig); !ok {
+		t.Errorf("FAIL(config): unexpected data %T", config.Data)
+	}
+
+	if err := json.Unmarshal(body, config); err == nil {
+		t.Errorf("FAIL(default): expected error from default registry")
+	}
+
+	configs := &Configs{}
+	configs.NewConfig(config)
+	body, _ = json.Marshal(configs)
+
+	other := &Configs{}
+	if err := registry.Unmarshal(body, other); err != nil {
+		t.Fatalf("FAIL(configs): unexpected error: %s", err)
+	}
+	if result, _ := other.Get(TestConfigType, "c0"); result.Config == nil || result.Config.Data.(*TestOtherConfig).Value != 1 {
+		t.Errorf("FAIL(configs): unexpected config %v", result.Config)
+	}
+
+	// The resolver of the registry is used for concurrent updates.
+	base := VersionVector{}.Update("w0")
+	a := &Config{Type: TestConfigType, ID: "c1", Vector: base.Update("w1"), Data: &TestOtherConfig{1}}
+	b := &Config{Type: TestConfigType, ID: "c1", Vector: base.Update("w2"), Data: &TestOtherConfig{2}}
+	a.Version, b.Version = a.Vector.Version(), b.Vector.Version()
+
+	other.NewConfig(a)
+	other.NewConfig(b)
+	if result, _ := other.Get(TestConfigType, "c1"); len(result.Config.Siblings) > 0 {
+		t.Errorf("FAIL(resolver): siblings were not resolved")
+	}
+
+	file := test.NewFile()
+	defer os.Remove(file)
+
+	dir := test.NewDir()
+	defer os.RemoveAll(dir)
+
+	sqlite := test.NewFile()
+	defer os.Remove(sqlite)
+
+	retention := map[string]int{TestConfigType: 2}
+
+	dbs := []struct {
+		Title string
+		New   func() ConfigDB
+	}{
+		{"aof", func() ConfigDB { return &AOFConfigDB{File: file, HistoryRetention: retention, Registry: registry} }},
+		{"dir", func() ConfigDB { return &DirConfigDB{Dir: dir, HistoryRetention: retention, Registry: registry} }},
+		{"sqlite", func() ConfigDB { return &SQLiteConfigDB{File: sqlite, HistoryRetention: retention, Registry: registry} }},
+	}
+
+	for _, db := range dbs {
+		db0 := db.New()
+		db0.NewConfig(config)
+		db0.NewConfig(&Config{Type: TestConfigType, ID: "c0", Version: 2, Data: &TestOtherConfig{2}})
+		db0.Close()
+
+		db1 := db.New()
+		configs, err := db1.Load()
+		db1.Close()
+
+		if err != nil {
+			t.Errorf("FAIL(%s): unable to load db: %s", db.Title, err)
+		} else if result, _ := configs.Get(TestConfigType, "c0"); result.Config == nil {
+			t.Errorf("FAIL(%s): missing config", db.Title)
+		} else if _, ok := result.Config.Data.(*TestOtherConfig); !ok {
+			t.Errorf("FAIL(%s): unexpected data %T", db.Title, result.Config.Data)
+		} else if history := configs.History(TestConfigType, "c0"); len(history) != 2 || history[0].Config == nil {
+			t.Errorf("FAIL(%s): unexpected history %v", db.Title, history)
+		} else if _, ok := history[0].Config.Data.(*TestOtherConfig); !ok {
+			t.Errorf("FAIL(%s): unexpected history data %T", db.Title, history[0].Config.Data)
+		}
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Errorf("FAIL(duplicate): expected panic")
+		}
+	}()
+	registry.Register(TestConfigType, reflect.TypeOf(TestConfig{}))
+}
@@ -0,0 +1,236 @@
+// Copyright (c) 2014 Datacratic. All rights reserved.
+
+package sconf
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/fnv"
+	"io"
+	"sort"
+)
+
+// Ordering is the result of comparing two version vectors.
+type Ordering int
+
+const (
+	// VectorEqual indicates that both vectors are identical.
+	VectorEqual Ordering = iota
+
+	// VectorBefore indicates that the vector happened before the other.
+	VectorBefore
+
+	// VectorAfter indicates that the vector happened after the other.
+	VectorAfter
+
+	// VectorConcurrent indicates that neither vector happened before the
+	// other.
+	VectorConcurrent
+)
+
+// vectorHashBits is the number of low bits of the scalar version of a vector
+// used to distinguish concurrent vectors with the same number of updates.
+const vectorHashBits = 16
+
+// VersionVector tracks the causal history of a config as the number of updates
+// made by each writer. A writer updating a config increments its own counter
+// in the vector of the latest config it observed which makes the new config
+// descend from all the updates that came before it. Two configs whose vectors
+// don't descend from one another were updated concurrently.
+type VersionVector map[string]uint64
+
+// Update returns a copy of the vector with the counter of the given writer
+// incremented.
+func (vector VersionVector) Update(writer string) VersionVector {
+	result := vector.Join(nil)
+	result[writer]++
+	return result
+}
+
+// Join returns the smallest vector that descends from both vectors.
+func (vector VersionVector) Join(other VersionVector) VersionVector {
+	result := make(VersionVector)
+
+	for writer, counter := range vector {
+		result[writer] = counter
+	}
+
+	for writer, counter := range other {
+		if counter > result[writer] {
+			result[writer] = counter
+		}
+	}
+
+	return result
+}
+
+// Compare returns the causal ordering of the vector relative to the other.
+func (vector VersionVector) Compare(other VersionVector) Ordering {
+	before, after := false, false
+
+	for writer, counter := range vector {
+		if counter > other[writer] {
+			after = true
+		} else if counter < other[writer] {
+			before = true
+		}
+	}
+
+	for writer, counter := range other {
+		if _, ok := vector[writer]; !ok && counter > 0 {
+			before = true
+		}
+	}
+
+	switch {
+	case before && after:
+		return VectorConcurrent
+	case before:
+		return VectorBefore
+	case after:
+		return VectorAfter
+	default:
+		return VectorEqual
+	}
+}
+
+// Version returns the scalar version to use for a config with the vector. The
+// high bits hold the total number of updates which guarantees that a vector
+// has a greater version then all the vectors it descends from. The low bits
+// hold a hash of the vector to distinguish concurrent vectors.
+func (vector VersionVector) Version() uint64 {
+	var updates uint64
+	for _, counter := range vector {
+		updates += counter
+	}
+
+	hash := fnv.New32a()
+	vector.hash(hash)
+
+	mask := uint64(1)<<vectorHashBits - 1
+	return updates<<vectorHashBits | uint64(hash.Sum32())&mask
+}
+
+// hash writes the non-zero counters of the vector to the hash in a
+// deterministic order.
+func (vector VersionVector) hash(hash io.Writer) {
+	writers := make([]string, 0, len(vector))
+	for writer, counter := range vector {
+		if counter > 0 {
+			writers = append(writers, writer)
+		}
+	}
+
+	sort.Strings(writers)
+
+	var buffer [8]byte
+	for _, writer := range writers {
+		hash.Write([]byte(writer))
+		binary.BigEndian.PutUint64(buffer[:], vector[writer])
+		hash.Write(buffer[:])
+	}
+}
+
+// Resolver collapses the siblings of a concurrent update into a single config.
+// The returned config only needs to set the Data field. Resolvers must be
+// deterministic such that all the nodes resolve the same siblings to the same
+// data. Returning nil keeps the siblings around. Resolver is a TypeOption of
+// RegisterType.
+type Resolver func(siblings []*Config) *Config
+
+// siblings returns the concurrent configs held by the config.
+func (config *Config) siblings() []*Config {
+	if len(config.Siblings) > 0 {
+		return config.Siblings
+	}
+	return []*Config{config}
+}
+
+// mergeCausal merges two configs with version vectors by discarding the
+// configs that happened before another config and returns the result. If more
+// then one config remains, they are returned as the siblings of a new config
+// unless they're collapsed by the given resolver. The new config carries the
+// labels of the sibling that wins the merge such that it keeps matching the
+// selectors that all the siblings match.
+func mergeCausal(a, b *Config, resolver Resolver, hashes dataHashes) *Config {
+	candidates := append(append([]*Config{}, a.siblings()...), b.siblings()...)
+
+	var result []*Config
+
+	for i, config := range candidates {
+		keep := true
+
+		for j, other := range candidates {
+			if i == j {
+				continue
+			}
+
+			order := config.Vector.Compare(other.Vector)
+			if order == VectorBefore {
+				keep = false
+			} else if order == VectorEqual {
+				cmp := bytes.Compare(hashes.of(config), hashes.of(other))
+				keep = keep && (cmp > 0 || (cmp == 0 && i < j))
+			}
+		}
+
+		if keep {
+			result = append(result, config)
+		}
+	}
+
+	if len(result) == 1 {
+		return result[0]
+	}
+
+	sort.Sort(configsByVersion{result, hashes})
+
+	var vector VersionVector
+	for _, config := range result {
+		vector = vector.Join(config.Vector)
+	}
+
+	winner := result[0]
+	for _, config := range result[1:] {
+		if config.wins(winner, hashes) {
+			winner = config
+		}
+	}
+
+	merged := &Config{
+		Type:     a.Type,
+		ID:       a.ID,
+		Version:  vector.Version(),
+		Labels:   winner.Labels,
+		Vector:   vector,
+		Siblings: result,
+	}
+
+	if resolver != nil {
+		if resolved := resolver(result); resolved != nil {
+			merged.Data = resolved.Data
+			merged.Siblings = nil
+		}
+	}
+
+	return merged
+}
+
+type configsByVersion struct {
+	list   []*Config
+	hashes dataHashes
+}
+
+func (sorter configsByVersion) Len() int { return len(sorter.list) }
+
+func (sorter configsByVersion) Swap(i, j int) {
+	sorter.list[i], sorter.list[j] = sorter.list[j], sorter.list[i]
+}
+
+func (sorter configsByVersion) Less(i, j int) bool {
+	a, b := sorter.list[i], sorter.list[j]
+	if a.Version != b.Version {
+		return a.Version < b.Version
+	}
+	return bytes.Compare(sorter.hashes.of(a), sorter.hashes.of(b)) < 0
+}
@@ -0,0 +1,253 @@
+// Copyright (c) 2014 Datacratic. All rights reserved.
+
+package sconf
+
+import (
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+const TestResolvedConfigType string = "test-resolved"
+
+func init() {
+	RegisterType(TestResolvedConfigType, reflect.TypeOf(TestConfig{}), Resolver(func(siblings []*Config) *Config {
+		var data []string
+		for _, sibling := range siblings {
+			data = append(data, sibling.Data.(*TestConfig).Data)
+		}
+		sort.Strings(data)
+
+		return &Config{Data: &TestConfig{Data: strings.Join(data, "+")}}
+	}))
+}
+
+func (t TestConfigUtils) CausalConfig(typ, ID string, vector VersionVector, data string) *Config {
+	return &Config{
+		Type:    typ,
+		ID:      ID,
+		Version: vector.Version(),
+		Vector:  vector,
+		Data:    &TestConfig{Data: data},
+	}
+}
+
+func TestVersionVector(t *testing.T) {
+	base := VersionVector{}.Update("w0")
+	a := base.Update("w1")
+	b := base.Update("w2")
+	c := a.Join(b).Update("w1")
+
+	check := func(title string, x, y VersionVector, exp Ordering) {
+		if order := x.Compare(y); order != exp {
+			t.Errorf("FAIL(%s): unexpected ordering %d != %d", title, order, exp)
+		}
+	}
+
+	check("equal", a, a, VectorEqual)
+	check("before", base, a, VectorBefore)
+	check("after", a, base, VectorAfter)
+	check("concurrent", a, b, VectorConcurrent)
+	check("join", c, b, VectorAfter)
+	check("empty", VersionVector{}, base, VectorBefore)
+
+	if base.Version() >= a.Version() || a.Version() >= c.Version() {
+		t.Errorf("FAIL(version): versions don't respect causality")
+	}
+
+	if a.Version() == b.Version() {
+		t.Errorf("FAIL(version): concurrent vectors have the same version")
+	}
+
+	if len(base) != 1 {
+		t.Errorf("FAIL(update): update modified the vector: %v", base)
+	}
+}
+
+func TestConfigsCausal(test *testing.T) {
+	t := NewTestConfigsUtils(test)
+
+	base := VersionVector{}.Update("w0")
+	a := t.CausalConfig(TestConfigType, "c0", base.Update("w1"), "a")
+	b := t.CausalConfig(TestConfigType, "c0", base.Update("w2"), "b")
+
+	ab := &Configs{}
+	ab.NewConfig(t.CausalConfig(TestConfigType, "c0", base, "base"))
+	ab.NewConfig(a)
+	if _, isNew := ab.NewConfig(b); !isNew {
+		t.Errorf("FAIL(concurrent): concurrent config was not new")
+	}
+
+	ba := &Configs{}
+	ba.NewConfig(b)
+	ba.NewConfig(a)
+
+	resultAB, _ := ab.Get(TestConfigType, "c0")
+	resultBA, _ := ba.Get(TestConfigType, "c0")
+
+	if siblings := len(resultAB.Config.Siblings); siblings != 2 {
+		t.Fatalf("FAIL(siblings): unexpected sibling count %d != 2", siblings)
+	}
+
+	if IsConflict(resultAB.Config, resultBA.Config) || resultAB.Config.Version != resultBA.Config.Version {
+		t.Errorf("FAIL(merge): diverged %v != %v", resultAB.Config.Siblings, resultBA.Config.Siblings)
+	}
+
+	if _, isNew := ab.NewConfig(a); isNew {
+		t.Errorf("FAIL(sibling): existing sibling was new")
+	}
+
+	// An update that observed both siblings replaces them.
+	c := t.CausalConfig(TestConfigType, "c0", resultAB.Config.Vector.Update("w1"), "c")
+	ab.NewConfig(c)
+	ab.Merge(ba)
+
+	if result, _ := ab.Get(TestConfigType, "c0"); result.Config != c {
+		t.Errorf("FAIL(collapse): unexpected config %v", result.Config)
+	}
+
+	// Configs without vectors are merged as usual.
+	if _, isNew := ab.NewConfig(t.Config("c0", c.Version+1)); !isNew {
+		t.Errorf("FAIL(scalar): config was not new")
+	}
+}
+
+func TestConfigsCausalResolver(test *testing.T) {
+	t := NewTestConfigsUtils(test)
+
+	base := VersionVector{}.Update("w0")
+	a := t.CausalConfig(TestResolvedConfigType, "c0", base.Update("w1"), "a")
+	b := t.CausalConfig(TestResolvedConfigType, "c0", base.Update("w2"), "b")
+
+	ab := &Configs{}
+	ab.NewConfig(a)
+	ab.NewConfig(b)
+
+	ba := &Configs{}
+	ba.NewConfig(b)
+	ba.NewConfig(a)
+
+	resultAB, _ := ab.Get(TestResolvedConfigType, "c0")
+	resultBA, _ := ba.Get(TestResolvedConfigType, "c0")
+
+	if len(resultAB.Config.Siblings) != 0 {
+		t.Fatalf("FAIL(resolve): siblings were not resolved")
+	}
+
+	if data := resultAB.Config.Data.(*TestConfig).Data; data != "a+b" {
+		t.Errorf("FAIL(resolve): unexpected data '%s'", data)
+	}
+
+	if IsConflict(resultAB.Config, resultBA.Config) {
+		t.Errorf("FAIL(resolve): diverged %v != %v", resultAB.Config.Data, resultBA.Config.Data)
+	}
+
+	if _, isNew := ab.NewConfig(b); isNew {
+		t.Errorf("FAIL(resolve): resolved sibling was new")
+	}
+}
+
+func TestRouterCausal(t *testing.T) {
+	test := NewTestRouterUtils(t)
+
+	handler := test.NewHandler()
+	router := test.NewRouter(handler)
+
+	base := VersionVector{}.Update("w0")
+	a := test.CausalConfig(TestConfigType, "c0", base.Update("w1"), "a")
+	b := test.CausalConfig(TestConfigType, "c0", base.Update("w2"), "b")
+
+	router.NewConfig(a)
+	handler.ExpectNew(a)
+
+	router.NewConfig(b)
+	test.WaitForPropagation()
+
+	result, _ := router.PullConfigs().Get(TestConfigType, "c0")
+	if len(result.Config.Siblings) != 2 {
+		t.Fatalf("FAIL(router): siblings were not kept: %v", result.Config)
+	}
+
+	handler.ExpectNew(result.Config)
+}
+
+func TestRouterCausalSelector(t *testing.T) {
+	test := NewTestRouterUtils(t)
+
+	handler := &TestSelectableHandler{test.NewHandler(), MustParseSelector("env=prod")}
+	router := test.NewRouter(handler)
+	sub := router.Watch(WatchOptions{Selector: MustParseSelector("env=prod")})
+
+	base := VersionVector{}.Update("w0")
+	a := test.CausalConfig(TestConfigType, "c0", base.Update("w1"), "a")
+	b := test.CausalConfig(TestConfigType, "c0", base.Update("w2"), "b")
+	a.Labels = map[string]string{"env": "prod"}
+	b.Labels = map[string]string{"env": "prod"}
+
+	router.NewConfigSync(a)
+	router.NewConfigSync(b)
+
+	result, _ := router.PullConfigs().Get(TestConfigType, "c0")
+	if len(result.Config.Siblings) != 2 || result.Config.Labels["env"] != "prod" {
+		t.Fatalf("FAIL(labels): unexpected merged config %v %v", result.Config, result.Config.Labels)
+	}
+
+	// Concurrent updates that match the selector keep matching it.
+	handler.ExpectNew(a)
+	handler.ExpectNew(result.Config)
+	handler.ExpectDead()
+
+	for _, exp := range []WatchEventType{WatchNew, WatchReplaced} {
+		if event := <-sub.C; event.Type != exp {
+			t.Errorf("FAIL(watch): unexpected event %s != %s", event.Type, exp)
+		}
+	}
+}
+
+func TestConfigPersistCausal(t *testing.T) {
+	test := NewConfigPersistUtilsTest(t)
+
+	file := test.NewFile()
+	defer os.Remove(file)
+
+	dir := test.NewDir()
+	defer os.RemoveAll(dir)
+
+	sqlite := test.NewFile()
+	defer os.Remove(sqlite)
+
+	dbs := []struct {
+		Title string
+		New   func() ConfigDB
+	}{
+		{"aof", func() ConfigDB { return &AOFConfigDB{File: file} }},
+		{"dir", func() ConfigDB { return &DirConfigDB{Dir: dir} }},
+		{"sqlite", func() ConfigDB { return &SQLiteConfigDB{File: sqlite} }},
+	}
+
+	base := VersionVector{}.Update("w0")
+	a := test.CausalConfig(TestConfigType, "c0", base.Update("w1"), "a")
+	b := test.CausalConfig(TestConfigType, "c0", base.Update("w2"), "b")
+
+	for _, db := range dbs {
+		db0 := db.New()
+		db0.NewConfig(a)
+		db0.NewConfig(b)
+		db0.Close()
+
+		db1 := db.New()
+		state := test.Load(db.Title, db1)
+		db1.Close()
+
+		if state == nil {
+			continue
+		}
+
+		config, _ := state.Configs.Get("c0")
+		if config == nil || len(config.Siblings) != 2 || config.Vector.Compare(a.Vector.Join(b.Vector)) != VectorEqual {
+			t.Errorf("FAIL(%s): siblings were not persisted: %v", db.Title, config)
+		}
+	}
+}
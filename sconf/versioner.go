@@ -0,0 +1,132 @@
+// Copyright (c) 2014 Datacratic. All rights reserved.
+
+package sconf
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// ErrClockSkew is the error returned by Versioner when an observed version is
+// too far ahead of the local clock.
+var ErrClockSkew = errors.New("ClockSkew")
+
+// DefaultVersionerMaxSkew is the default maximum clock skew tolerated by
+// Versioner.
+const DefaultVersionerMaxSkew = 1 * time.Minute
+
+// hlcLogicalBits is the number of low bits of a version used by the logical
+// counter of the hybrid logical clock. The remaining high bits hold the
+// physical time in milliseconds since the unix epoch.
+const hlcLogicalBits = 16
+
+// HLCVersion returns the smallest hybrid logical clock version for the given
+// time. Can be used as the Version function of TombstoneCollector.
+func HLCVersion(t time.Time) uint64 {
+	return uint64(t.UnixNano()/int64(time.Millisecond)) << hlcLogicalBits
+}
+
+// HLCTime returns the physical time of the given hybrid logical clock version.
+func HLCTime(version uint64) time.Time {
+	ms := int64(version >> hlcLogicalBits)
+	return time.Unix(ms/1000, (ms%1000)*int64(time.Millisecond))
+}
+
+// Versioner generates config versions using a hybrid logical clock packed
+// into a uint64: the high 48 bits hold the physical time in milliseconds and
+// the low 16 bits hold a logical counter. Generated versions are strictly
+// increasing and are always greater then any version previously observed which
+// allows multiple writers to produce versions that respect causality even when
+// their clocks are not perfectly synchronized.
+//
+// Versioner implements the Handler interface so that it can observe the
+// versions of all the config events processed by a Router. Observed versions
+// that are ahead of the local clock by more then MaxSkew are reported as
+// errors and ignored to avoid dragging the clock into the future.
+//
+// All the functions of Versioner are safe to call concurrently.
+type Versioner struct {
+	Component
+
+	// MaxSkew indicates how far ahead of the local clock an observed version
+	// can be before it's rejected. Defaults to DefaultVersionerMaxSkew.
+	MaxSkew time.Duration
+
+	// Clock returns the current time. Defaults to time.Now.
+	Clock func() time.Time
+
+	initialize sync.Once
+
+	lock sync.Mutex
+	last uint64
+}
+
+// Init initializes the object.
+func (versioner *Versioner) Init() {
+	versioner.initialize.Do(versioner.init)
+}
+
+func (versioner *Versioner) init() {
+	if versioner.MaxSkew == 0 {
+		versioner.MaxSkew = DefaultVersionerMaxSkew
+	}
+
+	if versioner.Clock == nil {
+		versioner.Clock = time.Now
+	}
+}
+
+// Next returns a new version which is strictly greater then all the versions
+// previously generated or observed.
+func (versioner *Versioner) Next() uint64 {
+	versioner.Init()
+
+	now := HLCVersion(versioner.Clock())
+
+	versioner.lock.Lock()
+	defer versioner.lock.Unlock()
+
+	if now > versioner.last {
+		versioner.last = now
+	} else {
+		versioner.last++
+	}
+
+	return versioner.last
+}
+
+// Observe advances the clock such that the versions generated afterwards are
+// greater then the given version. Returns ErrClockSkew and leaves the clock
+// untouched if the version is too far ahead of the local clock.
+func (versioner *Versioner) Observe(version uint64) error {
+	versioner.Init()
+
+	if version > HLCVersion(versioner.Clock().Add(versioner.MaxSkew)) {
+		return ErrClockSkew
+	}
+
+	versioner.lock.Lock()
+	defer versioner.lock.Unlock()
+
+	if version > versioner.last {
+		versioner.last = version
+	}
+
+	return nil
+}
+
+// NewConfig observes the version of the config.
+func (versioner *Versioner) NewConfig(config *Config) {
+	if err := versioner.Observe(config.Version); err != nil {
+		versioner.Error(fmt.Errorf("unable to observe config %s: %s", config, err))
+	}
+}
+
+// DeadConfig observes the version of the tombstone.
+func (versioner *Versioner) DeadConfig(tombstone *Tombstone) {
+	if err := versioner.Observe(tombstone.Version); err != nil {
+		versioner.Error(fmt.Errorf("unable to observe tombstone %s: %s", tombstone, err))
+	}
+}
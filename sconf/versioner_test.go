@@ -0,0 +1,89 @@
+// Copyright (c) 2014 Datacratic. All rights reserved.
+
+package sconf
+
+import (
+	"testing"
+	"time"
+)
+
+func TestVersioner(t *testing.T) {
+	now := time.Unix(1400000000, 0)
+	versioner := &Versioner{
+		MaxSkew: time.Second,
+		Clock:   func() time.Time { return now },
+	}
+
+	v0 := versioner.Next()
+	if v0 != HLCVersion(now) {
+		t.Errorf("FAIL(next): unexpected version %d != %d", v0, HLCVersion(now))
+	}
+
+	if ts := HLCTime(v0); !ts.Equal(now) {
+		t.Errorf("FAIL(time): unexpected time %s != %s", ts, now)
+	}
+
+	// The logical counter ensures progress when the clock stalls.
+	if v1 := versioner.Next(); v1 != v0+1 {
+		t.Errorf("FAIL(stall): unexpected version %d != %d", v1, v0+1)
+	}
+
+	// Observed versions drag the clock forward.
+	ahead := HLCVersion(now.Add(500 * time.Millisecond))
+	if err := versioner.Observe(ahead + 10); err != nil {
+		t.Errorf("FAIL(observe): unexpected error: %s", err)
+	}
+
+	if v2 := versioner.Next(); v2 != ahead+11 {
+		t.Errorf("FAIL(observe): unexpected version %d != %d", v2, ahead+11)
+	}
+
+	// Excessive skew is rejected and doesn't move the clock.
+	if err := versioner.Observe(HLCVersion(now.Add(time.Minute))); err != ErrClockSkew {
+		t.Errorf("FAIL(skew): expected skew error: %v", err)
+	}
+
+	if v3 := versioner.Next(); v3 != ahead+12 {
+		t.Errorf("FAIL(skew): unexpected version %d != %d", v3, ahead+12)
+	}
+
+	now = now.Add(time.Second)
+	if v4 := versioner.Next(); v4 != HLCVersion(now) {
+		t.Errorf("FAIL(tick): unexpected version %d != %d", v4, HLCVersion(now))
+	}
+}
+
+func TestRouterVersioner(t *testing.T) {
+	test := NewTestRouterUtils(t)
+
+	versioner := &Versioner{}
+	router := &Router{Versioner: versioner}
+
+	remote := HLCVersion(time.Now().Add(time.Hour))
+	router.NewConfig(test.Config("c0", 0))
+	router.NewConfig(test.Config("c1", 5))
+	router.NewConfig(test.Config("c2", remote))
+	test.WaitForPropagation()
+
+	configs := router.PullConfigs()
+
+	if result, _ := configs.Get(TestConfigType, "c0"); result.Config == nil || result.Config.Version == 0 {
+		t.Errorf("FAIL(stamp): config wasn't stamped: %v", result.Config)
+	}
+
+	if result, _ := configs.Get(TestConfigType, "c1"); result.Config == nil || result.Config.Version != 5 {
+		t.Errorf("FAIL(stamp): config was stamped: %v", result.Config)
+	}
+
+	// The remote version is too far ahead to be observed.
+	if v := versioner.Next(); v >= remote {
+		t.Errorf("FAIL(skew): clock was dragged by skewed version: %d >= %d", v, remote)
+	}
+
+	router.DeadConfig(test.Tomb("c0", 0))
+	test.WaitForPropagation()
+
+	if result, _ := router.PullConfigs().Get(TestConfigType, "c0"); result.Tombstone == nil {
+		t.Errorf("FAIL(dead): stamped tombstone didn't kill config: %v", result.Config)
+	}
+}
@@ -0,0 +1,384 @@
+// Copyright (c) 2014 Datacratic. All rights reserved.
+
+package sconf
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+)
+
+// WatchEventType indicates the kind of a WatchEvent.
+type WatchEventType int
+
+const (
+	// WatchNew indicates a config that isn't replacing a config seen by the
+	// subscription.
+	WatchNew WatchEventType = iota
+
+	// WatchReplaced indicates a config that replaces a config seen by the
+	// subscription.
+	WatchReplaced
+
+	// WatchDead indicates that a config was killed or stopped matching the
+	// selector of the subscription.
+	WatchDead
+)
+
+// String returns the name of the event type.
+func (typ WatchEventType) String() string {
+	switch typ {
+	case WatchNew:
+		return "new"
+	case WatchReplaced:
+		return "replaced"
+	case WatchDead:
+		return "dead"
+	}
+	return "unknown"
+}
+
+// WatchEvent is a configuration event delivered to a Subscription.
+type WatchEvent struct {
+	Type WatchEventType
+
+	// Config is the new config of WatchNew and WatchReplaced events.
+	Config *Config
+
+	// OldConfig is the config being replaced by a WatchReplaced event or being
+	// killed by a WatchDead event. Can be nil for WatchDead events of configs
+	// that were already dead.
+	OldConfig *Config
+
+	// Tombstone is the tombstone of WatchDead events. Configs that stop
+	// matching the selector of the subscription are killed by a tombstone with
+	// the version of the new config.
+	Tombstone *Tombstone
+}
+
+// OverflowPolicy indicates what happens to the events delivered to a
+// Subscription whose channel is full. The router never blocks on a
+// subscription.
+type OverflowPolicy int
+
+const (
+	// OverflowCancel cancels the subscription when an event can't be
+	// delivered. Err then returns ErrWatchOverflow and the subscriber can
+	// resynchronize by watching again with Replay set.
+	OverflowCancel OverflowPolicy = iota
+
+	// OverflowDropNewest drops the events that can't be delivered.
+	OverflowDropNewest
+
+	// OverflowDropOldest drops the oldest event of the channel to make room for
+	// the new event.
+	OverflowDropOldest
+)
+
+// ErrWatchOverflow is returned by Subscription.Err when the subscription was
+// cancelled because the subscriber fell behind.
+var ErrWatchOverflow = errors.New("WatchOverflow")
+
+// DefaultWatchBufferSize is the number of events that can be buffered in the
+// channel of a Subscription.
+const DefaultWatchBufferSize = 1 << 8
+
+// WatchOptions filters the configuration events delivered to a Subscription and
+// controls how they are delivered.
+type WatchOptions struct {
+
+	// Types contains the config types to watch. An empty list watches all the
+	// config types.
+	Types []string
+
+	// Selector must be matched by the labels of the configs to watch. A config
+	// whose labels stop matching the selector is delivered as a WatchDead
+	// event. The empty selector matches all the configs.
+	Selector Selector
+
+	// Replay indicates that the live configs of the router should be delivered
+	// as WatchNew events before any other event. The replayed configs are
+	// buffered in addition to BufferSize.
+	Replay bool
+
+	// BufferSize indicates the number of events that can be buffered in the
+	// channel of the subscription. Defaults to DefaultWatchBufferSize.
+	BufferSize int
+
+	// Overflow indicates what happens to events that can't be delivered
+	// because the channel is full. Defaults to OverflowCancel.
+	Overflow OverflowPolicy
+}
+
+// Subscription delivers the configuration events of a Router that match its
+// WatchOptions. Events are delivered in the order they are processed by the
+// router which is before they are visible via Router.PullConfigs.
+type Subscription struct {
+
+	// C is the channel on which the events are delivered. The channel is
+	// closed once the subscription is cancelled.
+	C <-chan WatchEvent
+
+	options WatchOptions
+	types   map[string]bool
+
+	c       chan WatchEvent
+	closed  bool
+	err     error
+	dropped uint64
+
+	router *Router
+	cancel sync.Once
+	doneC  chan int
+}
+
+// Watch subscribes to the configuration events that match the given options.
+// The subscription can be added and cancelled at any time but Watch and Cancel
+// must not be called from a handler or object of the router. Watching a closed
+// router returns a subscription whose channel is already closed.
+func (router *Router) Watch(options WatchOptions) *Subscription {
+	router.Init()
+
+	sub := &Subscription{options: options, router: router, doneC: make(chan int, 1)}
+
+	if len(options.Types) > 0 {
+		sub.types = make(map[string]bool)
+		for _, typ := range options.Types {
+			sub.types[typ] = true
+		}
+	}
+
+	select {
+	case router.watchC <- sub:
+	case <-router.closedC:
+		sub.routerClosed()
+		return sub
+	}
+
+	select {
+	case <-sub.doneC:
+	case <-router.closedC:
+		sub.routerClosed()
+	}
+
+	return sub
+}
+
+// Cancel removes the subscription from the router and closes its channel.
+// Events buffered in the channel can still be read. Returns immediately if the
+// router was closed since its subscriptions are closed along with it.
+func (sub *Subscription) Cancel() {
+	sub.cancel.Do(func() {
+		select {
+		case sub.router.unwatchC <- sub:
+		case <-sub.router.closedC:
+			return
+		}
+
+		select {
+		case <-sub.doneC:
+		case <-sub.router.closedC:
+		}
+	})
+}
+
+// Err returns ErrWatchOverflow if the subscription was cancelled because an
+// event couldn't be delivered. Should only be called once C is closed.
+func (sub *Subscription) Err() error {
+	return sub.err
+}
+
+// Dropped returns the number of events dropped by the overflow policy.
+func (sub *Subscription) Dropped() uint64 {
+	return atomic.LoadUint64(&sub.dropped)
+}
+
+// watches returns true if the config should be delivered to the subscription.
+func (sub *Subscription) watches(config *Config) bool {
+	if sub.types != nil && !sub.types[config.Type] {
+		return false
+	}
+	return sub.options.Selector.Matches(config.Labels)
+}
+
+// open creates the channel of the subscription and delivers the replayed
+// configs.
+func (sub *Subscription) open(configs *Configs) {
+	var replay []*Config
+	if sub.options.Replay {
+		for _, config := range configs.ConfigArray() {
+			if sub.watches(config) {
+				replay = append(replay, config)
+			}
+		}
+	}
+
+	size := sub.options.BufferSize
+	if size < 1 {
+		size = DefaultWatchBufferSize
+	}
+
+	sub.c = make(chan WatchEvent, size+len(replay))
+	sub.C = sub.c
+
+	for _, config := range replay {
+		sub.c <- WatchEvent{Type: WatchNew, Config: config}
+	}
+}
+
+// routerClosed closes the subscription of a router that was closed before it
+// could process the subscription. Must only be called once the goroutine of the
+// router exited.
+func (sub *Subscription) routerClosed() {
+	if sub.c == nil {
+		sub.c = make(chan WatchEvent)
+		sub.C = sub.c
+	}
+	sub.close(nil)
+}
+
+func (sub *Subscription) close(err error) {
+	if !sub.closed {
+		sub.err = err
+		sub.closed = true
+		close(sub.c)
+	}
+}
+
+// send delivers the event without blocking and returns false if the
+// subscription was cancelled by the overflow policy.
+func (sub *Subscription) send(event WatchEvent) bool {
+	select {
+	case sub.c <- event:
+		return true
+	default:
+	}
+
+	switch sub.options.Overflow {
+
+	case OverflowDropNewest:
+		atomic.AddUint64(&sub.dropped, 1)
+
+	case OverflowDropOldest:
+		select {
+		case <-sub.c:
+			atomic.AddUint64(&sub.dropped, 1)
+		default:
+		}
+
+		select {
+		case sub.c <- event:
+		default:
+			atomic.AddUint64(&sub.dropped, 1)
+		}
+
+	default:
+		sub.close(ErrWatchOverflow)
+		return false
+	}
+
+	return true
+}
+
+// newConfig delivers the replacement of the old config by the new config where
+// each config is only seen by the subscription if it's watched.
+func (sub *Subscription) newConfig(oldConfig, config *Config) bool {
+	if sub.types != nil && !sub.types[config.Type] {
+		return true
+	}
+
+	wasWatched := oldConfig != nil && sub.watches(oldConfig)
+
+	if sub.watches(config) {
+		if wasWatched {
+			return sub.send(WatchEvent{Type: WatchReplaced, Config: config, OldConfig: oldConfig})
+		}
+		return sub.send(WatchEvent{Type: WatchNew, Config: config})
+	}
+
+	if wasWatched {
+		tombstone := &Tombstone{Type: config.Type, ID: config.ID, Version: config.Version}
+		return sub.send(WatchEvent{Type: WatchDead, OldConfig: oldConfig, Tombstone: tombstone})
+	}
+
+	return true
+}
+
+// deadConfig delivers the tombstone unless the subscription has a selector and
+// didn't watch the killed config.
+func (sub *Subscription) deadConfig(oldConfig *Config, tombstone *Tombstone) bool {
+	if sub.types != nil && !sub.types[tombstone.Type] {
+		return true
+	}
+
+	if len(sub.options.Selector) > 0 && (oldConfig == nil || !sub.watches(oldConfig)) {
+		return true
+	}
+
+	return sub.send(WatchEvent{Type: WatchDead, OldConfig: oldConfig, Tombstone: tombstone})
+}
+
+func (router *Router) watch(sub *Subscription) {
+	state := router.get().Copy()
+
+	state.watch(sub)
+	router.commit(state)
+}
+
+func (router *Router) unwatch(sub *Subscription) {
+	state := router.get().Copy()
+
+	state.unwatch(sub)
+	router.commit(state)
+}
+
+func (state *routerState) watch(sub *Subscription) {
+	sub.open(state.Configs)
+	state.watchers = appendWatcher(state.watchers, sub)
+	sub.doneC <- 1
+}
+
+func (state *routerState) unwatch(sub *Subscription) {
+	state.removeWatcher(sub)
+	sub.close(nil)
+	sub.doneC <- 1
+}
+
+func (state *routerState) removeWatcher(sub *Subscription) {
+	for i, watcher := range state.watchers {
+		if watcher == sub {
+			watchers := make([]*Subscription, 0, len(state.watchers)-1)
+			watchers = append(watchers, state.watchers[:i]...)
+			state.watchers = append(watchers, state.watchers[i+1:]...)
+			return
+		}
+	}
+}
+
+// watchNewConfig delivers a new config to the subscriptions and removes the
+// subscriptions cancelled by their overflow policy.
+func (state *routerState) watchNewConfig(oldConfig, config *Config) {
+	for _, sub := range state.watchers {
+		if !sub.newConfig(oldConfig, config) {
+			state.removeWatcher(sub)
+		}
+	}
+}
+
+// watchDeadConfig delivers a tombstone to the subscriptions and removes the
+// subscriptions cancelled by their overflow policy.
+func (state *routerState) watchDeadConfig(oldConfig *Config, tombstone *Tombstone) {
+	for _, sub := range state.watchers {
+		if !sub.deadConfig(oldConfig, tombstone) {
+			state.removeWatcher(sub)
+		}
+	}
+}
+
+// closeWatchers closes the channels of all the subscriptions.
+func (state *routerState) closeWatchers() {
+	for _, sub := range state.watchers {
+		sub.close(nil)
+	}
+	state.watchers = nil
+}
@@ -0,0 +1,158 @@
+// Copyright (c) 2014 Datacratic. All rights reserved.
+
+package sconf
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func (sub *Subscription) Expect(t *testing.T, title string, exp ...string) {
+	for _, e := range exp {
+		select {
+		case event, ok := <-sub.C:
+			if !ok {
+				t.Errorf("FAIL(%s): channel closed, expected %s", title, e)
+				return
+			}
+
+			var result string
+			if event.Type == WatchDead {
+				result = fmt.Sprintf("%s:%s:%d", event.Type, event.Tombstone.ID, event.Tombstone.Version)
+			} else {
+				result = fmt.Sprintf("%s:%s:%d", event.Type, event.Config.ID, event.Config.Version)
+			}
+
+			if result != e {
+				t.Errorf("FAIL(%s): unexpected event %s != %s", title, result, e)
+			}
+
+		default:
+			t.Errorf("FAIL(%s): missing event %s", title, e)
+			return
+		}
+	}
+
+	select {
+	case event, ok := <-sub.C:
+		if ok {
+			t.Errorf("FAIL(%s): extra event %v", title, event)
+		}
+	default:
+	}
+}
+
+func TestRouterWatch(t *testing.T) {
+	test := NewTestRouterUtils(t)
+
+	router := &Router{}
+	router.NewConfigSync(test.ConfigT("t1", "c0", 1))
+	router.NewConfigSync(test.ConfigT("t2", "c1", 1))
+
+	all := router.Watch(WatchOptions{})
+	all.Expect(t, "no-replay")
+
+	typed := router.Watch(WatchOptions{Types: []string{"t1"}, Replay: true})
+	typed.Expect(t, "replay", "new:c0:1")
+
+	router.NewConfigSync(test.ConfigT("t1", "c0", 2))
+	router.NewConfigSync(test.ConfigT("t2", "c2", 1))
+	router.DeadConfigSync(test.TombT("t1", "c0", 3))
+	router.NewConfigSync(test.ConfigT("t1", "c0", 1))
+
+	all.Expect(t, "all", "replaced:c0:2", "new:c2:1", "dead:c0:3")
+	typed.Expect(t, "typed", "replaced:c0:2", "dead:c0:3")
+
+	typed.Cancel()
+	typed.Cancel()
+
+	router.NewConfigSync(test.ConfigT("t1", "c3", 1))
+	all.Expect(t, "cancel", "new:c3:1")
+
+	if _, ok := <-typed.C; ok {
+		t.Errorf("FAIL(cancel): channel not closed")
+	}
+	if err := typed.Err(); err != nil {
+		t.Errorf("FAIL(cancel): unexpected error: %s", err)
+	}
+
+	router.Close()
+
+	if _, ok := <-all.C; ok {
+		t.Errorf("FAIL(close): channel not closed")
+	}
+
+	doneC := make(chan int)
+	go func() {
+		all.Cancel()
+		close(doneC)
+	}()
+
+	select {
+	case <-doneC:
+	case <-time.After(time.Second):
+		t.Errorf("FAIL(close): cancel blocked once the router was closed")
+	}
+
+	watchC := make(chan *Subscription)
+	go func() { watchC <- router.Watch(WatchOptions{Replay: true}) }()
+
+	select {
+	case sub := <-watchC:
+		if _, ok := <-sub.C; ok {
+			t.Errorf("FAIL(watch-closed): channel not closed")
+		}
+		sub.Cancel()
+
+	case <-time.After(time.Second):
+		t.Errorf("FAIL(watch-closed): watch blocked once the router was closed")
+	}
+}
+
+func TestRouterWatchSelector(t *testing.T) {
+	test := NewTestRouterUtils(t)
+
+	router := &Router{}
+	sub := router.Watch(WatchOptions{Selector: MustParseSelector("env=prod")})
+
+	router.NewConfigSync(test.Labeled("c0", 1, "env", "dev"))
+	router.NewConfigSync(test.Labeled("c0", 2, "env", "prod"))
+	router.NewConfigSync(test.Labeled("c0", 3, "env", "prod"))
+	router.NewConfigSync(test.Labeled("c0", 4, "env", "dev"))
+	router.DeadConfigSync(test.Tomb("c0", 5))
+	router.NewConfigSync(test.Labeled("c1", 1, "env", "prod"))
+	router.DeadConfigSync(test.Tomb("c1", 2))
+
+	sub.Expect(t, "selector", "new:c0:2", "replaced:c0:3", "dead:c0:4", "new:c1:1", "dead:c1:2")
+}
+
+func TestRouterWatchOverflow(t *testing.T) {
+	test := NewTestRouterUtils(t)
+
+	router := &Router{}
+
+	cancel := router.Watch(WatchOptions{BufferSize: 1})
+	newest := router.Watch(WatchOptions{BufferSize: 1, Overflow: OverflowDropNewest})
+	oldest := router.Watch(WatchOptions{BufferSize: 1, Overflow: OverflowDropOldest})
+
+	router.NewConfigSync(test.Config("c0", 1))
+	router.NewConfigSync(test.Config("c1", 1))
+	router.NewConfigSync(test.Config("c2", 1))
+
+	cancel.Expect(t, "cancel", "new:c0:1")
+	if err := cancel.Err(); err != ErrWatchOverflow {
+		t.Errorf("FAIL(cancel): unexpected error: %v", err)
+	}
+	cancel.Cancel()
+
+	newest.Expect(t, "newest", "new:c0:1")
+	if dropped := newest.Dropped(); dropped != 2 {
+		t.Errorf("FAIL(newest): unexpected dropped count %d", dropped)
+	}
+
+	oldest.Expect(t, "oldest", "new:c2:1")
+	if dropped := oldest.Dropped(); dropped != 2 {
+		t.Errorf("FAIL(oldest): unexpected dropped count %d", dropped)
+	}
+}
@@ -0,0 +1,78 @@
+// Copyright (c) 2014 Datacratic. All rights reserved.
+
+// sconfctl is a command-line tool used to operate on the configs of an sconf
+// HTTP config endpoint.
+//
+// Usage:
+//
+//	sconfctl -url <endpoint-url> rollback <type> <id> [<version>]
+//
+// The rollback command re-emits the data of the config at the given version as
+// a new config and prints the version of the new config. Omitting the version
+// rolls back to the live config that precedes the current state which also
+// resurrects a killed config. The endpoint must retain the history of the
+// config's type.
+package main
+
+import (
+	"github.com/datacratic/gosconf/sconf"
+
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+)
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "usage: %s -url <endpoint-url> rollback <type> <id> [<version>]\n", os.Args[0])
+	flag.PrintDefaults()
+	os.Exit(2)
+}
+
+func main() {
+	URL := flag.String("url", "", "URL of the HTTP config endpoint")
+	flag.Usage = usage
+	flag.Parse()
+
+	args := flag.Args()
+	if len(*URL) == 0 || len(args) == 0 {
+		usage()
+	}
+
+	client := &sconf.HTTPClient{
+		Component: sconf.Component{Name: "sconfctl"},
+		URL:       *URL,
+	}
+
+	switch args[0] {
+
+	case "rollback":
+		rollback(client, args[1:])
+
+	default:
+		usage()
+
+	}
+}
+
+func rollback(client *sconf.HTTPClient, args []string) {
+	if len(args) < 2 || len(args) > 3 {
+		usage()
+	}
+
+	var version uint64
+	if len(args) == 3 {
+		var err error
+		if version, err = strconv.ParseUint(args[2], 10, 64); err != nil {
+			fmt.Fprintf(os.Stderr, "invalid version '%s': %s\n", args[2], err)
+			os.Exit(2)
+		}
+	}
+
+	newVersion, ok := client.Rollback(args[0], args[1], version)
+	if !ok {
+		os.Exit(1)
+	}
+
+	fmt.Println(newVersion)
+}